@@ -0,0 +1,38 @@
+// Command faketruelayer serves a fake TrueLayer with a demo bank connection,
+// for running the app locally without real bank credentials. Start the app
+// with TRUELAYER_API_URL and TRUELAYER_AUTH_URL set to the URL it prints.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/truelayer/truelayertest"
+)
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:8081", "address to listen on")
+	seed := flag.Int64("seed", 1, "seed for the demo connection's transactions")
+	flag.Parse()
+
+	l, err := net.Listen("tcp", *addr)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fake := truelayertest.NewUnstartedServer()
+	fake.Listener.Close()
+	fake.Listener = l
+	fake.AddConnection("demo", truelayertest.DemoConnection(*seed, time.Now()))
+	fake.Start()
+	defer fake.Close()
+	fmt.Printf("Fake TrueLayer at %s\n", fake.URL)
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	<-sig
+}
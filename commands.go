@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/arussellsaw/youneedaspreadsheet/domain"
+	"github.com/arussellsaw/youneedaspreadsheet/handler"
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/syncer"
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/token"
+)
+
+// commands can be run instead of the server with `youneedaspreadsheet <command> [flags]`
+var commands = map[string]func(ctx context.Context, args []string) error{
+	"rotate-tokens":  rotateTokens,
+	"sync":           syncUser,
+	"check-consents": checkConsents,
+}
+
+func runCommand(ctx context.Context, name string, args []string) error {
+	cmd, ok := commands[name]
+	if !ok {
+		var names []string
+		for n := range commands {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown command, expected one of: %s", strings.Join(names, ", "))
+	}
+	return cmd(ctx, args)
+}
+
+func rotateTokens(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("rotate-tokens", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "report which tokens would be rotated without writing")
+	resume := fs.Bool("resume", false, "continue the last unfinished rotation")
+	list := fs.Bool("list", false, "list previous rotations and exit")
+	fs.Parse(args)
+
+	if *list {
+		runs, err := token.ListRotations(ctx)
+		if err != nil {
+			return err
+		}
+		for _, run := range runs {
+			fmt.Printf("%s\tstarted %s\tfinished %s\tkey %s\trotated %d\tcurrent %d\tfailed %d\n",
+				run.ID, run.Started.Format("2006-01-02 15:04"), run.Finished.Format("2006-01-02 15:04"),
+				run.KeyName, run.Rotated, run.Current, run.Failed)
+		}
+		return nil
+	}
+
+	run, err := token.Rotate(ctx, token.RotateOptions{
+		DryRun: *dryRun,
+		Resume: *resume,
+		Progress: func(run *token.RotationRun) {
+			fmt.Fprintf(os.Stderr, "\r%d/%d tokens: %d rotated, %d current, %d failed",
+				run.Rotated+run.Current+run.Failed, run.Total, run.Rotated, run.Current, run.Failed)
+		},
+	})
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return err
+	}
+	for _, e := range run.Errors {
+		fmt.Println(e)
+	}
+	if *dryRun {
+		fmt.Printf("dry run: %d tokens would be rotated to %s\n", run.Rotated, run.KeyName)
+		return nil
+	}
+	if run.Failed > 0 {
+		return fmt.Errorf("%d tokens failed to rotate", run.Failed)
+	}
+	return nil
+}
+
+func syncUser(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("sync", flag.ExitOnError)
+	userID := fs.String("user", "", "ID of the user to sync")
+	email := fs.String("email", "", "email of the user to sync, if -user isn't set")
+	backfill := fs.Bool("backfill", false, "fetch every account's full transaction history")
+	dryRun := fs.Bool("dry-run", false, "print the changes the sync would make to the sheet without writing them")
+	reapply := fs.Bool("reapply-rules", false, "apply the user's categorisation rules to every row already in their sheets")
+	fs.Parse(args)
+
+	var (
+		u   *domain.User
+		err error
+	)
+	switch {
+	case *userID != "":
+		u, err = domain.UserByID(ctx, *userID)
+	case *email != "":
+		u, err = domain.UserByEmail(ctx, *email)
+		if err == nil && u == nil {
+			err = fmt.Errorf("no user with email %s", *email)
+		}
+	default:
+		return fmt.Errorf("one of -user or -email is required")
+	}
+	if err != nil {
+		return err
+	}
+
+	e, err := syncer.FromContext(ctx)
+	if err != nil {
+		return err
+	}
+	res, syncErr := e.Sync(ctx, u, syncer.Options{Trigger: domain.TriggerManual, Backfill: *backfill, DryRun: *dryRun, ReapplyRules: *reapply})
+	buf, err := json.MarshalIndent(res, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(buf))
+	return syncErr
+}
+
+func checkConsents(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("check-consents", flag.ExitOnError)
+	within := fs.Duration("within", handler.ConsentReminderWindow, "flag connections whose consent expires within this long")
+	fs.Parse(args)
+
+	n, err := handler.CheckConsents(ctx, *within)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("flagged %d connections for renewal\n", n)
+	return nil
+}
@@ -0,0 +1,164 @@
+package domain
+
+import (
+	"sort"
+	"time"
+)
+
+// AccountState is what we remember about a synced bank account or card
+// between syncs.
+type AccountState struct {
+	ID           string
+	Name         string
+	Provider     string
+	ConnectionID string
+	LastSynced   time.Time
+	LastError    string
+	LastErrorAt  time.Time
+	LastBalance  *Balance
+	// Watermark is when the account's transactions were last fetched and
+	// written successfully, the next sync only fetches from shortly before it.
+	Watermark time.Time
+	// Columns are the transaction fields the account's sheet was last
+	// written with, empty for sheets written before columns were configurable.
+	Columns []string
+	// BaseCurrency is the currency amounts in the account's sheet were last
+	// converted into.
+	BaseCurrency string
+	// SheetID is the ID of the tab the account's transactions are written
+	// to, nil until the account first syncs. Tabs are found by it, so they
+	// can be renamed.
+	SheetID *int64
+	// MissingSince is when the account was first missing from its
+	// connection, or its connection from the user, zero if it was there on
+	// the last sync.
+	MissingSince time.Time
+	// Archived is when the account was archived, after it had been missing
+	// for a while, zero if it hasn't been.
+	Archived time.Time
+	// ArchiveAction is what's done with the account's tab once it's
+	// archived, one of the Archive constants, ArchiveKeep if empty.
+	ArchiveAction string
+	// DestinationID is the spreadsheet the account is synced into, the
+	// same as its connection's if it's empty.
+	DestinationID string
+}
+
+// What's done with an archived account. Kept accounts stay on the balance
+// sheet with their last balance and their tab marked as archived, hidden
+// accounts have their tab hidden, and deleted accounts have their tab deleted
+// and are forgotten.
+const (
+	ArchiveKeep   = "keep"
+	ArchiveHide   = "hide"
+	ArchiveDelete = "delete"
+)
+
+// IsArchived returns true if the account has been archived.
+func (a AccountState) IsArchived() bool {
+	return !a.Archived.IsZero()
+}
+
+// Status returns whether the account is active, missing from its connection
+// or archived.
+func (a AccountState) Status() string {
+	switch {
+	case a.IsArchived():
+		return "Archived"
+	case !a.MissingSince.IsZero():
+		return "Missing"
+	default:
+		return "Active"
+	}
+}
+
+// Action returns what's done with the account once it's archived.
+func (a AccountState) Action() string {
+	if a.ArchiveAction == "" {
+		return ArchiveKeep
+	}
+	return a.ArchiveAction
+}
+
+type Balance struct {
+	Currency  string
+	Available float64
+	Current   float64
+	Overdraft float64
+	Updated   time.Time
+}
+
+// ConnectionState is what we remember about a bank connection, identified by
+// the ID of its stored token.
+type ConnectionState struct {
+	ID          string
+	Provider    string
+	ProviderID  string
+	LastSynced  time.Time
+	LastError   string
+	LastErrorAt time.Time
+	// ConsentStatus and ConsentExpiresAt are from the connection's metadata
+	// as of the last sync, open banking consent has to be renewed every 90
+	// days.
+	ConsentStatus    string
+	ConsentExpiresAt time.Time
+	// ConsentReminderAt is when the connection was flagged as needing its
+	// consent renewed, it's cleared once the user reconnects.
+	ConsentReminderAt time.Time
+	// DestinationID is the spreadsheet the connection's accounts are
+	// synced into, the user's main spreadsheet if it's empty.
+	DestinationID string
+}
+
+// NeedsReconsent returns true if the connection has been flagged as expiring,
+// or its consent has already lapsed.
+func (c ConnectionState) NeedsReconsent() bool {
+	if !c.ConsentReminderAt.IsZero() {
+		return true
+	}
+	return !c.ConsentExpiresAt.IsZero() && c.ConsentExpiresAt.Before(time.Now())
+}
+
+func (c ConnectionState) ConsentExpiry() string {
+	if c.ConsentExpiresAt.IsZero() {
+		return ""
+	}
+	return c.ConsentExpiresAt.Format("2006-01-02")
+}
+
+// AccountList returns the user's accounts ordered by provider and name.
+func (u *User) AccountList() []AccountState {
+	var out []AccountState
+	for _, acc := range u.Accounts {
+		out = append(out, acc)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Provider != out[j].Provider {
+			return out[i].Provider < out[j].Provider
+		}
+		return out[i].Name < out[j].Name
+	})
+	return out
+}
+
+// ConnectionList returns the user's connections ordered by provider.
+func (u *User) ConnectionList() []ConnectionState {
+	var out []ConnectionState
+	for _, c := range u.Connections {
+		out = append(out, c)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Provider != out[j].Provider {
+			return out[i].Provider < out[j].Provider
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out
+}
+
+func (a AccountState) SyncTime() string {
+	if a.LastSynced.IsZero() {
+		return ""
+	}
+	return a.LastSynced.Format("2006-01-02 15:04")
+}
@@ -0,0 +1,176 @@
+package domain
+
+import (
+	"fmt"
+	"time"
+)
+
+// MainDestination is the ID of the user's main spreadsheet, SheetID.
+const MainDestination = "main"
+
+// Destination is a spreadsheet a user's accounts are synced into, each gets
+// its own balance sheet, history and summary. The user's main spreadsheet is
+// held on the user itself, for the accounts which aren't routed anywhere
+// else.
+type Destination struct {
+	ID string `json:"id"`
+	// Name tells the user's spreadsheets apart, like Joint.
+	Name    string `json:"name"`
+	SheetID string `json:"sheet_id"`
+	// Connected, TabPrefix and BalanceSheetID are as on the user, for the
+	// main spreadsheet.
+	Connected      bool   `json:"connected,omitempty"`
+	TabPrefix      string `json:"tab_prefix,omitempty"`
+	BalanceSheetID *int64 `json:"balance_sheet_id,omitempty"`
+}
+
+// DestinationList returns every spreadsheet the user syncs into, the main
+// one first.
+func (u *User) DestinationList() []Destination {
+	out := []Destination{{
+		ID:             MainDestination,
+		Name:           "Main",
+		SheetID:        u.SheetID,
+		Connected:      u.SheetConnected,
+		TabPrefix:      u.TabPrefix,
+		BalanceSheetID: u.BalanceSheetID,
+	}}
+	return append(out, u.Destinations...)
+}
+
+// Destination returns the spreadsheet with the given ID.
+func (u *User) Destination(id string) (Destination, bool) {
+	for _, d := range u.DestinationList() {
+		if d.ID == id {
+			return d, true
+		}
+	}
+	return Destination{}, false
+}
+
+// SetDestination saves changes to one of the user's spreadsheets, adding it
+// if it's new.
+func (u *User) SetDestination(d Destination) {
+	if d.ID == MainDestination {
+		u.SheetID = d.SheetID
+		u.SheetConnected = d.Connected
+		u.TabPrefix = d.TabPrefix
+		u.BalanceSheetID = d.BalanceSheetID
+		return
+	}
+	for i := range u.Destinations {
+		if u.Destinations[i].ID == d.ID {
+			u.Destinations[i] = d
+			return
+		}
+	}
+	u.Destinations = append(u.Destinations, d)
+}
+
+// RemoveDestination stops syncing into one of the user's spreadsheets, the
+// accounts routed to it go back to the main one.
+func (u *User) RemoveDestination(id string) error {
+	if id == MainDestination {
+		return fmt.Errorf("the main spreadsheet can't be removed")
+	}
+	if _, ok := u.Destination(id); !ok {
+		return fmt.Errorf("unknown spreadsheet %q", id)
+	}
+	u.reroute(func() {
+		for accID, acc := range u.Accounts {
+			if acc.DestinationID == id {
+				acc.DestinationID = ""
+				u.Accounts[accID] = acc
+			}
+		}
+		for connID, conn := range u.Connections {
+			if conn.DestinationID == id {
+				conn.DestinationID = ""
+				u.Connections[connID] = conn
+			}
+		}
+		var ds []Destination
+		for _, d := range u.Destinations {
+			if d.ID != id {
+				ds = append(ds, d)
+			}
+		}
+		u.Destinations = ds
+	})
+	return nil
+}
+
+// DestinationOf returns the ID of the spreadsheet the account is synced
+// into, its own if it's routed to one, otherwise its connection's, otherwise
+// the main spreadsheet.
+func (u *User) DestinationOf(acc AccountState) string {
+	if _, ok := u.Destination(acc.DestinationID); ok {
+		return acc.DestinationID
+	}
+	if _, ok := u.Destination(u.Connections[acc.ConnectionID].DestinationID); ok {
+		return u.Connections[acc.ConnectionID].DestinationID
+	}
+	return MainDestination
+}
+
+// RouteAccount syncs the account into the given spreadsheet, or its
+// connection's if destinationID is empty.
+func (u *User) RouteAccount(accountID, destinationID string) error {
+	acc, ok := u.Accounts[accountID]
+	if !ok {
+		return fmt.Errorf("unknown account %q", accountID)
+	}
+	if _, ok := u.Destination(destinationID); !ok && destinationID != "" {
+		return fmt.Errorf("unknown spreadsheet %q", destinationID)
+	}
+	u.reroute(func() {
+		acc.DestinationID = destinationID
+		u.Accounts[accountID] = acc
+	})
+	return nil
+}
+
+// RouteConnection syncs the connection's accounts into the given
+// spreadsheet, apart from those routed somewhere themselves.
+func (u *User) RouteConnection(connectionID, destinationID string) error {
+	conn, ok := u.Connections[connectionID]
+	if !ok {
+		return fmt.Errorf("unknown connection %q", connectionID)
+	}
+	if _, ok := u.Destination(destinationID); !ok {
+		return fmt.Errorf("unknown spreadsheet %q", destinationID)
+	}
+	if destinationID == MainDestination {
+		destinationID = ""
+	}
+	u.reroute(func() {
+		conn.DestinationID = destinationID
+		u.Connections[connectionID] = conn
+	})
+	return nil
+}
+
+// reroute makes a change to where accounts are synced, and forgets the tab
+// of every account it moves to another spreadsheet.
+func (u *User) reroute(change func()) {
+	before := make(map[string]string, len(u.Accounts))
+	for id, acc := range u.Accounts {
+		before[id] = u.DestinationOf(acc)
+	}
+	change()
+	for id, acc := range u.Accounts {
+		if u.DestinationOf(acc) != before[id] {
+			u.Accounts[id] = acc.moved()
+		}
+	}
+}
+
+// moved forgets the account's tab and history, for when it's synced into a
+// different spreadsheet, so the next sync adds a tab and backfills it.
+func (a AccountState) moved() AccountState {
+	a.SheetID = nil
+	a.Watermark = time.Time{}
+	a.Columns = nil
+	a.BaseCurrency = ""
+	return a
+}
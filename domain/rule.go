@@ -0,0 +1,20 @@
+package domain
+
+// Rule assigns a category, and optionally tags, to the transactions it
+// matches. A user's rules are applied in order and the first match wins.
+// Empty fields match every transaction.
+type Rule struct {
+	ID string `json:"id"`
+	// Description and Merchant are regular expressions matched against the
+	// transaction's description and merchant name.
+	Description string `json:"description"`
+	Merchant    string `json:"merchant"`
+	// MinAmount and MaxAmount bound the amount inclusively, spending is
+	// negative.
+	MinAmount       *float64 `json:"min_amount"`
+	MaxAmount       *float64 `json:"max_amount"`
+	AccountID       string   `json:"account_id"`
+	TransactionType string   `json:"transaction_type"`
+	Category        string   `json:"category"`
+	Tags            []string `json:"tags"`
+}
@@ -0,0 +1,157 @@
+package domain
+
+import (
+	"context"
+	"time"
+
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/store"
+)
+
+const syncRunsCollection = "banksheets#sync-runs"
+
+// What started a sync.
+const (
+	TriggerManual     = "manual"
+	TriggerSchedule   = "schedule"
+	TriggerConnection = "connection"
+)
+
+// SyncRun records a single attempt to sync a user's accounts.
+type SyncRun struct {
+	ID          string          `json:"id"`
+	UserID      string          `json:"user_id"`
+	Trigger     string          `json:"trigger"`
+	DryRun      bool            `json:"dry_run,omitempty"`
+	Started     time.Time       `json:"started"`
+	Finished    time.Time       `json:"finished"`
+	Connections []ConnectionRun `json:"connections"`
+	Accounts    []AccountRun    `json:"accounts"`
+	RowsAdded   int             `json:"rows_added"`
+	RowsUpdated int             `json:"rows_updated"`
+	RowsRemoved int             `json:"rows_removed"`
+	// BalancesError is set if the balance sheet couldn't be updated.
+	BalancesError string `json:"balances_error,omitempty"`
+	// HistoryError is set if the balance history couldn't be updated.
+	HistoryError string `json:"history_error,omitempty"`
+	// SummaryError is set if the monthly summary couldn't be updated.
+	SummaryError string `json:"summary_error,omitempty"`
+	// ArchiveError is set if the tabs of archived accounts couldn't be
+	// updated.
+	ArchiveError string `json:"archive_error,omitempty"`
+	// Error is set if the sync failed outright, failures of individual
+	// connections and accounts are recorded against them.
+	Error string `json:"error,omitempty"`
+}
+
+type ConnectionRun struct {
+	ConnectionID string `json:"connection_id"`
+	Accounts     int    `json:"accounts"`
+	Error        string `json:"error,omitempty"`
+}
+
+type AccountRun struct {
+	AccountID   string `json:"account_id"`
+	Name        string `json:"name"`
+	Provider    string `json:"provider"`
+	RowsAdded   int    `json:"rows_added"`
+	RowsUpdated int    `json:"rows_updated"`
+	RowsRemoved int    `json:"rows_removed"`
+	Backfill    bool   `json:"backfill"`
+	Error       string `json:"error,omitempty"`
+	// Diff is what the sync would change in the account's sheet, it's only
+	// set on dry runs.
+	Diff *RowDiff `json:"diff,omitempty"`
+}
+
+// RowDiff describes the changes a sync makes to a sheet's rows, with each row
+// as its cell values.
+type RowDiff struct {
+	Append  [][]string  `json:"append"`
+	Rewrite []RowChange `json:"rewrite"`
+	Remove  [][]string  `json:"remove"`
+}
+
+type RowChange struct {
+	Before []string `json:"before"`
+	After  []string `json:"after"`
+}
+
+// Errors returns every error recorded during the run.
+func (r *SyncRun) Errors() []string {
+	var errs []string
+	if r.Error != "" {
+		errs = append(errs, r.Error)
+	}
+	if r.BalancesError != "" {
+		errs = append(errs, "balances: "+r.BalancesError)
+	}
+	if r.HistoryError != "" {
+		errs = append(errs, "balance history: "+r.HistoryError)
+	}
+	if r.SummaryError != "" {
+		errs = append(errs, "monthly summary: "+r.SummaryError)
+	}
+	if r.ArchiveError != "" {
+		errs = append(errs, "archived accounts: "+r.ArchiveError)
+	}
+	for _, c := range r.Connections {
+		if c.Error != "" {
+			errs = append(errs, c.ConnectionID+": "+c.Error)
+		}
+	}
+	for _, a := range r.Accounts {
+		if a.Error != "" {
+			errs = append(errs, a.Provider+" "+a.Name+": "+a.Error)
+		}
+	}
+	return errs
+}
+
+// Status summarises the run as ok, partial or failed.
+func (r *SyncRun) Status() string {
+	switch {
+	case r.Error != "":
+		return "failed"
+	case len(r.Errors()) > 0:
+		return "partial"
+	default:
+		return "ok"
+	}
+}
+
+func (r *SyncRun) Duration() time.Duration {
+	return r.Finished.Sub(r.Started).Round(time.Millisecond)
+}
+
+func SaveSyncRun(ctx context.Context, r *SyncRun) error {
+	s, err := store.FromContext(ctx)
+	if err != nil {
+		return err
+	}
+	return s.Set(ctx, syncRunsCollection, r.ID, r)
+}
+
+// ListSyncRuns returns a user's most recent sync runs, newest first. Firestore
+// needs a composite index on UserID and Started for it, `make indexes` creates
+// it.
+func ListSyncRuns(ctx context.Context, userID string, limit int) ([]SyncRun, error) {
+	s, err := store.FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var runs []SyncRun
+	err = s.Query(ctx, syncRunsCollection, store.Where("UserID", userID).Order("Started", true).WithLimit(limit), &runs)
+	return runs, err
+}
+
+// RecentSyncRuns returns the most recent sync runs across every user, newest
+// first.
+func RecentSyncRuns(ctx context.Context, limit int) ([]SyncRun, error) {
+	s, err := store.FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var runs []SyncRun
+	err = s.Query(ctx, syncRunsCollection, store.Query{}.Order("Started", true).WithLimit(limit), &runs)
+	return runs, err
+}
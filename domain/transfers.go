@@ -0,0 +1,61 @@
+package domain
+
+import (
+	"context"
+
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/store"
+)
+
+const transfersCollection = "banksheets#transfers"
+
+// AccountTransfers are the IDs of an account's transactions paired with one
+// in another of the user's accounts, which are left out of its monthly
+// summary whether or not its sheet has a transfer column. They're kept apart
+// from the user, as they grow with the account's history.
+type AccountTransfers struct {
+	ID             string   `json:"id"`
+	UserID         string   `json:"user_id"`
+	AccountID      string   `json:"account_id"`
+	TransactionIDs []string `json:"transaction_ids"`
+}
+
+func transfersID(userID, accountID string) string {
+	return userID + "_" + accountID
+}
+
+// TransfersOf returns the transfers recorded for one of the user's accounts,
+// with no transactions if none have been.
+func TransfersOf(ctx context.Context, userID, accountID string) (*AccountTransfers, error) {
+	s, err := store.FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	t := &AccountTransfers{
+		ID:        transfersID(userID, accountID),
+		UserID:    userID,
+		AccountID: accountID,
+	}
+	err = s.Get(ctx, transfersCollection, t.ID, t)
+	if err != nil && err != store.ErrNotFound {
+		return nil, err
+	}
+	return t, nil
+}
+
+func SaveTransfers(ctx context.Context, t *AccountTransfers) error {
+	s, err := store.FromContext(ctx)
+	if err != nil {
+		return err
+	}
+	return s.Set(ctx, transfersCollection, t.ID, t)
+}
+
+// DeleteTransfers forgets the transfers of an account which is being
+// forgotten.
+func DeleteTransfers(ctx context.Context, userID, accountID string) error {
+	s, err := store.FromContext(ctx)
+	if err != nil {
+		return err
+	}
+	return s.Delete(ctx, transfersCollection, transfersID(userID, accountID))
+}
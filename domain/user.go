@@ -8,12 +8,35 @@ import (
 )
 
 type User struct {
-	ID       string     `json:"id"`
-	Email    string     `json:"email"`
-	Created  time.Time  `json:"created"`
-	SheetID  string     `json:"sheet_id"`
-	LastSync time.Time  `json:"last_sync"`
-	Stripe   StripeData `json:"stripe"`
+	ID          string                     `json:"id"`
+	Email       string                     `json:"email"`
+	Created     time.Time                  `json:"created"`
+	SheetID     string                     `json:"sheet_id"`
+	LastSync    time.Time                  `json:"last_sync"`
+	Stripe      StripeData                 `json:"stripe"`
+	Accounts    map[string]AccountState    `json:"accounts"`
+	Connections map[string]ConnectionState `json:"connections"`
+	// Columns are the transaction fields written to each account's sheet, in
+	// order, see syncer.Columns.
+	Columns []string `json:"columns"`
+	// Rules categorise transactions, in order.
+	Rules []Rule `json:"rules"`
+	// BaseCurrency is the currency amounts are converted into so accounts
+	// in different currencies can be totalled, none if it's empty.
+	BaseCurrency string `json:"base_currency,omitempty"`
+	// BalanceSheetID is the ID of the tab balances are written to, nil
+	// until it's been found by its original title, Sheet1, or added.
+	BalanceSheetID *int64 `json:"balance_sheet_id,omitempty"`
+	// SheetConnected is set if the user connected a spreadsheet of their
+	// own rather than having one created, its existing tabs are never
+	// written to.
+	SheetConnected bool `json:"sheet_connected,omitempty"`
+	// TabPrefix is added to the title of every tab added to the
+	// spreadsheet, to tell them apart from the user's own.
+	TabPrefix string `json:"tab_prefix,omitempty"`
+	// Destinations are the spreadsheets accounts can be synced into as
+	// well as the main one, SheetID.
+	Destinations []Destination `json:"destinations,omitempty"`
 }
 
 type StripeData struct {
@@ -24,8 +47,10 @@ type StripeData struct {
 	Error         string
 }
 
+const usersCollection = "banksheets#users"
+
 func NewUserWithID(ctx context.Context, id, email string) (*User, error) {
-	fs, err := store.FromContext(ctx)
+	s, err := store.FromContext(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -34,74 +59,163 @@ func NewUserWithID(ctx context.Context, id, email string) (*User, error) {
 		Email:   email,
 		Created: time.Now(),
 	}
-	_, err = fs.Collection("banksheets#users").Doc(id).Set(ctx, user)
+	err = s.Set(ctx, usersCollection, id, user)
 	return &user, err
 }
 
 func UserByID(ctx context.Context, userID string) (*User, error) {
-	fs, err := store.FromContext(ctx)
+	s, err := store.FromContext(ctx)
 	if err != nil {
 		return nil, err
 	}
-	doc, err := fs.Collection("banksheets#users").Doc(userID).Get(ctx)
+	usr := User{}
+	err = s.Get(ctx, usersCollection, userID, &usr)
 	if err != nil {
 		return nil, err
 	}
-	usr := User{}
-	err = doc.DataTo(&usr)
-	return &usr, err
+	return &usr, nil
 }
 
 func UserByEmail(ctx context.Context, email string) (*User, error) {
-	fs, err := store.FromContext(ctx)
+	s, err := store.FromContext(ctx)
 	if err != nil {
 		return nil, err
 	}
-	iter := fs.Collection("banksheets#users").Where("Email", "==", email).Limit(1).Documents(ctx)
-	docs, err := iter.GetAll()
+	var users []User
+	err = s.Query(ctx, usersCollection, store.Where("Email", email).WithLimit(1), &users)
 	if err != nil {
 		return nil, err
 	}
-	if len(docs) == 0 {
+	if len(users) == 0 {
 		return nil, nil
 	}
-	usr := User{}
-	err = docs[0].DataTo(&usr)
-	return &usr, err
+	return &users[0], nil
 }
 
 func ListUsers(ctx context.Context) ([]User, error) {
-	fs, err := store.FromContext(ctx)
+	s, err := store.FromContext(ctx)
 	if err != nil {
 		return nil, err
 	}
-	iter := fs.Collection("banksheets#users").Documents(ctx)
-	docs, err := iter.GetAll()
+	var users []User
+	err = s.Query(ctx, usersCollection, store.Query{}, &users)
 	if err != nil {
 		return nil, err
 	}
-	if len(docs) == 0 {
-		return nil, nil
-	}
-	out := []User{}
-	for _, doc := range docs {
-		usr := User{}
-		err = doc.DataTo(&usr)
-		if err != nil {
-			return nil, err
-		}
-		out = append(out, usr)
-	}
-	return out, nil
+	return users, nil
 }
 
 func UpdateUser(ctx context.Context, u *User) error {
-	fs, err := store.FromContext(ctx)
+	s, err := store.FromContext(ctx)
 	if err != nil {
 		return err
 	}
-	_, err = fs.Collection("banksheets#users").Doc(u.ID).Set(ctx, u)
-	return err
+	return s.Set(ctx, usersCollection, u.ID, u)
+}
+
+// ModifyUser applies fn to the user as it's stored and saves the result,
+// atomically, so changes made to the user since it was read elsewhere aren't
+// lost. fn can be called more than once.
+func ModifyUser(ctx context.Context, userID string, fn func(u *User) error) (*User, error) {
+	s, err := store.FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var u User
+	err = s.Update(ctx, usersCollection, userID, &u, func() error {
+		return fn(&u)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// MergeSync copies what a sync recorded on synced, its copy of the user, onto
+// u, the user as it's stored now. Everything the user sets themselves, like
+// their columns, rules, spreadsheets, routes and archive actions, is left as
+// it is on u. An account which has been moved to another spreadsheet since
+// the sync read the user keeps the tab mapping the move reset.
+func (u *User) MergeSync(synced *User) {
+	if synced.LastSync.After(u.LastSync) {
+		u.LastSync = synced.LastSync
+	}
+	if u.Connections == nil {
+		u.Connections = make(map[string]ConnectionState)
+	}
+	for id, sc := range synced.Connections {
+		c, ok := u.Connections[id]
+		if !ok {
+			u.Connections[id] = sc
+			continue
+		}
+		if sc.ConsentExpiresAt.After(c.ConsentExpiresAt) {
+			// renewed, however it was, so it's reminded again before
+			// the new expiry
+			c.ConsentReminderAt = time.Time{}
+		}
+		c.Provider, c.ProviderID = sc.Provider, sc.ProviderID
+		c.LastSynced, c.LastError, c.LastErrorAt = sc.LastSynced, sc.LastError, sc.LastErrorAt
+		c.ConsentStatus, c.ConsentExpiresAt = sc.ConsentStatus, sc.ConsentExpiresAt
+		u.Connections[id] = c
+	}
+
+	if u.Accounts == nil {
+		u.Accounts = make(map[string]AccountState)
+	}
+	// accounts are only forgotten by a sync, once their tab is deleted
+	for id, acc := range u.Accounts {
+		if _, ok := synced.Accounts[id]; !ok && acc.Action() == ArchiveDelete {
+			delete(u.Accounts, id)
+		}
+	}
+	for id, sa := range synced.Accounts {
+		a, ok := u.Accounts[id]
+		if !ok {
+			u.Accounts[id] = sa
+			continue
+		}
+		if a.IsArchived() && !sa.IsArchived() {
+			// restored, so the action no longer applies
+			a.ArchiveAction = ""
+		}
+		a.Name, a.Provider, a.ConnectionID = sa.Name, sa.Provider, sa.ConnectionID
+		a.LastSynced, a.LastError, a.LastErrorAt, a.LastBalance = sa.LastSynced, sa.LastError, sa.LastErrorAt, sa.LastBalance
+		a.MissingSince, a.Archived = sa.MissingSince, sa.Archived
+		if u.sheetOf(a) == synced.sheetOf(sa) {
+			a.Watermark, a.Columns, a.BaseCurrency, a.SheetID = sa.Watermark, sa.Columns, sa.BaseCurrency, sa.SheetID
+		}
+		u.Accounts[id] = a
+	}
+
+	for _, sd := range synced.DestinationList() {
+		d, ok := u.Destination(sd.ID)
+		if !ok || d.SheetID != sd.SheetID {
+			continue
+		}
+		d.BalanceSheetID = sd.BalanceSheetID
+		u.SetDestination(d)
+	}
+}
+
+// sheetOf returns the ID of the spreadsheet the account is synced into.
+func (u *User) sheetOf(acc AccountState) string {
+	d, _ := u.Destination(u.DestinationOf(acc))
+	return d.SheetID
+}
+
+// SetSpreadsheet points the user's main spreadsheet at a different one.
+// Nothing has been written to it yet, so the tab and history of every
+// account synced into it are forgotten and the next sync backfills them.
+func (u *User) SetSpreadsheet(id string, connected bool) {
+	u.SheetID = id
+	u.SheetConnected = connected
+	u.BalanceSheetID = nil
+	for accID, acc := range u.Accounts {
+		if u.DestinationOf(acc) == MainDestination {
+			u.Accounts[accID] = acc.moved()
+		}
+	}
 }
 
 func (u *User) SyncTime() string {
@@ -0,0 +1,79 @@
+package handler
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+
+	"github.com/monzo/slog"
+
+	"github.com/arussellsaw/youneedaspreadsheet/domain"
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/authn"
+)
+
+type accountsData struct {
+	User     *domain.User
+	Accounts []domain.AccountState
+	Saved    bool
+	Error    string
+}
+
+// handleAccounts lists the user's accounts which are missing or archived.
+// Posting an account ID with an action of keep, hide or delete chooses what's
+// done with an archived account on the next sync.
+func handleAccounts(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	u := authn.User(ctx)
+	if u == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	data := accountsData{User: u}
+	if r.Method == http.MethodPost {
+		latest, invalid, err := saveSetting(ctx, u.ID, func(u *domain.User) error {
+			return setArchiveAction(u, r.FormValue("account"), r.FormValue("action"))
+		})
+		if err != nil {
+			slog.Error(ctx, "Error saving archive action: %s", err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if invalid != nil {
+			data.Error = invalid.Error()
+		} else {
+			u, data.User, data.Saved = latest, latest, true
+		}
+	}
+	for _, acc := range u.AccountList() {
+		if acc.Status() != "Active" {
+			data.Accounts = append(data.Accounts, acc)
+		}
+	}
+
+	t := template.New("accounts.html")
+	t, err := t.ParseFiles("tmpl/accounts.html")
+	if err != nil {
+		slog.Error(ctx, "Error parsing template: %s", err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	err = t.Execute(w, data)
+	if err != nil {
+		slog.Error(ctx, "Accounts: %s", err)
+	}
+}
+
+func setArchiveAction(u *domain.User, accountID, action string) error {
+	acc, ok := u.Accounts[accountID]
+	if !ok || !acc.IsArchived() {
+		return fmt.Errorf("that account isn't archived")
+	}
+	switch action {
+	case domain.ArchiveKeep, domain.ArchiveHide, domain.ArchiveDelete:
+	default:
+		return fmt.Errorf("unknown action %q", action)
+	}
+	acc.ArchiveAction = action
+	u.Accounts[accountID] = acc
+	return nil
+}
@@ -0,0 +1,123 @@
+package handler
+
+import (
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/monzo/slog"
+
+	"github.com/arussellsaw/youneedaspreadsheet/domain"
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/authn"
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/syncer"
+)
+
+type columnsData struct {
+	User    *domain.User
+	Columns []columnOption
+	Saved   bool
+	Error   string
+}
+
+type columnOption struct {
+	syncer.Column
+	Selected bool
+	Position int
+}
+
+// handleColumns lets the user choose which transaction columns are written to
+// their sheets, and in what order. Each column is posted with a checkbox and
+// its position.
+func handleColumns(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	u := authn.User(ctx)
+	if u == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	data := columnsData{User: u}
+	keys := syncer.UserColumns(u)
+	if r.Method == http.MethodPost {
+		keys = postedColumns(r)
+		latest, invalid, err := saveSetting(ctx, u.ID, func(u *domain.User) error {
+			_, err := syncer.ParseColumns(keys)
+			if err != nil {
+				return err
+			}
+			u.Columns = keys
+			return nil
+		})
+		if err != nil {
+			slog.Error(ctx, "Error saving columns: %s", err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if invalid != nil {
+			data.Error = invalid.Error()
+		} else {
+			data.User, data.Saved = latest, true
+		}
+	}
+	data.Columns = columnOptions(keys)
+
+	t := template.New("columns.html")
+	t, err := t.ParseFiles("tmpl/columns.html")
+	if err != nil {
+		slog.Error(ctx, "Error parsing template: %s", err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	err = t.Execute(w, data)
+	if err != nil {
+		slog.Error(ctx, "Columns: %s", err)
+	}
+}
+
+// postedColumns returns the checked columns ordered by their position.
+func postedColumns(r *http.Request) []string {
+	var opts []columnOption
+	for _, col := range syncer.Columns {
+		if r.FormValue("column_"+col.Key) != "on" {
+			continue
+		}
+		pos, err := strconv.Atoi(r.FormValue("position_" + col.Key))
+		if err != nil {
+			pos = len(syncer.Columns)
+		}
+		opts = append(opts, columnOption{Column: col, Position: pos})
+	}
+	sort.SliceStable(opts, func(i, j int) bool {
+		return opts[i].Position < opts[j].Position
+	})
+	var keys []string
+	for _, opt := range opts {
+		keys = append(keys, opt.Key)
+	}
+	return keys
+}
+
+// columnOptions lists the selected columns in order, followed by the rest.
+func columnOptions(keys []string) []columnOption {
+	var (
+		opts     []columnOption
+		selected = make(map[string]bool)
+	)
+	for _, key := range keys {
+		for _, col := range syncer.Columns {
+			if col.Key == key && !selected[key] {
+				selected[key] = true
+				opts = append(opts, columnOption{Column: col, Selected: true})
+			}
+		}
+	}
+	for _, col := range syncer.Columns {
+		if !selected[col.Key] {
+			opts = append(opts, columnOption{Column: col})
+		}
+	}
+	for i := range opts {
+		opts[i].Position = i + 1
+	}
+	return opts
+}
@@ -0,0 +1,79 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/monzo/slog"
+
+	"github.com/arussellsaw/youneedaspreadsheet/domain"
+)
+
+// ConsentReminderWindow is how long before a connection's consent expires
+// it's flagged for renewal.
+var ConsentReminderWindow = 7 * 24 * time.Hour
+
+func handleCheckConsents(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	n, err := CheckConsents(ctx, ConsentReminderWindow)
+	if err != nil {
+		slog.Error(ctx, "error checking consents: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	slog.Info(ctx, "flagged %d connections for renewal", n)
+}
+
+// CheckConsents flags every connection whose consent expires within the
+// window, so the user is asked to renew it, and returns how many were newly
+// flagged.
+func CheckConsents(ctx context.Context, within time.Duration) (int, error) {
+	users, err := domain.ListUsers(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var (
+		now     = time.Now()
+		flagged int
+	)
+	for _, u := range users {
+		if len(expiring(u, now, within)) == 0 {
+			continue
+		}
+		// flagged on the user as it is now, a sync may have saved it since
+		// it was listed
+		var ids []string
+		latest, err := domain.ModifyUser(ctx, u.ID, func(u *domain.User) error {
+			ids = expiring(*u, now, within)
+			for _, id := range ids {
+				c := u.Connections[id]
+				c.ConsentReminderAt = now
+				u.Connections[id] = c
+			}
+			return nil
+		})
+		if err != nil {
+			slog.Error(ctx, "error flagging connections for user %s: %s", u.ID, err)
+			continue
+		}
+		for _, id := range ids {
+			slog.Info(ctx, "consent for connection %s of user %s expires at %s", id, latest.ID, latest.Connections[id].ConsentExpiresAt)
+		}
+		flagged += len(ids)
+	}
+	return flagged, nil
+}
+
+// expiring returns the IDs of the user's connections whose consent expires
+// within the window, and which haven't been flagged yet.
+func expiring(u domain.User, now time.Time, within time.Duration) []string {
+	var ids []string
+	for id, c := range u.Connections {
+		if c.ConsentExpiresAt.IsZero() || !c.ConsentReminderAt.IsZero() || c.ConsentExpiresAt.After(now.Add(within)) {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
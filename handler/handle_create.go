@@ -31,8 +31,10 @@ func handleCreateSheet(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(err.Error()))
 		return
 	}
-	u.SheetID = sheetID
-	err = domain.UpdateUser(ctx, u)
+	_, err = domain.ModifyUser(ctx, u.ID, func(u *domain.User) error {
+		u.SetSpreadsheet(sheetID, false)
+		return nil
+	})
 	if err != nil {
 		slog.Error(ctx, "Error updating user: %s", err)
 		w.Write([]byte(err.Error()))
@@ -0,0 +1,101 @@
+package handler
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/monzo/slog"
+
+	"github.com/arussellsaw/youneedaspreadsheet/domain"
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/authn"
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/syncer"
+)
+
+type currencyData struct {
+	User *domain.User
+	// Converts is false if there are no exchange rates to convert with.
+	Converts bool
+	Saved    bool
+	Error    string
+}
+
+var currencyCode = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// handleCurrency sets the base currency the user's accounts are converted
+// into, posting an empty currency turns conversion off.
+func handleCurrency(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	u := authn.User(ctx)
+	if u == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	e, err := syncer.FromContext(ctx)
+	if err != nil {
+		slog.Error(ctx, "Error getting sync engine: %s", err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	data := currencyData{User: u, Converts: e.FX != nil}
+	if r.Method == http.MethodPost {
+		base := strings.ToUpper(strings.TrimSpace(r.FormValue("base_currency")))
+		latest, invalid, err := saveSetting(ctx, u.ID, func(u *domain.User) error {
+			err := validateBaseCurrency(e, u, base)
+			if err != nil {
+				return err
+			}
+			u.BaseCurrency = base
+			return nil
+		})
+		if err != nil {
+			slog.Error(ctx, "Error saving base currency: %s", err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if invalid != nil {
+			data.Error = invalid.Error()
+		} else {
+			data.User, data.Saved = latest, true
+		}
+	}
+
+	t := template.New("currency.html")
+	t, err = t.ParseFiles("tmpl/currency.html")
+	if err != nil {
+		slog.Error(ctx, "Error parsing template: %s", err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	err = t.Execute(w, data)
+	if err != nil {
+		slog.Error(ctx, "Currency: %s", err)
+	}
+}
+
+// validateBaseCurrency checks the engine has rates to convert each of the
+// user's accounts into the currency.
+func validateBaseCurrency(e *syncer.Engine, u *domain.User, base string) error {
+	if base == "" {
+		return nil
+	}
+	if !currencyCode.MatchString(base) {
+		return fmt.Errorf("%q isn't a currency code", base)
+	}
+	if e.FX == nil {
+		return fmt.Errorf("currency conversion isn't available, there are no exchange rates")
+	}
+	for _, acc := range u.AccountList() {
+		if acc.LastBalance == nil || acc.LastBalance.Currency == "" {
+			continue
+		}
+		_, err := e.FX.Rate(acc.LastBalance.Currency, base, time.Now())
+		if err != nil {
+			return fmt.Errorf("can't convert %s into %s: %s", acc.LastBalance.Currency, base, err)
+		}
+	}
+	return nil
+}
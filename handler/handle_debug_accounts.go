@@ -16,7 +16,7 @@ func handleDebugAccounts(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	tls, err := truelayer.GetClients(ctx, u.ID)
+	tls, _, err := truelayer.GetClients(ctx, u.ID)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
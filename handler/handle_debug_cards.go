@@ -16,7 +16,7 @@ func handleDebugCards(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	tls, err := truelayer.GetClients(ctx, u.ID)
+	tls, _, err := truelayer.GetClients(ctx, u.ID)
 	if err != nil {
 		w.Write([]byte(err.Error()))
 	}
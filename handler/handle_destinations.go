@@ -0,0 +1,143 @@
+package handler
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+
+	"github.com/monzo/slog"
+
+	"github.com/arussellsaw/youneedaspreadsheet/domain"
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/authn"
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/idgen"
+)
+
+type destinationsData struct {
+	User         *domain.User
+	Destinations []domain.Destination
+	Connections  []route
+	Accounts     []route
+	Saved        bool
+	Error        string
+}
+
+// route is a connection or account and the spreadsheet it's routed to, empty
+// for an account which follows its connection.
+type route struct {
+	ID          string
+	Name        string
+	Destination string
+}
+
+// handleDestinations lists the spreadsheets the user syncs into and where
+// each connection and account is routed. Posting an action of add, remove,
+// route_connection or route_account changes them.
+func handleDestinations(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	u := authn.User(ctx)
+	if u == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	data := destinationsData{User: u}
+	if r.Method == http.MethodPost {
+		change, invalid := destinationChange(r, u)
+		var latest *domain.User
+		if invalid == nil {
+			var err error
+			latest, invalid, err = saveSetting(ctx, u.ID, change)
+			if err != nil {
+				slog.Error(ctx, "Error saving spreadsheets: %s", err)
+				http.Error(w, err.Error(), 500)
+				return
+			}
+		}
+		if invalid != nil {
+			data.Error = invalid.Error()
+		} else {
+			u, data.User, data.Saved = latest, latest, true
+		}
+	}
+	data.Destinations = u.DestinationList()
+	for _, conn := range u.ConnectionList() {
+		dest := conn.DestinationID
+		if dest == "" {
+			dest = domain.MainDestination
+		}
+		data.Connections = append(data.Connections, route{ID: conn.ID, Name: conn.Provider, Destination: dest})
+	}
+	for _, acc := range u.AccountList() {
+		data.Accounts = append(data.Accounts, route{ID: acc.ID, Name: acc.Provider + " " + acc.Name, Destination: acc.DestinationID})
+	}
+
+	t := template.New("destinations.html")
+	t, err := t.ParseFiles("tmpl/destinations.html")
+	if err != nil {
+		slog.Error(ctx, "Error parsing template: %s", err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	err = t.Execute(w, data)
+	if err != nil {
+		slog.Error(ctx, "Destinations: %s", err)
+	}
+}
+
+// destinationChange returns the posted change to the user's spreadsheets. A
+// spreadsheet being added is checked first, as the change can be retried.
+func destinationChange(r *http.Request, u *domain.User) (func(u *domain.User) error, error) {
+	switch r.FormValue("action") {
+	case "add":
+		id, err := checkSpreadsheet(r.Context(), u, "", r.FormValue("spreadsheet"))
+		if err != nil {
+			return nil, err
+		}
+		return func(u *domain.User) error {
+			return addDestination(r, u, id)
+		}, nil
+	case "remove":
+		return func(u *domain.User) error {
+			return u.RemoveDestination(r.FormValue("destination"))
+		}, nil
+	case "route_connection":
+		return func(u *domain.User) error {
+			return u.RouteConnection(r.FormValue("connection"), r.FormValue("destination"))
+		}, nil
+	case "route_account":
+		return func(u *domain.User) error {
+			return u.RouteAccount(r.FormValue("account"), r.FormValue("destination"))
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown action %q", r.FormValue("action"))
+	}
+}
+
+// addDestination adds the spreadsheet with the given ID, which has already
+// been checked, as one of the user's destinations.
+func addDestination(r *http.Request, u *domain.User, id string) error {
+	if u.SheetID == "" {
+		return fmt.Errorf("set up your main spreadsheet first")
+	}
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		return fmt.Errorf("give the spreadsheet a name")
+	}
+	for _, d := range u.DestinationList() {
+		if strings.EqualFold(d.Name, name) {
+			return fmt.Errorf("you already have a spreadsheet called %s", d.Name)
+		}
+	}
+	err := spreadsheetTaken(u, "", id)
+	if err != nil {
+		return err
+	}
+	u.SetDestination(domain.Destination{
+		ID:        idgen.New("dst"),
+		Name:      name,
+		SheetID:   id,
+		Connected: true,
+		TabPrefix: strings.TrimLeft(r.FormValue("tab_prefix"), " "),
+	})
+	return nil
+}
@@ -1,18 +1,16 @@
 package handler
 
 import (
+	"context"
 	"net/http"
-
-	"github.com/arussellsaw/youneedaspreadsheet/pkg/authn"
-	"github.com/arussellsaw/youneedaspreadsheet/pkg/stripe"
-
-	"cloud.google.com/go/pubsub"
-
-	"github.com/arussellsaw/youneedaspreadsheet/pkg/util"
+	"time"
 
 	"github.com/monzo/slog"
 
 	"github.com/arussellsaw/youneedaspreadsheet/domain"
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/authn"
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/queue"
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/stripe"
 )
 
 func handleEnqueue(w http.ResponseWriter, r *http.Request) {
@@ -31,12 +29,10 @@ func handleEnqueue(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
-	ps, err := pubsub.NewClient(ctx, util.Project())
-	if err != nil {
-		slog.Error(ctx, "error getting pubsub client: %s", err)
-		return
-	}
-	t := ps.Topic("sync-users")
+	enqueueUsers(ctx, users)
+}
+
+func enqueueUsers(ctx context.Context, users []domain.User) {
 	for _, user := range users {
 		user := user
 		ok, err := stripe.HasSubscription(ctx, &user)
@@ -48,12 +44,37 @@ func handleEnqueue(w http.ResponseWriter, r *http.Request) {
 			slog.Warn(ctx, "not enqueueing lapsed user: %s", user.ID)
 			continue
 		}
-		result := t.Publish(ctx, &pubsub.Message{
-			Data: []byte(user.ID),
+		err = queue.Publish(ctx, &queue.Message{
+			Data:       []byte(user.ID),
+			Attributes: map[string]string{"trigger": domain.TriggerSchedule},
 		})
-		_, err = result.Get(ctx)
 		if err != nil {
 			slog.Error(ctx, "error publishing: %s", err)
 		}
 	}
 }
+
+// Schedule enqueues a sync for every user and checks for expiring consents
+// each interval, for deployments without an external scheduler calling
+// /api/enqueue and /api/check-consents.
+func Schedule(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			users, err := domain.ListUsers(ctx)
+			if err != nil {
+				slog.Error(ctx, "error listing users: %s", err)
+				continue
+			}
+			enqueueUsers(ctx, users)
+			_, err = CheckConsents(ctx, ConsentReminderWindow)
+			if err != nil {
+				slog.Error(ctx, "error checking consents: %s", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
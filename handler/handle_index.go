@@ -78,7 +78,7 @@ func hasTruelayer(ctx context.Context, user *domain.User) (bool, []truelayer.Met
 	if user == nil {
 		return false, nil
 	}
-	tls, err := truelayer.GetClients(ctx, user.ID)
+	tls, _, err := truelayer.GetClients(ctx, user.ID)
 	if err != nil {
 		slog.Error(ctx, "error getting truelayer client: %s", err)
 	}
@@ -0,0 +1,137 @@
+package handler
+
+import (
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/monzo/slog"
+
+	"github.com/arussellsaw/youneedaspreadsheet/domain"
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/authn"
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/idgen"
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/syncer"
+)
+
+type rulesData struct {
+	User  *domain.User
+	Rules []domain.Rule
+	Saved bool
+	Error string
+}
+
+// handleRules lists the user's categorisation rules. Posting adds a rule, or
+// with an action of delete, up or down and a rule ID removes or reorders one.
+func handleRules(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	u := authn.User(ctx)
+	if u == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	data := rulesData{User: u}
+	if r.Method == http.MethodPost {
+		latest, invalid, err := saveSetting(ctx, u.ID, func(u *domain.User) error {
+			rules, err := updateRules(r, u.Rules)
+			if err != nil {
+				return err
+			}
+			u.Rules = rules
+			return nil
+		})
+		if err != nil {
+			slog.Error(ctx, "Error saving rules: %s", err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if invalid != nil {
+			data.Error = invalid.Error()
+		} else {
+			u, data.User, data.Saved = latest, latest, true
+		}
+	}
+	data.Rules = u.Rules
+
+	t := template.New("rules.html")
+	t, err := t.ParseFiles("tmpl/rules.html")
+	if err != nil {
+		slog.Error(ctx, "Error parsing template: %s", err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	err = t.Execute(w, data)
+	if err != nil {
+		slog.Error(ctx, "Rules: %s", err)
+	}
+}
+
+// updateRules applies the posted action to a copy of the rules.
+func updateRules(r *http.Request, rules []domain.Rule) ([]domain.Rule, error) {
+	out := append([]domain.Rule(nil), rules...)
+	i := -1
+	for j, rule := range out {
+		if rule.ID == r.FormValue("id") {
+			i = j
+		}
+	}
+	switch r.FormValue("action") {
+	case "delete":
+		if i >= 0 {
+			out = append(out[:i], out[i+1:]...)
+		}
+	case "up":
+		if i > 0 {
+			out[i-1], out[i] = out[i], out[i-1]
+		}
+	case "down":
+		if i >= 0 && i < len(out)-1 {
+			out[i], out[i+1] = out[i+1], out[i]
+		}
+	default:
+		rule, err := postedRule(r)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, rule)
+	}
+	return out, nil
+}
+
+func postedRule(r *http.Request) (domain.Rule, error) {
+	rule := domain.Rule{
+		ID:              idgen.New("rule"),
+		Description:     strings.TrimSpace(r.FormValue("description")),
+		Merchant:        strings.TrimSpace(r.FormValue("merchant")),
+		AccountID:       r.FormValue("account_id"),
+		TransactionType: strings.TrimSpace(r.FormValue("transaction_type")),
+		Category:        strings.TrimSpace(r.FormValue("category")),
+	}
+	for _, tag := range strings.Split(r.FormValue("tags"), ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			rule.Tags = append(rule.Tags, tag)
+		}
+	}
+	var err error
+	rule.MinAmount, err = formAmount(r, "min_amount")
+	if err != nil {
+		return rule, err
+	}
+	rule.MaxAmount, err = formAmount(r, "max_amount")
+	if err != nil {
+		return rule, err
+	}
+	return rule, syncer.ValidateRule(rule)
+}
+
+func formAmount(r *http.Request, key string) (*float64, error) {
+	v := strings.TrimSpace(r.FormValue(key))
+	if v == "" {
+		return nil, nil
+	}
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &n, nil
+}
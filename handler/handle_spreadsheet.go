@@ -0,0 +1,120 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+
+	"github.com/monzo/slog"
+
+	"github.com/arussellsaw/youneedaspreadsheet/domain"
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/authn"
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/sheets"
+)
+
+type spreadsheetData struct {
+	User  *domain.User
+	Saved bool
+	Error string
+}
+
+// handleSpreadsheet connects a spreadsheet the user already has, instead of
+// the one we create, and sets the prefix added to the titles of the tabs we
+// add to it.
+func handleSpreadsheet(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	u := authn.User(ctx)
+	if u == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	data := spreadsheetData{User: u}
+	if r.Method == http.MethodPost {
+		// leaving the spreadsheet empty keeps the current one, to only
+		// change the tab prefix. It's checked before the update, which can
+		// be retried.
+		var (
+			id      string
+			invalid error
+			latest  *domain.User
+		)
+		if spreadsheet := strings.TrimSpace(r.FormValue("spreadsheet")); spreadsheet != "" {
+			id, invalid = checkSpreadsheet(ctx, u, domain.MainDestination, spreadsheet)
+		}
+		if invalid == nil {
+			var err error
+			latest, invalid, err = saveSetting(ctx, u.ID, func(u *domain.User) error {
+				if id != "" && id != u.SheetID {
+					err := spreadsheetTaken(u, domain.MainDestination, id)
+					if err != nil {
+						return err
+					}
+					u.SetSpreadsheet(id, true)
+				}
+				u.TabPrefix = strings.TrimLeft(r.FormValue("tab_prefix"), " ")
+				return nil
+			})
+			if err != nil {
+				slog.Error(ctx, "Error saving spreadsheet: %s", err)
+				http.Error(w, err.Error(), 500)
+				return
+			}
+		}
+		if invalid != nil {
+			data.Error = invalid.Error()
+		} else {
+			data.User, data.Saved = latest, true
+		}
+	}
+
+	t := template.New("spreadsheet.html")
+	t, err := t.ParseFiles("tmpl/spreadsheet.html")
+	if err != nil {
+		slog.Error(ctx, "Error parsing template: %s", err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	err = t.Execute(w, data)
+	if err != nil {
+		slog.Error(ctx, "Spreadsheet: %s", err)
+	}
+}
+
+// checkSpreadsheet returns the ID of the spreadsheet from its URL or ID, for
+// the user's destination with the given ID. It has to be one the user can
+// edit, and can't already be another of their destinations.
+func checkSpreadsheet(ctx context.Context, u *domain.User, destinationID, spreadsheet string) (string, error) {
+	id, err := sheets.ParseSpreadsheetID(spreadsheet)
+	if err != nil {
+		return "", err
+	}
+	err = spreadsheetTaken(u, destinationID, id)
+	if err != nil {
+		return "", err
+	}
+	if d, ok := u.Destination(destinationID); ok && d.SheetID == id {
+		return id, nil
+	}
+	s, err := sheets.NewClient(ctx, u.ID)
+	if err != nil {
+		return "", err
+	}
+	err = sheets.CheckAccess(ctx, s, id)
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// spreadsheetTaken returns an error if the spreadsheet is one of the user's
+// destinations other than the one with the given ID.
+func spreadsheetTaken(u *domain.User, destinationID, id string) error {
+	for _, d := range u.DestinationList() {
+		if d.SheetID == id && d.ID != destinationID {
+			return fmt.Errorf("that spreadsheet is already your %s spreadsheet", d.Name)
+		}
+	}
+	return nil
+}
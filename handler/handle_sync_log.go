@@ -0,0 +1,98 @@
+package handler
+
+import (
+	"html/template"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/monzo/slog"
+
+	"github.com/arussellsaw/youneedaspreadsheet/domain"
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/authn"
+)
+
+type syncLogData struct {
+	User  *domain.User
+	Admin bool
+	Runs  []domain.SyncRun
+}
+
+// handleSyncLog lists the logged in user's recent syncs.
+func handleSyncLog(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	u := authn.User(ctx)
+	if u == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	runs, err := domain.ListSyncRuns(ctx, u.ID, 50)
+	if err != nil {
+		slog.Error(ctx, "Error listing sync runs: %s", err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	renderSyncLog(w, r, syncLogData{User: u, Runs: runs})
+}
+
+// handleAdminSyncRuns lists recent syncs across every user, or a single user
+// with ?user=, for anyone whose email is in ADMIN_EMAILS.
+func handleAdminSyncRuns(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	u := authn.User(ctx)
+	if !isAdmin(u) {
+		http.Error(w, "unauthorised", http.StatusForbidden)
+		return
+	}
+	var (
+		runs []domain.SyncRun
+		err  error
+	)
+	if userID := r.FormValue("user"); userID != "" {
+		runs, err = domain.ListSyncRuns(ctx, userID, 200)
+	} else {
+		runs, err = domain.RecentSyncRuns(ctx, 200)
+	}
+	if err != nil {
+		slog.Error(ctx, "Error listing sync runs: %s", err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if r.FormValue("failed") == "true" {
+		var failed []domain.SyncRun
+		for _, run := range runs {
+			if run.Status() != "ok" {
+				failed = append(failed, run)
+			}
+		}
+		runs = failed
+	}
+	renderSyncLog(w, r, syncLogData{User: u, Admin: true, Runs: runs})
+}
+
+func renderSyncLog(w http.ResponseWriter, r *http.Request, data syncLogData) {
+	ctx := r.Context()
+	t := template.New("sync_log.html")
+	t, err := t.ParseFiles("tmpl/sync_log.html")
+	if err != nil {
+		slog.Error(ctx, "Error parsing template: %s", err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	err = t.Execute(w, data)
+	if err != nil {
+		slog.Error(ctx, "Sync log: %s", err)
+	}
+}
+
+func isAdmin(u *domain.User) bool {
+	if u == nil || u.Email == "" {
+		return false
+	}
+	for _, email := range strings.Split(os.Getenv("ADMIN_EMAILS"), ",") {
+		if strings.EqualFold(strings.TrimSpace(email), u.Email) {
+			return true
+		}
+	}
+	return false
+}
@@ -10,10 +10,20 @@ func Routes(r *mux.Router) {
 	r.HandleFunc("/api/logout", handleLogout)
 	r.HandleFunc("/api/create-sheet", handleCreateSheet)
 	r.HandleFunc("/api/sync", handleSync)
+	r.HandleFunc("/api/sync/dry-run", handleSyncDryRun)
 	r.HandleFunc("/api/enqueue", handleEnqueue)
+	r.HandleFunc("/api/check-consents", handleCheckConsents)
 	r.HandleFunc("/", handleIndex)
 	r.HandleFunc("/business", handleBusiness)
 	r.HandleFunc("/banks", handleSupportedBanks)
+	r.HandleFunc("/sync-log", handleSyncLog)
+	r.HandleFunc("/settings/columns", handleColumns)
+	r.HandleFunc("/settings/rules", handleRules)
+	r.HandleFunc("/settings/currency", handleCurrency)
+	r.HandleFunc("/settings/accounts", handleAccounts)
+	r.HandleFunc("/settings/spreadsheet", handleSpreadsheet)
+	r.HandleFunc("/settings/destinations", handleDestinations)
+	r.HandleFunc("/admin/sync-runs", handleAdminSyncRuns)
 	r.HandleFunc("/api/debug/accounts", handleDebugAccounts)
 	r.HandleFunc("/api/debug/transactions", handleDebugTransactions)
 	r.HandleFunc("/api/debug/cards", handleDebugCards)
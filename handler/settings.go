@@ -0,0 +1,23 @@
+package handler
+
+import (
+	"context"
+
+	"github.com/arussellsaw/youneedaspreadsheet/domain"
+)
+
+// saveSetting applies change to the user as it's stored, rather than saving
+// the request's copy of the user over it, so a sync or another setting saved
+// since the request's user was read isn't lost. An error from change is the
+// user's to fix, it's returned as invalid and nothing is saved. change can be
+// called more than once.
+func saveSetting(ctx context.Context, userID string, change func(u *domain.User) error) (latest *domain.User, invalid, err error) {
+	latest, err = domain.ModifyUser(ctx, userID, func(u *domain.User) error {
+		invalid = change(u)
+		return invalid
+	})
+	if invalid != nil {
+		return nil, invalid, nil
+	}
+	return latest, nil, err
+}
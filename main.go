@@ -6,6 +6,8 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/arussellsaw/youneedaspreadsheet/pkg/authn"
 	"github.com/arussellsaw/youneedaspreadsheet/pkg/stripe"
@@ -17,10 +19,14 @@ import (
 	"github.com/gorilla/mux"
 
 	"github.com/arussellsaw/youneedaspreadsheet/handler"
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/fx"
 	"github.com/arussellsaw/youneedaspreadsheet/pkg/idgen"
 	"github.com/arussellsaw/youneedaspreadsheet/pkg/logging"
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/queue"
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/secret"
 	"github.com/arussellsaw/youneedaspreadsheet/pkg/sheets"
 	"github.com/arussellsaw/youneedaspreadsheet/pkg/store"
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/syncer"
 	"github.com/arussellsaw/youneedaspreadsheet/pkg/truelayer"
 	"github.com/arussellsaw/youneedaspreadsheet/pkg/util"
 )
@@ -48,12 +54,25 @@ func main() {
 
 	idgen.Init(ctx)
 
-	fs, err := store.Init(ctx)
+	err = secret.Init(ctx)
 	if err != nil {
-		slog.Error(ctx, "Error intialising FireStore: %s", err)
+		slog.Error(ctx, "Error intialising secrets: %s", err)
 		os.Exit(1)
 	}
-	ctx = store.WithStore(ctx, fs)
+
+	st, err := store.Init(ctx)
+	if err != nil {
+		slog.Error(ctx, "Error intialising store: %s", err)
+		os.Exit(1)
+	}
+	ctx = store.WithStore(ctx, st)
+
+	q, err := queue.Init(ctx)
+	if err != nil {
+		slog.Error(ctx, "Error intialising queue: %s", err)
+		os.Exit(1)
+	}
+	ctx = queue.WithQueue(ctx, q)
 
 	r := mux.NewRouter()
 
@@ -62,7 +81,10 @@ func main() {
 		slog.Error(ctx, "Error intialising Google Sheets: %s", err)
 		os.Exit(1)
 	}
-	err = truelayer.Init(ctx, r)
+	err = truelayer.Init(ctx, r, truelayer.Config{
+		APIBaseURL:  os.Getenv("TRUELAYER_API_URL"),
+		AuthBaseURL: os.Getenv("TRUELAYER_AUTH_URL"),
+	})
 	if err != nil {
 		slog.Error(ctx, "Error intialising Truelayer: %s", err)
 		os.Exit(1)
@@ -73,8 +95,59 @@ func main() {
 		os.Exit(1)
 	}
 
+	if days := os.Getenv("CONSENT_REMINDER_DAYS"); days != "" {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			slog.Error(ctx, "Invalid CONSENT_REMINDER_DAYS: %s", err)
+			os.Exit(1)
+		}
+		handler.ConsentReminderWindow = time.Duration(n) * 24 * time.Hour
+	}
+
+	e := syncer.NewEngine()
+	if path := os.Getenv("FX_RATES_FILE"); path != "" {
+		rates, err := fx.LoadTable(path)
+		if err != nil {
+			slog.Error(ctx, "Error loading FX_RATES_FILE: %s", err)
+			os.Exit(1)
+		}
+		first, last := rates.Days[0].Date, rates.Days[len(rates.Days)-1].Date
+		slog.Info(ctx, "Loaded FX rates for %d days, %s to %s", len(rates.Days), first.Format("2006-01-02"), last.Format("2006-01-02"))
+		if time.Since(last) > 7*24*time.Hour {
+			slog.Warn(ctx, "FX rates end on %s, later amounts are converted at that day's rates", last.Format("2006-01-02"))
+		}
+		e.FX = rates
+	} else {
+		slog.Warn(ctx, "FX_RATES_FILE isn't set, amounts won't be converted into users' base currencies")
+	}
+	ctx = syncer.WithEngine(ctx, e)
+
+	if len(os.Args) > 1 {
+		err = runCommand(ctx, os.Args[1], os.Args[2:])
+		if err != nil {
+			slog.Error(ctx, "%s: %s", os.Args[1], err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	handler.Routes(r)
 
+	go func() {
+		err := q.Consume(ctx, handler.HandleSyncMessage)
+		if err != nil {
+			slog.Error(ctx, "queue consumer exiting: %s", err)
+		}
+	}()
+	if interval := os.Getenv("SYNC_INTERVAL"); interval != "" {
+		d, err := time.ParseDuration(interval)
+		if err != nil {
+			slog.Error(ctx, "Invalid SYNC_INTERVAL: %s", err)
+			os.Exit(1)
+		}
+		go handler.Schedule(ctx, d)
+	}
+
 	srv := http.Server{
 		Addr:    ":8080",
 		Handler: sloggcloud.CloudContextMiddleware(authn.UserSessionMiddleware(r)),
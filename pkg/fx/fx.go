@@ -0,0 +1,119 @@
+package fx
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Source looks up exchange rates.
+type Source interface {
+	// Rate returns the rate converting an amount in from into to as of at,
+	// or as close to it as the source has.
+	Rate(from, to string, at time.Time) (Rate, error)
+}
+
+// Rate is the number of units of To one unit of From buys, as of Date.
+type Rate struct {
+	From  string
+	To    string
+	Value float64
+	Date  time.Time
+}
+
+// Convert returns amount, in From, converted into To.
+func (r Rate) Convert(amount float64) float64 {
+	return amount * r.Value
+}
+
+// Table is a Source of daily rates held in memory, each day's rates quoted
+// as the units of a currency one unit of Base buys.
+type Table struct {
+	Base string
+	Days []Day
+}
+
+// Day is a table's rates on one day.
+type Day struct {
+	Date  time.Time
+	Rates map[string]float64
+}
+
+// Rate uses the latest day in the table on or before at, or the earliest if
+// at is before every day in it.
+func (t *Table) Rate(from, to string, at time.Time) (Rate, error) {
+	if from == to {
+		return Rate{From: from, To: to, Value: 1, Date: at}, nil
+	}
+	if len(t.Days) == 0 {
+		return Rate{}, fmt.Errorf("no rates")
+	}
+	i := sort.Search(len(t.Days), func(i int) bool {
+		return t.Days[i].Date.After(at)
+	})
+	if i > 0 {
+		i--
+	}
+	day := t.Days[i]
+	f, ok := day.rate(t.Base, from)
+	if !ok {
+		return Rate{}, fmt.Errorf("no rate for %s", from)
+	}
+	tr, ok := day.rate(t.Base, to)
+	if !ok {
+		return Rate{}, fmt.Errorf("no rate for %s", to)
+	}
+	return Rate{From: from, To: to, Value: tr / f, Date: day.Date}, nil
+}
+
+func (d Day) rate(base, currency string) (float64, bool) {
+	if currency == base {
+		return 1, true
+	}
+	r, ok := d.Rates[currency]
+	return r, ok && r > 0
+}
+
+// tableFile is the format of a rates file, rates are keyed by day as
+// YYYY-MM-DD then by currency.
+type tableFile struct {
+	Base  string                        `json:"base"`
+	Rates map[string]map[string]float64 `json:"rates"`
+}
+
+// LoadTable reads a table of rates from a JSON file, of the form
+//
+//	{"base": "EUR", "rates": {"2021-03-01": {"GBP": 0.86, "USD": 1.2}}}
+func LoadTable(path string) (*Table, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f tableFile
+	err = json.Unmarshal(buf, &f)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing rates")
+	}
+	if f.Base == "" {
+		return nil, fmt.Errorf("rates file has no base currency")
+	}
+	t := &Table{Base: f.Base}
+	for date, rates := range f.Rates {
+		d, err := time.Parse("2006-01-02", date)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing rates date")
+		}
+		t.Days = append(t.Days, Day{Date: d, Rates: rates})
+	}
+	if len(t.Days) == 0 {
+		return nil, fmt.Errorf("rates file has no rates")
+	}
+	sort.Slice(t.Days, func(i, j int) bool {
+		return t.Days[i].Date.Before(t.Days[j].Date)
+	})
+	return t, nil
+}
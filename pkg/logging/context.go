@@ -34,11 +34,11 @@ type paramContainer struct {
 }
 
 func WithParams(ctx context.Context, params map[string]string) context.Context {
-	return context.WithValue(ctx, paramKey("params"), paramContainer{params: params})
+	return context.WithValue(ctx, paramKey("params"), &paramContainer{params: params})
 }
 
 func SetParam(ctx context.Context, key, value string) context.Context {
-	v, ok := ctx.Value(paramKey("params")).(paramContainer)
+	v, ok := ctx.Value(paramKey("params")).(*paramContainer)
 	if !ok {
 		return WithParams(ctx, map[string]string{key: value})
 	}
@@ -51,7 +51,7 @@ func SetParam(ctx context.Context, key, value string) context.Context {
 }
 
 func Params(ctx context.Context) map[string]interface{} {
-	container, ok := ctx.Value(paramKey("params")).(paramContainer)
+	container, ok := ctx.Value(paramKey("params")).(*paramContainer)
 	if !ok {
 		return nil
 	}
@@ -0,0 +1,58 @@
+package queue
+
+import (
+	"context"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/monzo/slog"
+)
+
+type pubSubQueue struct {
+	client       *pubsub.Client
+	topic        *pubsub.Topic
+	subscription string
+}
+
+// NewPubSub returns a Queue that publishes to a Pub/Sub topic. Messages are
+// normally delivered by push to /api/sync, if subscription is set Consume
+// pulls from it instead.
+func NewPubSub(ctx context.Context, project, topic, subscription string) (Queue, error) {
+	client, err := pubsub.NewClient(ctx, project)
+	if err != nil {
+		return nil, err
+	}
+	return &pubSubQueue{
+		client:       client,
+		topic:        client.Topic(topic),
+		subscription: subscription,
+	}, nil
+}
+
+func (q *pubSubQueue) Publish(ctx context.Context, m *Message) error {
+	result := q.topic.Publish(ctx, &pubsub.Message{
+		Data:       m.Data,
+		Attributes: m.Attributes,
+	})
+	_, err := result.Get(ctx)
+	return err
+}
+
+func (q *pubSubQueue) Consume(ctx context.Context, h Handler) error {
+	if q.subscription == "" {
+		slog.Info(ctx, "no pubsub subscription configured, expecting push delivery")
+		return nil
+	}
+	return q.client.Subscription(q.subscription).Receive(ctx, func(ctx context.Context, pm *pubsub.Message) {
+		err := h(ctx, &Message{
+			ID:         pm.ID,
+			Data:       pm.Data,
+			Attributes: pm.Attributes,
+		})
+		if err != nil {
+			slog.Error(ctx, "error handling message %s: %s", pm.ID, err)
+			pm.Nack()
+			return
+		}
+		pm.Ack()
+	})
+}
@@ -0,0 +1,101 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/util"
+)
+
+var ErrQueueNotFound = errors.New("not_found.queue: couldn't find queue in context")
+
+type Message struct {
+	ID         string            `json:"messageId"`
+	Data       []byte            `json:"data"`
+	Attributes map[string]string `json:"attributes"`
+}
+
+// Handler processes a message, returning an error means the message may be
+// redelivered.
+type Handler func(ctx context.Context, m *Message) error
+
+type Publisher interface {
+	Publish(ctx context.Context, m *Message) error
+}
+
+type Consumer interface {
+	// Consume calls h for every message until ctx is cancelled.
+	Consume(ctx context.Context, h Handler) error
+}
+
+type Queue interface {
+	Publisher
+	Consumer
+}
+
+// Init sets up the queue configured by QUEUE_BACKEND, either pubsub (the
+// default) publishing to QUEUE_TOPIC, or local which runs jobs in process
+// with QUEUE_CONCURRENCY workers.
+func Init(ctx context.Context) (Queue, error) {
+	switch backend := os.Getenv("QUEUE_BACKEND"); backend {
+	case "", "pubsub":
+		topic := os.Getenv("QUEUE_TOPIC")
+		if topic == "" {
+			topic = "sync-users"
+		}
+		return NewPubSub(ctx, util.Project(), topic, os.Getenv("QUEUE_SUBSCRIPTION"))
+	case "local":
+		concurrency := 4
+		if c := os.Getenv("QUEUE_CONCURRENCY"); c != "" {
+			var err error
+			concurrency, err = strconv.Atoi(c)
+			if err != nil {
+				return nil, fmt.Errorf("invalid QUEUE_CONCURRENCY: %s", err)
+			}
+		}
+		return NewWorkerPool(concurrency, 1000), nil
+	default:
+		return nil, fmt.Errorf("unknown queue backend: %s", backend)
+	}
+}
+
+// DecodePush decodes the body of a Pub/Sub push delivery.
+func DecodePush(r io.Reader) (*Message, error) {
+	m := struct {
+		Message      Message `json:"message"`
+		Subscription string  `json:"subscription"`
+	}{}
+	err := json.NewDecoder(r).Decode(&m)
+	if err != nil {
+		return nil, err
+	}
+	return &m.Message, nil
+}
+
+type queueKey string
+
+func FromContext(ctx context.Context) (Queue, error) {
+	q, ok := ctx.Value(queueKey("queue")).(Queue)
+	if !ok {
+		return nil, ErrQueueNotFound
+	}
+	return q, nil
+}
+
+func WithQueue(ctx context.Context, q Queue) context.Context {
+	return context.WithValue(ctx, queueKey("queue"), q)
+}
+
+// Publish publishes to the queue in the context.
+func Publish(ctx context.Context, m *Message) error {
+	q, err := FromContext(ctx)
+	if err != nil {
+		return err
+	}
+	return q.Publish(ctx, m)
+}
@@ -0,0 +1,57 @@
+package queue
+
+import (
+	"context"
+	"sync"
+
+	"github.com/monzo/slog"
+)
+
+// WorkerPool is an in-process Queue, published messages are buffered and
+// handled by a fixed number of workers once Consume is running.
+type WorkerPool struct {
+	concurrency int
+	jobs        chan *Message
+}
+
+func NewWorkerPool(concurrency, buffer int) *WorkerPool {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &WorkerPool{
+		concurrency: concurrency,
+		jobs:        make(chan *Message, buffer),
+	}
+}
+
+func (p *WorkerPool) Publish(ctx context.Context, m *Message) error {
+	select {
+	case p.jobs <- m:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *WorkerPool) Consume(ctx context.Context, h Handler) error {
+	var wg sync.WaitGroup
+	wg.Add(p.concurrency)
+	for i := 0; i < p.concurrency; i++ {
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case m := <-p.jobs:
+					err := h(ctx, m)
+					if err != nil {
+						slog.Error(ctx, "error handling message %s: %s", m.ID, err)
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return ctx.Err()
+}
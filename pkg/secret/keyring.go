@@ -0,0 +1,132 @@
+package secret
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/util"
+)
+
+// Keyring encrypts and decrypts data with a versioned key.
+type Keyring interface {
+	// Name identifies the keyring in ciphertexts, it mustn't contain ':'.
+	Name() string
+	// Primary returns the key version used for new encryption.
+	Primary(ctx context.Context) (string, error)
+	Encrypt(ctx context.Context, plaintext []byte) (ciphertext []byte, version string, err error)
+	Decrypt(ctx context.Context, ciphertext []byte, version string) ([]byte, error)
+}
+
+var (
+	primary  Keyring = NewKMSKeyring(util.Project())
+	keyrings         = map[string]Keyring{
+		primary.Name(): primary,
+	}
+)
+
+// Init configures the primary keyring from SECRET_KEYRING, either kms (the
+// default) or local. Local key material is read from the file at
+// SECRET_LOCAL_KEYFILE or from SECRET_LOCAL_KEYS, and is registered for
+// decryption whenever it's present so that mixed data can still be read.
+func Init(ctx context.Context) error {
+	var buf []byte
+	if path := os.Getenv("SECRET_LOCAL_KEYFILE"); path != "" {
+		var err error
+		buf, err = ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+	} else if keys := os.Getenv("SECRET_LOCAL_KEYS"); keys != "" {
+		buf = []byte(keys)
+	}
+	if buf != nil {
+		local, err := ParseLocalKeyring(buf)
+		if err != nil {
+			return err
+		}
+		RegisterKeyring(local)
+	}
+
+	if name := os.Getenv("SECRET_KEYRING"); name != "" {
+		k, ok := keyrings[name]
+		if !ok {
+			return fmt.Errorf("no key material configured for keyring %s", name)
+		}
+		primary = k
+	}
+	return nil
+}
+
+// RegisterKeyring makes a keyring available for decryption.
+func RegisterKeyring(k Keyring) {
+	keyrings[k.Name()] = k
+}
+
+// SetPrimary registers a keyring and uses it for all new encryption.
+func SetPrimary(k Keyring) {
+	RegisterKeyring(k)
+	primary = k
+}
+
+// Encrypt encrypts plaintext with the primary keyring, the returned ciphertext
+// is formatted as keyring:version:base64, and the key name as keyring:version.
+func Encrypt(ctx context.Context, plaintext []byte) (string, string, error) {
+	ciphertext, version, err := primary.Encrypt(ctx, plaintext)
+	if err != nil {
+		return "", "", err
+	}
+	keyName := primary.Name() + ":" + version
+	return keyName + ":" + base64.StdEncoding.EncodeToString(ciphertext), keyName, nil
+}
+
+// Decrypt decrypts a ciphertext produced by Encrypt with the keyring and key
+// version that produced it. Ciphertexts without a header are legacy KMS
+// ciphertexts, for those the version comes from the key name.
+func Decrypt(ctx context.Context, ciphertext, keyName string) ([]byte, error) {
+	name, version, b64Ciphertext := parseCiphertext(ciphertext)
+	if version == "" {
+		name, version = ParseKeyName(keyName)
+	}
+	k, ok := keyrings[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown keyring %s for key %s", name, keyName)
+	}
+	raw, err := base64.StdEncoding.DecodeString(b64Ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	return k.Decrypt(ctx, raw, version)
+}
+
+// PrimaryKeyName returns the key name that Encrypt currently produces.
+func PrimaryKeyName(ctx context.Context) (string, error) {
+	version, err := primary.Primary(ctx)
+	if err != nil {
+		return "", err
+	}
+	return primary.Name() + ":" + version, nil
+}
+
+// ParseKeyName splits a key name into its keyring and version, key names from
+// before keyrings were introduced are full KMS key version paths.
+func ParseKeyName(keyName string) (string, string) {
+	parts := strings.SplitN(keyName, ":", 2)
+	if len(parts) != 2 {
+		return kmsKeyringName, path.Base(keyName)
+	}
+	return parts[0], parts[1]
+}
+
+func parseCiphertext(ciphertext string) (string, string, string) {
+	parts := strings.SplitN(ciphertext, ":", 3)
+	if len(parts) != 3 {
+		// base64 never contains ':', so this predates keyrings
+		return kmsKeyringName, "", ciphertext
+	}
+	return parts[0], parts[1], parts[2]
+}
@@ -0,0 +1,215 @@
+package secret
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+// withKeyrings restores the package's keyrings once the test is done.
+func withKeyrings(t *testing.T) {
+	prevPrimary := primary
+	prevKeyrings := make(map[string]Keyring, len(keyrings))
+	for name, k := range keyrings {
+		prevKeyrings[name] = k
+	}
+	t.Cleanup(func() {
+		primary, keyrings = prevPrimary, prevKeyrings
+	})
+}
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+func mustLocal(t *testing.T, keys map[string][]byte, primary string) *LocalKeyring {
+	t.Helper()
+	k, err := NewLocalKeyring(keys, primary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestLocalRoundTrip(t *testing.T) {
+	withKeyrings(t)
+	ctx := context.Background()
+	SetPrimary(mustLocal(t, map[string][]byte{"1": testKey(1)}, "1"))
+
+	ciphertext, keyName, err := Encrypt(ctx, []byte("access token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyName != "local:1" {
+		t.Errorf("got key name %q, want local:1", keyName)
+	}
+	if !strings.HasPrefix(ciphertext, "local:1:") {
+		t.Errorf("got ciphertext %q, want a local:1: header", ciphertext)
+	}
+	if name, err := PrimaryKeyName(ctx); err != nil || name != keyName {
+		t.Errorf("got primary key name %q (%v), want %q", name, err, keyName)
+	}
+	plaintext, err := Decrypt(ctx, ciphertext, keyName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != "access token" {
+		t.Errorf("got %q", plaintext)
+	}
+
+	// the nonce is random, so the same plaintext never encrypts the same
+	again, _, err := Encrypt(ctx, []byte("access token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again == ciphertext {
+		t.Error("encrypting twice gave the same ciphertext")
+	}
+}
+
+func TestLocalOlderVersion(t *testing.T) {
+	withKeyrings(t)
+	ctx := context.Background()
+	SetPrimary(mustLocal(t, map[string][]byte{"1": testKey(1)}, "1"))
+	old, oldKeyName, err := Encrypt(ctx, []byte("old token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the key is rotated, version 1 is kept for decryption
+	SetPrimary(mustLocal(t, map[string][]byte{"1": testKey(1), "2": testKey(2)}, "2"))
+	plaintext, err := Decrypt(ctx, old, oldKeyName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != "old token" {
+		t.Errorf("got %q", plaintext)
+	}
+	ciphertext, keyName, err := Encrypt(ctx, []byte("new token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyName != "local:2" || !strings.HasPrefix(ciphertext, "local:2:") {
+		t.Errorf("got %q %q, want the new version", keyName, ciphertext)
+	}
+
+	// once version 1 is dropped its ciphertexts can't be read
+	SetPrimary(mustLocal(t, map[string][]byte{"2": testKey(2)}, "2"))
+	if _, err := Decrypt(ctx, old, oldKeyName); err == nil {
+		t.Error("decrypted with a dropped key version")
+	}
+}
+
+func TestLocalTampered(t *testing.T) {
+	withKeyrings(t)
+	ctx := context.Background()
+	// both versions have the same key, so only the header binds the
+	// ciphertext to its version
+	SetPrimary(mustLocal(t, map[string][]byte{"1": testKey(1), "2": testKey(1)}, "1"))
+	ciphertext, keyName, err := Encrypt(ctx, []byte("access token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.SplitN(ciphertext, ":", 3)
+	raw, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, tampered := range map[string]string{
+		"flipped byte": func() string {
+			b := append([]byte(nil), raw...)
+			b[len(b)-1] ^= 0xff
+			return "local:1:" + base64.StdEncoding.EncodeToString(b)
+		}(),
+		"truncated": "local:1:" + base64.StdEncoding.EncodeToString(raw[:4]),
+		"version":   "local:2:" + parts[2],
+		"base64":    "local:1:!!!",
+	} {
+		if _, err := Decrypt(ctx, tampered, keyName); err == nil {
+			t.Errorf("%s: decrypted a tampered ciphertext", name)
+		}
+	}
+	if _, err := Decrypt(ctx, "other:1:"+parts[2], keyName); err == nil {
+		t.Error("decrypted with an unknown keyring")
+	}
+}
+
+// fakeKMS stands in for KMS, its ciphertexts are the plaintext reversed.
+type fakeKMS struct {
+	version string
+}
+
+func (k *fakeKMS) Name() string { return kmsKeyringName }
+
+func (k *fakeKMS) Primary(ctx context.Context) (string, error) { return "7", nil }
+
+func (k *fakeKMS) Encrypt(ctx context.Context, plaintext []byte) ([]byte, string, error) {
+	return reverse(plaintext), "7", nil
+}
+
+func (k *fakeKMS) Decrypt(ctx context.Context, ciphertext []byte, version string) ([]byte, error) {
+	k.version = version
+	return reverse(ciphertext), nil
+}
+
+func reverse(b []byte) []byte {
+	out := make([]byte, len(b))
+	for i := range b {
+		out[len(b)-1-i] = b[i]
+	}
+	return out
+}
+
+func TestLegacyKMSCiphertext(t *testing.T) {
+	withKeyrings(t)
+	ctx := context.Background()
+	kms := &fakeKMS{}
+	RegisterKeyring(kms)
+	// the primary is local, legacy ciphertexts are still read with KMS
+	SetPrimary(mustLocal(t, map[string][]byte{"1": testKey(1)}, "1"))
+
+	// tokens stored before keyrings have no header, and the full KMS key
+	// version path as their key name
+	legacy := base64.StdEncoding.EncodeToString(reverse([]byte("legacy token")))
+	keyName := "projects/p/locations/global/keyRings/oauth/cryptoKeys/access_tokens/cryptoKeyVersions/3"
+	plaintext, err := Decrypt(ctx, legacy, keyName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != "legacy token" {
+		t.Errorf("got %q", plaintext)
+	}
+	if kms.version != "3" {
+		t.Errorf("got version %q, want 3 from the key name", kms.version)
+	}
+
+	if name, version := ParseKeyName(keyName); name != kmsKeyringName || version != "3" {
+		t.Errorf("got %s %s", name, version)
+	}
+	if name, version := ParseKeyName("local:2"); name != "local" || version != "2" {
+		t.Errorf("got %s %s", name, version)
+	}
+}
+
+func TestParseLocalKeyring(t *testing.T) {
+	k, err := ParseLocalKeyring([]byte(`{"primary": "1", "keys": {"1": "` + base64.StdEncoding.EncodeToString(testKey(1)) + `"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := k.Primary(context.Background()); v != "1" {
+		t.Errorf("got primary %q", v)
+	}
+	for name, buf := range map[string]string{
+		"no primary": `{"primary": "2", "keys": {"1": "` + base64.StdEncoding.EncodeToString(testKey(1)) + `"}}`,
+		"short key":  `{"primary": "1", "keys": {"1": "` + base64.StdEncoding.EncodeToString([]byte("short")) + `"}}`,
+		"bad base64": `{"primary": "1", "keys": {"1": "!!!"}}`,
+		"not json":   `primary=1`,
+	} {
+		if _, err := ParseLocalKeyring([]byte(buf)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package secret
+
+import (
+	"context"
+	"fmt"
+	"path"
+
+	kms "cloud.google.com/go/kms/apiv1"
+
+	kmspb "google.golang.org/genproto/googleapis/cloud/kms/v1"
+)
+
+const kmsKeyringName = "kms"
+
+// KMSKeyring encrypts with the access_tokens key in Google Cloud KMS.
+type KMSKeyring struct {
+	key string
+}
+
+func NewKMSKeyring(project string) *KMSKeyring {
+	return &KMSKeyring{
+		key: "projects/" + project + "/locations/global/keyRings/oauth/cryptoKeys/access_tokens",
+	}
+}
+
+func (k *KMSKeyring) Name() string {
+	return kmsKeyringName
+}
+
+func (k *KMSKeyring) Encrypt(ctx context.Context, plaintext []byte) ([]byte, string, error) {
+	client, err := kms.NewKeyManagementClient(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	defer client.Close()
+
+	// encrypting against the key uses its primary version
+	res, err := client.Encrypt(ctx, &kmspb.EncryptRequest{
+		Name:      k.key,
+		Plaintext: plaintext,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return res.GetCiphertext(), path.Base(res.GetName()), nil
+}
+
+func (k *KMSKeyring) Primary(ctx context.Context) (string, error) {
+	client, err := kms.NewKeyManagementClient(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer client.Close()
+
+	key, err := client.GetCryptoKey(ctx, &kmspb.GetCryptoKeyRequest{
+		Name: k.key,
+	})
+	if err != nil {
+		return "", err
+	}
+	if key.GetPrimary() == nil {
+		return "", fmt.Errorf("no primary version for key %s", k.key)
+	}
+	return path.Base(key.GetPrimary().GetName()), nil
+}
+
+func (k *KMSKeyring) Decrypt(ctx context.Context, ciphertext []byte, version string) ([]byte, error) {
+	client, err := kms.NewKeyManagementClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	// KMS ciphertexts carry their key version, so we decrypt against the key
+	res, err := client.Decrypt(ctx, &kmspb.DecryptRequest{
+		Name:       k.key,
+		Ciphertext: ciphertext,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.GetPlaintext(), nil
+}
@@ -0,0 +1,113 @@
+package secret
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+const localKeyringName = "local"
+
+// LocalKeyring encrypts with AES-GCM using key material held in memory, for
+// dev, CI and self-hosted deployments without KMS.
+type LocalKeyring struct {
+	primary string
+	keys    map[string][]byte
+}
+
+// NewLocalKeyring takes AES keys (16, 24 or 32 bytes) by version, new data is
+// encrypted with the primary version.
+func NewLocalKeyring(keys map[string][]byte, primary string) (*LocalKeyring, error) {
+	if _, ok := keys[primary]; !ok {
+		return nil, fmt.Errorf("missing primary key version %s", primary)
+	}
+	for version, key := range keys {
+		if _, err := aes.NewCipher(key); err != nil {
+			return nil, errors.Wrapf(err, "key version %s", version)
+		}
+	}
+	return &LocalKeyring{
+		primary: primary,
+		keys:    keys,
+	}, nil
+}
+
+// ParseLocalKeyring parses key material formatted as
+// {"primary": "1", "keys": {"1": "<base64 key>"}}, a key can be generated with
+// `openssl rand -base64 32`.
+func ParseLocalKeyring(buf []byte) (*LocalKeyring, error) {
+	var file struct {
+		Primary string            `json:"primary"`
+		Keys    map[string]string `json:"keys"`
+	}
+	err := json.Unmarshal(buf, &file)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing local keys")
+	}
+	keys := make(map[string][]byte)
+	for version, b64Key := range file.Keys {
+		key, err := base64.StdEncoding.DecodeString(b64Key)
+		if err != nil {
+			return nil, errors.Wrapf(err, "decoding key version %s", version)
+		}
+		keys[version] = key
+	}
+	return NewLocalKeyring(keys, file.Primary)
+}
+
+func (k *LocalKeyring) Name() string {
+	return localKeyringName
+}
+
+func (k *LocalKeyring) Primary(ctx context.Context) (string, error) {
+	return k.primary, nil
+}
+
+func (k *LocalKeyring) Encrypt(ctx context.Context, plaintext []byte) ([]byte, string, error) {
+	gcm, err := k.gcm(k.primary)
+	if err != nil {
+		return nil, "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, "", err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, k.additionalData(k.primary)), k.primary, nil
+}
+
+func (k *LocalKeyring) Decrypt(ctx context.Context, ciphertext []byte, version string) ([]byte, error) {
+	gcm, err := k.gcm(version)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	nonce, sealed := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, sealed, k.additionalData(version))
+}
+
+func (k *LocalKeyring) gcm(version string) (cipher.AEAD, error) {
+	key, ok := k.keys[version]
+	if !ok {
+		return nil, fmt.Errorf("unknown local key version %s", version)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// additionalData binds the ciphertext to the header it's stored with
+func (k *LocalKeyring) additionalData(version string) []byte {
+	return []byte(k.Name() + ":" + version)
+}
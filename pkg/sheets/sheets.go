@@ -2,16 +2,32 @@ package sheets
 
 import (
 	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
 
 	"golang.org/x/oauth2"
 
 	"github.com/pkg/errors"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/option"
 	"google.golang.org/api/sheets/v4"
 
 	"github.com/arussellsaw/youneedaspreadsheet/pkg/token"
 )
 
+// Spreadsheets is the subset of the Sheets API used to create and sync
+// spreadsheets, see sheetstest for an in-memory implementation.
+type Spreadsheets interface {
+	Create(ctx context.Context) (string, error)
+	// Get returns the spreadsheet including grid data for every sheet.
+	Get(ctx context.Context, spreadsheetID string) (*sheets.Spreadsheet, error)
+	BatchUpdate(ctx context.Context, spreadsheetID string, reqs []*sheets.Request) error
+}
+
+var _ Spreadsheets = &Client{}
+
 type Client struct {
 	c *sheets.Service
 }
@@ -55,3 +71,59 @@ func (c *Client) Service(ctx context.Context) *sheets.Service {
 func (c *Client) Get(ctx context.Context, sheetID string) (*sheets.Spreadsheet, error) {
 	return c.c.Spreadsheets.Get(sheetID).IncludeGridData(true).Context(ctx).Do()
 }
+
+func (c *Client) BatchUpdate(ctx context.Context, spreadsheetID string, reqs []*sheets.Request) error {
+	_, err := c.c.Spreadsheets.BatchUpdate(spreadsheetID, &sheets.BatchUpdateSpreadsheetRequest{
+		Requests: reqs,
+	}).Context(ctx).Do()
+	return err
+}
+
+var (
+	spreadsheetURL = regexp.MustCompile(`/spreadsheets/d/([a-zA-Z0-9_-]+)`)
+	spreadsheetID  = regexp.MustCompile(`^[a-zA-Z0-9_-]{20,}$`)
+)
+
+// ParseSpreadsheetID returns the ID of a spreadsheet from its URL, or the ID
+// itself.
+func ParseSpreadsheetID(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if m := spreadsheetURL.FindStringSubmatch(s); m != nil {
+		return m[1], nil
+	}
+	if spreadsheetID.MatchString(s) {
+		return s, nil
+	}
+	return "", fmt.Errorf("that doesn't look like a spreadsheet URL or ID")
+}
+
+// CheckAccess checks the spreadsheet can be read and written without
+// changing it. The Sheets API can't say whether the user can edit a
+// spreadsheet, so it asks to rename a sheet which doesn't exist: that's
+// refused as forbidden if they can't edit it, and as a bad request if they
+// can, and can never change anything either way.
+func CheckAccess(ctx context.Context, s Spreadsheets, spreadsheetID string) error {
+	ss, err := s.Get(ctx, spreadsheetID)
+	if err != nil {
+		return errors.Wrap(err, "opening the spreadsheet")
+	}
+	var missing int64
+	for _, sheet := range ss.Sheets {
+		if sheet.Properties.SheetId >= missing {
+			missing = sheet.Properties.SheetId + 1
+		}
+	}
+	err = s.BatchUpdate(ctx, spreadsheetID, []*sheets.Request{
+		{
+			UpdateSheetProperties: &sheets.UpdateSheetPropertiesRequest{
+				Fields:     "title",
+				Properties: &sheets.SheetProperties{SheetId: missing, Title: "access check"},
+			},
+		},
+	})
+	var apiErr *googleapi.Error
+	if err == nil || errors.As(err, &apiErr) && apiErr.Code == http.StatusBadRequest {
+		return nil
+	}
+	return errors.Wrap(err, "editing the spreadsheet")
+}
@@ -0,0 +1,557 @@
+// Package sheetstest provides an in-memory implementation of
+// sheets.Spreadsheets, so spreadsheet writes can be asserted on as a grid of
+// cells without talking to Google.
+package sheetstest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"google.golang.org/api/sheets/v4"
+)
+
+const (
+	defaultRowCount    = 1000
+	defaultColumnCount = 26
+)
+
+// Fake models spreadsheets as grids of cells. Batch updates are atomic, like
+// the real API, and writes outside a sheet's grid are rejected.
+type Fake struct {
+	mu           sync.Mutex
+	spreadsheets map[string]*spreadsheet
+	nextID       int
+}
+
+type spreadsheet struct {
+	id       string
+	title    string
+	timeZone string
+	sheets   []*sheet
+}
+
+type sheet struct {
+	props *sheets.SheetProperties
+	rows  [][]*sheets.CellData
+}
+
+func NewFake() *Fake {
+	return &Fake{
+		spreadsheets: make(map[string]*spreadsheet),
+	}
+}
+
+// Create creates a spreadsheet with a single empty Sheet1, in the
+// Europe/London time zone.
+func (f *Fake) Create(ctx context.Context) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nextID++
+	id := fmt.Sprintf("spreadsheet-%d", f.nextID)
+	f.spreadsheets[id] = &spreadsheet{
+		id:       id,
+		title:    "Y.N.A.S Export",
+		timeZone: "Europe/London",
+		sheets: []*sheet{
+			{props: newProperties(&sheets.SheetProperties{SheetId: 0, Title: "Sheet1"}, 0)},
+		},
+	}
+	return id, nil
+}
+
+func (f *Fake) Get(ctx context.Context, spreadsheetID string) (*sheets.Spreadsheet, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ss, ok := f.spreadsheets[spreadsheetID]
+	if !ok {
+		return nil, fmt.Errorf("spreadsheet %s not found", spreadsheetID)
+	}
+	out := &sheets.Spreadsheet{
+		SpreadsheetId: ss.id,
+		Properties: &sheets.SpreadsheetProperties{
+			Title:    ss.title,
+			TimeZone: ss.timeZone,
+		},
+	}
+	for _, sh := range ss.sheets {
+		var rows []*sheets.RowData
+		for _, cells := range trim(sh.rows) {
+			rd := &sheets.RowData{}
+			for _, c := range cells {
+				if c == nil {
+					c = &sheets.CellData{}
+				}
+				rd.Values = append(rd.Values, copyCell(c))
+			}
+			rows = append(rows, rd)
+		}
+		props := *sh.props
+		grid := *sh.props.GridProperties
+		props.GridProperties = &grid
+		out.Sheets = append(out.Sheets, &sheets.Sheet{
+			Properties: &props,
+			Data:       []*sheets.GridData{{RowData: rows}},
+		})
+	}
+	return out, nil
+}
+
+func (f *Fake) BatchUpdate(ctx context.Context, spreadsheetID string, reqs []*sheets.Request) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ss, ok := f.spreadsheets[spreadsheetID]
+	if !ok {
+		return fmt.Errorf("spreadsheet %s not found", spreadsheetID)
+	}
+	// apply to a copy so a failing request leaves the spreadsheet untouched
+	next := ss.clone()
+	for i, req := range reqs {
+		err := next.apply(req)
+		if err != nil {
+			return fmt.Errorf("request %d: %s", i, err)
+		}
+	}
+	f.spreadsheets[spreadsheetID] = next
+	return nil
+}
+
+// Titles returns the titles of every sheet in the spreadsheet, in order, or
+// nil if there's no such spreadsheet.
+func (f *Fake) Titles(spreadsheetID string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ss, ok := f.spreadsheets[spreadsheetID]
+	if !ok {
+		return nil
+	}
+	var out []string
+	for _, sh := range ss.sheets {
+		out = append(out, sh.props.Title)
+	}
+	return out
+}
+
+// Grid returns the user entered values of a sheet as strings, trimmed to the
+// last row and column with data. Numbers are formatted with
+// strconv.FormatFloat(v, 'f', -1, 64).
+func (f *Fake) Grid(spreadsheetID, title string) [][]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ss, ok := f.spreadsheets[spreadsheetID]
+	if !ok {
+		return nil
+	}
+	sh := ss.byTitle(title)
+	if sh == nil {
+		return nil
+	}
+	var out [][]string
+	for _, cells := range trim(sh.rows) {
+		var row []string
+		for _, c := range cells {
+			row = append(row, FormatCell(c))
+		}
+		out = append(out, row)
+	}
+	return out
+}
+
+// FormatCell formats a cell's user entered value as a string.
+func FormatCell(c *sheets.CellData) string {
+	if c == nil || c.UserEnteredValue == nil {
+		return ""
+	}
+	v := c.UserEnteredValue
+	switch {
+	case v.StringValue != nil:
+		return *v.StringValue
+	case v.NumberValue != nil:
+		return strconv.FormatFloat(*v.NumberValue, 'f', -1, 64)
+	case v.BoolValue != nil:
+		return strconv.FormatBool(*v.BoolValue)
+	case v.FormulaValue != nil:
+		return *v.FormulaValue
+	}
+	return ""
+}
+
+func (ss *spreadsheet) apply(req *sheets.Request) error {
+	switch {
+	case req.AddSheet != nil:
+		return ss.addSheet(req.AddSheet)
+	case req.UpdateCells != nil:
+		return ss.updateCells(req.UpdateCells)
+	case req.AppendCells != nil:
+		return ss.appendCells(req.AppendCells)
+	case req.AppendDimension != nil:
+		return ss.appendDimension(req.AppendDimension)
+	case req.UpdateSheetProperties != nil:
+		return ss.updateSheetProperties(req.UpdateSheetProperties)
+	case req.DeleteSheet != nil:
+		return ss.deleteSheet(req.DeleteSheet)
+	case req.UpdateSpreadsheetProperties != nil:
+		return ss.updateSpreadsheetProperties(req.UpdateSpreadsheetProperties)
+	default:
+		buf, _ := json.Marshal(req)
+		return fmt.Errorf("unsupported request: %s", buf)
+	}
+}
+
+func (ss *spreadsheet) addSheet(req *sheets.AddSheetRequest) error {
+	props := req.Properties
+	if props == nil {
+		props = &sheets.SheetProperties{}
+	}
+	if props.Title == "" {
+		props.Title = fmt.Sprintf("Sheet%d", len(ss.sheets)+1)
+	}
+	if ss.byTitle(props.Title) != nil {
+		return fmt.Errorf("a sheet with the name %q already exists", props.Title)
+	}
+	if props.SheetId != 0 && ss.byID(props.SheetId) != nil {
+		return fmt.Errorf("a sheet with the id %d already exists", props.SheetId)
+	}
+	if props.SheetId == 0 {
+		var max int64
+		for _, sh := range ss.sheets {
+			if sh.props.SheetId > max {
+				max = sh.props.SheetId
+			}
+		}
+		props = copyProperties(props)
+		props.SheetId = max + 1
+	}
+	ss.sheets = append(ss.sheets, &sheet{props: newProperties(props, int64(len(ss.sheets)))})
+	return nil
+}
+
+func (ss *spreadsheet) updateCells(req *sheets.UpdateCellsRequest) error {
+	var (
+		sh                 *sheet
+		startRow, startCol int64
+		endRow, endCol     int64 = -1, -1
+	)
+	switch {
+	case req.Range != nil:
+		sh = ss.byID(req.Range.SheetId)
+		startRow, startCol = req.Range.StartRowIndex, req.Range.StartColumnIndex
+		if sh != nil {
+			// zero end indexes are omitted from requests, so the range is unbounded
+			endRow, endCol = req.Range.EndRowIndex, req.Range.EndColumnIndex
+			if endRow == 0 {
+				endRow = sh.props.GridProperties.RowCount
+			}
+			if endCol == 0 {
+				endCol = sh.props.GridProperties.ColumnCount
+			}
+		}
+	case req.Start != nil:
+		sh = ss.byID(req.Start.SheetId)
+		startRow, startCol = req.Start.RowIndex, req.Start.ColumnIndex
+	default:
+		return fmt.Errorf("update cells needs a range or start")
+	}
+	if sh == nil {
+		return fmt.Errorf("no sheet with the id %d", sheetID(req))
+	}
+	for i, rd := range req.Rows {
+		for j, c := range rd.Values {
+			err := sh.set(startRow+int64(i), startCol+int64(j), c, req.Fields)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	// cells in the range that aren't covered by rows are cleared
+	for r := startRow; r < endRow && r < int64(len(sh.rows)); r++ {
+		for c := startCol; c < endCol && c < int64(len(sh.rows[r])); c++ {
+			i, j := r-startRow, c-startCol
+			if i < int64(len(req.Rows)) && j < int64(len(req.Rows[i].Values)) {
+				continue
+			}
+			sh.rows[r][c] = mergeCell(sh.rows[r][c], nil, req.Fields)
+		}
+	}
+	return nil
+}
+
+func (ss *spreadsheet) appendCells(req *sheets.AppendCellsRequest) error {
+	sh := ss.byID(req.SheetId)
+	if sh == nil {
+		return fmt.Errorf("no sheet with the id %d", req.SheetId)
+	}
+	start := int64(len(trim(sh.rows)))
+	if need := start + int64(len(req.Rows)); need > sh.props.GridProperties.RowCount {
+		sh.props.GridProperties.RowCount = need
+	}
+	for i, rd := range req.Rows {
+		for j, c := range rd.Values {
+			err := sh.set(start+int64(i), int64(j), c, req.Fields)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (ss *spreadsheet) appendDimension(req *sheets.AppendDimensionRequest) error {
+	sh := ss.byID(req.SheetId)
+	if sh == nil {
+		return fmt.Errorf("no sheet with the id %d", req.SheetId)
+	}
+	if req.Length < 1 {
+		return fmt.Errorf("length must be at least 1")
+	}
+	switch req.Dimension {
+	case "ROWS":
+		sh.props.GridProperties.RowCount += req.Length
+	case "COLUMNS":
+		sh.props.GridProperties.ColumnCount += req.Length
+	default:
+		return fmt.Errorf("unsupported dimension %q", req.Dimension)
+	}
+	return nil
+}
+
+// updateSheetProperties supports the title, hidden and frozen row and column
+// fields of the mask.
+func (ss *spreadsheet) updateSheetProperties(req *sheets.UpdateSheetPropertiesRequest) error {
+	if req.Properties == nil {
+		return fmt.Errorf("update sheet properties needs properties")
+	}
+	sh := ss.byID(req.Properties.SheetId)
+	if sh == nil {
+		return fmt.Errorf("no sheet with the id %d", req.Properties.SheetId)
+	}
+	grid := req.Properties.GridProperties
+	if grid == nil {
+		grid = &sheets.GridProperties{}
+	}
+	for _, field := range strings.Split(req.Fields, ",") {
+		switch strings.TrimSpace(field) {
+		case "title":
+			if other := ss.byTitle(req.Properties.Title); other != nil && other != sh {
+				return fmt.Errorf("a sheet with the name %q already exists", req.Properties.Title)
+			}
+			sh.props.Title = req.Properties.Title
+		case "gridProperties.frozenRowCount":
+			sh.props.GridProperties.FrozenRowCount = grid.FrozenRowCount
+		case "gridProperties.frozenColumnCount":
+			sh.props.GridProperties.FrozenColumnCount = grid.FrozenColumnCount
+		case "hidden":
+			if req.Properties.Hidden && ss.visible() == 1 && !sh.props.Hidden {
+				return fmt.Errorf("you can't hide all the sheets in a document")
+			}
+			sh.props.Hidden = req.Properties.Hidden
+		default:
+			return fmt.Errorf("unsupported field %q", field)
+		}
+	}
+	return nil
+}
+
+// updateSpreadsheetProperties supports the title field of the mask.
+func (ss *spreadsheet) updateSpreadsheetProperties(req *sheets.UpdateSpreadsheetPropertiesRequest) error {
+	if req.Properties == nil {
+		return fmt.Errorf("update spreadsheet properties needs properties")
+	}
+	for _, field := range strings.Split(req.Fields, ",") {
+		switch strings.TrimSpace(field) {
+		case "title":
+			ss.title = req.Properties.Title
+		default:
+			return fmt.Errorf("unsupported field %q", field)
+		}
+	}
+	return nil
+}
+
+func (ss *spreadsheet) deleteSheet(req *sheets.DeleteSheetRequest) error {
+	for i, sh := range ss.sheets {
+		if sh.props.SheetId != req.SheetId {
+			continue
+		}
+		if len(ss.sheets) == 1 {
+			return fmt.Errorf("you can't remove all the sheets in a document")
+		}
+		ss.sheets = append(ss.sheets[:i], ss.sheets[i+1:]...)
+		for j, sh := range ss.sheets {
+			sh.props.Index = int64(j)
+		}
+		return nil
+	}
+	return fmt.Errorf("no sheet with the id %d", req.SheetId)
+}
+
+// visible returns the number of sheets which aren't hidden.
+func (ss *spreadsheet) visible() int {
+	n := 0
+	for _, sh := range ss.sheets {
+		if !sh.props.Hidden {
+			n++
+		}
+	}
+	return n
+}
+
+func (sh *sheet) set(row, col int64, c *sheets.CellData, fields string) error {
+	grid := sh.props.GridProperties
+	if row >= grid.RowCount || col >= grid.ColumnCount {
+		return fmt.Errorf(
+			"range (%s!%s) exceeds grid limits: max rows %d, max columns %d",
+			sh.props.Title, cellName(row, col), grid.RowCount, grid.ColumnCount,
+		)
+	}
+	for int64(len(sh.rows)) <= row {
+		sh.rows = append(sh.rows, nil)
+	}
+	for int64(len(sh.rows[row])) <= col {
+		sh.rows[row] = append(sh.rows[row], nil)
+	}
+	sh.rows[row][col] = mergeCell(sh.rows[row][col], c, fields)
+	return nil
+}
+
+// mergeCell writes the fields in the mask from src over dst, "*" replaces the
+// whole cell.
+func mergeCell(dst, src *sheets.CellData, fields string) *sheets.CellData {
+	if src == nil {
+		src = &sheets.CellData{}
+	}
+	if fields == "*" || fields == "" {
+		if src.UserEnteredValue == nil && src.UserEnteredFormat == nil && src.Note == "" {
+			return nil
+		}
+		return copyCell(src)
+	}
+	out := &sheets.CellData{}
+	if dst != nil {
+		out = copyCell(dst)
+	}
+	for _, field := range strings.Split(fields, ",") {
+		switch strings.Split(strings.TrimSpace(field), ".")[0] {
+		case "userEnteredValue":
+			out.UserEnteredValue = copyCell(src).UserEnteredValue
+		case "userEnteredFormat":
+			out.UserEnteredFormat = copyCell(src).UserEnteredFormat
+		case "note":
+			out.Note = src.Note
+		}
+	}
+	return out
+}
+
+func (ss *spreadsheet) byID(id int64) *sheet {
+	for _, sh := range ss.sheets {
+		if sh.props.SheetId == id {
+			return sh
+		}
+	}
+	return nil
+}
+
+func (ss *spreadsheet) byTitle(title string) *sheet {
+	for _, sh := range ss.sheets {
+		if sh.props.Title == title {
+			return sh
+		}
+	}
+	return nil
+}
+
+func (ss *spreadsheet) clone() *spreadsheet {
+	out := &spreadsheet{id: ss.id, title: ss.title, timeZone: ss.timeZone}
+	for _, sh := range ss.sheets {
+		next := &sheet{props: copyProperties(sh.props)}
+		for _, cells := range sh.rows {
+			row := make([]*sheets.CellData, len(cells))
+			for i, c := range cells {
+				if c != nil {
+					row[i] = copyCell(c)
+				}
+			}
+			next.rows = append(next.rows, row)
+		}
+		out.sheets = append(out.sheets, next)
+	}
+	return out
+}
+
+func newProperties(props *sheets.SheetProperties, index int64) *sheets.SheetProperties {
+	props = copyProperties(props)
+	props.Index = index
+	if props.SheetType == "" {
+		props.SheetType = "GRID"
+	}
+	if props.GridProperties == nil {
+		props.GridProperties = &sheets.GridProperties{}
+	}
+	if props.GridProperties.RowCount == 0 {
+		props.GridProperties.RowCount = defaultRowCount
+	}
+	if props.GridProperties.ColumnCount == 0 {
+		props.GridProperties.ColumnCount = defaultColumnCount
+	}
+	return props
+}
+
+func copyProperties(props *sheets.SheetProperties) *sheets.SheetProperties {
+	out := &sheets.SheetProperties{}
+	roundTrip(props, out)
+	return out
+}
+
+func copyCell(c *sheets.CellData) *sheets.CellData {
+	out := &sheets.CellData{}
+	roundTrip(c, out)
+	return out
+}
+
+func roundTrip(src, dst interface{}) {
+	buf, err := json.Marshal(src)
+	if err != nil {
+		panic(err)
+	}
+	err = json.Unmarshal(buf, dst)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// trim drops trailing empty rows and cells, as the API does when returning
+// grid data.
+func trim(rows [][]*sheets.CellData) [][]*sheets.CellData {
+	var out [][]*sheets.CellData
+	for _, cells := range rows {
+		end := len(cells)
+		for end > 0 && cells[end-1] == nil {
+			end--
+		}
+		out = append(out, cells[:end])
+	}
+	end := len(out)
+	for end > 0 && len(out[end-1]) == 0 {
+		end--
+	}
+	return out[:end]
+}
+
+func sheetID(req *sheets.UpdateCellsRequest) int64 {
+	if req.Range != nil {
+		return req.Range.SheetId
+	}
+	return req.Start.SheetId
+}
+
+func cellName(row, col int64) string {
+	var name string
+	for col++; col > 0; col = (col - 1) / 26 {
+		name = string(rune('A'+(col-1)%26)) + name
+	}
+	return name + strconv.FormatInt(row+1, 10)
+}
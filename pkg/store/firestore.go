@@ -0,0 +1,107 @@
+package store
+
+import (
+	"context"
+	"reflect"
+
+	"cloud.google.com/go/firestore"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type firestoreStore struct {
+	fs *firestore.Client
+}
+
+func NewFirestore(ctx context.Context, project string) (Store, error) {
+	fs, err := firestore.NewClient(ctx, project)
+	if err != nil {
+		return nil, err
+	}
+	return &firestoreStore{fs: fs}, nil
+}
+
+func (s *firestoreStore) Get(ctx context.Context, collection, id string, v interface{}) error {
+	doc, err := s.fs.Collection(collection).Doc(id).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return doc.DataTo(v)
+}
+
+func (s *firestoreStore) Set(ctx context.Context, collection, id string, v interface{}) error {
+	_, err := s.fs.Collection(collection).Doc(id).Set(ctx, v)
+	return err
+}
+
+func (s *firestoreStore) Update(ctx context.Context, collection, id string, v interface{}, fn func() error) error {
+	ref := s.fs.Collection(collection).Doc(id)
+	return s.fs.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(ref)
+		if status.Code(err) == codes.NotFound {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		// a retried transaction decodes into v again, start from scratch
+		rv := reflect.ValueOf(v).Elem()
+		rv.Set(reflect.Zero(rv.Type()))
+		err = doc.DataTo(v)
+		if err != nil {
+			return err
+		}
+		err = fn()
+		if err != nil {
+			return err
+		}
+		return tx.Set(ref, v)
+	})
+}
+
+func (s *firestoreStore) Delete(ctx context.Context, collection, id string) error {
+	_, err := s.fs.Collection(collection).Doc(id).Delete(ctx)
+	return err
+}
+
+func (s *firestoreStore) Query(ctx context.Context, collection string, q Query, dst interface{}) error {
+	out, elem, err := sliceOf(dst)
+	if err != nil {
+		return err
+	}
+	fq := s.fs.Collection(collection).Query
+	for _, f := range q.Filters {
+		fq = fq.Where(f.Field, "==", f.Value)
+	}
+	if q.OrderBy != "" {
+		dir := firestore.Asc
+		if q.Descending {
+			dir = firestore.Desc
+		}
+		fq = fq.OrderBy(q.OrderBy, dir)
+	}
+	if q.Limit > 0 {
+		fq = fq.Limit(q.Limit)
+	}
+	docs, err := fq.Documents(ctx).GetAll()
+	if err != nil {
+		return err
+	}
+	for _, doc := range docs {
+		v := reflect.New(elem)
+		err = doc.DataTo(v.Interface())
+		if err != nil {
+			return errors.Wrapf(err, "decoding %s/%s", collection, doc.Ref.ID)
+		}
+		out.Set(reflect.Append(out, v.Elem()))
+	}
+	return nil
+}
+
+func (s *firestoreStore) Close() error {
+	return s.fs.Close()
+}
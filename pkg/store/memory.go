@@ -0,0 +1,88 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+)
+
+type memoryStore struct {
+	mu   sync.RWMutex
+	docs map[string]map[string][]byte
+}
+
+// NewMemory returns a Store that keeps documents in memory, it's intended for
+// tests and local development.
+func NewMemory() Store {
+	return &memoryStore{
+		docs: make(map[string]map[string][]byte),
+	}
+}
+
+func (s *memoryStore) Get(ctx context.Context, collection, id string, v interface{}) error {
+	s.mu.RLock()
+	buf, ok := s.docs[collection][id]
+	s.mu.RUnlock()
+	if !ok {
+		return ErrNotFound
+	}
+	return json.Unmarshal(buf, v)
+}
+
+func (s *memoryStore) Set(ctx context.Context, collection, id string, v interface{}) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.docs[collection] == nil {
+		s.docs[collection] = make(map[string][]byte)
+	}
+	s.docs[collection][id] = buf
+	return nil
+}
+
+func (s *memoryStore) Update(ctx context.Context, collection, id string, v interface{}, fn func() error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	buf, ok := s.docs[collection][id]
+	if !ok {
+		return ErrNotFound
+	}
+	err := json.Unmarshal(buf, v)
+	if err != nil {
+		return err
+	}
+	err = fn()
+	if err != nil {
+		return err
+	}
+	buf, err = json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	s.docs[collection][id] = buf
+	return nil
+}
+
+func (s *memoryStore) Delete(ctx context.Context, collection, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.docs[collection], id)
+	return nil
+}
+
+func (s *memoryStore) Query(ctx context.Context, collection string, q Query, dst interface{}) error {
+	s.mu.RLock()
+	var docs []document
+	for id, buf := range s.docs[collection] {
+		docs = append(docs, document{id: id, data: buf})
+	}
+	s.mu.RUnlock()
+	return applyQuery(docs, q, dst)
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,114 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// sliceOf validates that dst is a pointer to a slice of structs, and returns
+// the slice value and its element type.
+func sliceOf(dst interface{}) (reflect.Value, reflect.Type, error) {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Slice {
+		return reflect.Value{}, nil, fmt.Errorf("expected pointer to slice, got %T", dst)
+	}
+	elem := v.Elem().Type().Elem()
+	if elem.Kind() != reflect.Struct {
+		return reflect.Value{}, nil, fmt.Errorf("expected slice of structs, got %T", dst)
+	}
+	return v.Elem(), elem, nil
+}
+
+type document struct {
+	id   string
+	data []byte
+}
+
+// applyQuery decodes JSON encoded documents into dst, filtering, ordering and
+// limiting them in memory. It is used by the backends that don't have native
+// query support.
+func applyQuery(docs []document, q Query, dst interface{}) error {
+	out, elem, err := sliceOf(dst)
+	if err != nil {
+		return err
+	}
+	sort.Slice(docs, func(i, j int) bool {
+		return docs[i].id < docs[j].id
+	})
+	var matched []reflect.Value
+	for _, doc := range docs {
+		v := reflect.New(elem)
+		err := json.Unmarshal(doc.data, v.Interface())
+		if err != nil {
+			return errors.Wrapf(err, "decoding %s", doc.id)
+		}
+		ok, err := matches(v.Elem(), q.Filters)
+		if err != nil {
+			return err
+		}
+		if ok {
+			matched = append(matched, v.Elem())
+		}
+	}
+	if q.OrderBy != "" {
+		var sortErr error
+		sort.SliceStable(matched, func(i, j int) bool {
+			a, b := matched[i].FieldByName(q.OrderBy), matched[j].FieldByName(q.OrderBy)
+			if !a.IsValid() || !b.IsValid() {
+				sortErr = fmt.Errorf("unknown field %s on %s", q.OrderBy, elem)
+				return false
+			}
+			if q.Descending {
+				return less(b, a)
+			}
+			return less(a, b)
+		})
+		if sortErr != nil {
+			return sortErr
+		}
+	}
+	if q.Limit > 0 && len(matched) > q.Limit {
+		matched = matched[:q.Limit]
+	}
+	for _, v := range matched {
+		out.Set(reflect.Append(out, v))
+	}
+	return nil
+}
+
+func matches(v reflect.Value, filters []Filter) (bool, error) {
+	for _, f := range filters {
+		field := v.FieldByName(f.Field)
+		if !field.IsValid() {
+			return false, fmt.Errorf("unknown field %s on %s", f.Field, v.Type())
+		}
+		if !reflect.DeepEqual(field.Interface(), f.Value) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func less(a, b reflect.Value) bool {
+	if t, ok := a.Interface().(time.Time); ok {
+		return t.Before(b.Interface().(time.Time))
+	}
+	switch a.Kind() {
+	case reflect.String:
+		return a.String() < b.String()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return a.Int() < b.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return a.Uint() < b.Uint()
+	case reflect.Float32, reflect.Float64:
+		return a.Float() < b.Float()
+	case reflect.Bool:
+		return !a.Bool() && b.Bool()
+	}
+	return false
+}
@@ -0,0 +1,137 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+)
+
+const sqlSchema = `CREATE TABLE IF NOT EXISTS documents (
+	collection TEXT NOT NULL,
+	id         TEXT NOT NULL,
+	data       TEXT NOT NULL,
+	PRIMARY KEY (collection, id)
+)`
+
+type sqlStore struct {
+	db *sql.DB
+}
+
+// NewSQL returns a Store backed by a single documents table, documents are
+// stored as JSON. It's written against SQLite, see NewSQLite.
+func NewSQL(ctx context.Context, db *sql.DB) (Store, error) {
+	_, err := db.ExecContext(ctx, sqlSchema)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlStore{db: db}, nil
+}
+
+func (s *sqlStore) Get(ctx context.Context, collection, id string, v interface{}) error {
+	var data string
+	err := s.db.QueryRowContext(
+		ctx,
+		"SELECT data FROM documents WHERE collection = ? AND id = ?",
+		collection, id,
+	).Scan(&data)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(data), v)
+}
+
+func (s *sqlStore) Set(ctx context.Context, collection, id string, v interface{}) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(
+		ctx,
+		`INSERT INTO documents (collection, id, data) VALUES (?, ?, ?)
+		ON CONFLICT (collection, id) DO UPDATE SET data = excluded.data`,
+		collection, id, string(buf),
+	)
+	return err
+}
+
+func (s *sqlStore) Update(ctx context.Context, collection, id string, v interface{}, fn func() error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var data string
+	err = tx.QueryRowContext(
+		ctx,
+		"SELECT data FROM documents WHERE collection = ? AND id = ?",
+		collection, id,
+	).Scan(&data)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal([]byte(data), v)
+	if err != nil {
+		return err
+	}
+	err = fn()
+	if err != nil {
+		return err
+	}
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(
+		ctx,
+		"UPDATE documents SET data = ? WHERE collection = ? AND id = ?",
+		string(buf), collection, id,
+	)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) Delete(ctx context.Context, collection, id string) error {
+	_, err := s.db.ExecContext(
+		ctx,
+		"DELETE FROM documents WHERE collection = ? AND id = ?",
+		collection, id,
+	)
+	return err
+}
+
+func (s *sqlStore) Query(ctx context.Context, collection string, q Query, dst interface{}) error {
+	rows, err := s.db.QueryContext(
+		ctx,
+		"SELECT id, data FROM documents WHERE collection = ?",
+		collection,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var docs []document
+	for rows.Next() {
+		var id, data string
+		err = rows.Scan(&id, &data)
+		if err != nil {
+			return err
+		}
+		docs = append(docs, document{id: id, data: []byte(data)})
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return applyQuery(docs, q, dst)
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
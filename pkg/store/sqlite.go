@@ -0,0 +1,28 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+
+	// registers the sqlite3 driver, which needs cgo
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// NewSQLite returns a Store kept in the SQLite database at path, for self
+// hosting without Firestore. Everything goes through one connection, as
+// SQLite only has one writer at a time and Update's transactions would
+// otherwise fail as busy, and so ":memory:" is one database rather than one
+// per connection.
+func NewSQLite(ctx context.Context, path string) (Store, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	s, err := NewSQL(ctx, db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
@@ -3,47 +3,109 @@ package store
 import (
 	"context"
 	"errors"
+	"fmt"
 	"net/http"
+	"os"
 
 	"github.com/arussellsaw/youneedaspreadsheet/pkg/util"
+)
 
-	"cloud.google.com/go/firestore"
+var (
+	ErrStoreNotFound = errors.New("not_found.store: couldn't find store in context")
+	ErrNotFound      = errors.New("not_found.document: couldn't find document")
 )
 
-var ErrStoreNotFound = errors.New("not_found.store: couldn't find store in context")
+// Store is a document store, values are structs that are persisted by
+// collection and ID. Queries filter on the Go field names of the stored struct.
+type Store interface {
+	Get(ctx context.Context, collection, id string, v interface{}) error
+	Set(ctx context.Context, collection, id string, v interface{}) error
+	Delete(ctx context.Context, collection, id string) error
+	// Update reads the document into v, which must be a pointer, calls fn to
+	// change it and writes it back, atomically. fn is called again if the
+	// document changes before it can be written, and mustn't use the store.
+	Update(ctx context.Context, collection, id string, v interface{}, fn func() error) error
+	// Query decodes all matching documents into dst, which must be a pointer
+	// to a slice of structs.
+	Query(ctx context.Context, collection string, q Query, dst interface{}) error
+	Close() error
+}
 
-func Init(ctx context.Context) (*firestore.Client, error) {
-	var err error
-	fs, err := firestore.NewClient(ctx, util.Project())
-	if err != nil {
-		return fs, err
-	}
+type Filter struct {
+	Field string
+	Value interface{}
+}
+
+type Query struct {
+	Filters    []Filter
+	OrderBy    string
+	Descending bool
+	Limit      int
+}
+
+func Where(field string, value interface{}) Query {
+	return Query{}.Where(field, value)
+}
 
-	return fs, nil
+func (q Query) Where(field string, value interface{}) Query {
+	q.Filters = append(q.Filters, Filter{Field: field, Value: value})
+	return q
+}
+
+func (q Query) Order(field string, descending bool) Query {
+	q.OrderBy = field
+	q.Descending = descending
+	return q
+}
+
+func (q Query) WithLimit(n int) Query {
+	q.Limit = n
+	return q
+}
+
+// Init sets up the store configured by STORE_BACKEND, one of firestore
+// (default), sql or memory. The sql backend keeps everything in the SQLite
+// database at STORE_SQL_DSN, youneedaspreadsheet.db if it's unset, and needs
+// a binary built with cgo.
+func Init(ctx context.Context) (Store, error) {
+	switch backend := os.Getenv("STORE_BACKEND"); backend {
+	case "", "firestore":
+		return NewFirestore(ctx, util.Project())
+	case "memory":
+		return NewMemory(), nil
+	case "sql":
+		dsn := os.Getenv("STORE_SQL_DSN")
+		if dsn == "" {
+			dsn = "youneedaspreadsheet.db"
+		}
+		return NewSQLite(ctx, dsn)
+	default:
+		return nil, fmt.Errorf("unknown store backend: %s", backend)
+	}
 }
 
-type fsKey string
+type storeKey string
 
-func FromContext(ctx context.Context) (*firestore.Client, error) {
-	c, ok := ctx.Value(fsKey("firestore")).(*firestore.Client)
+func FromContext(ctx context.Context) (Store, error) {
+	s, ok := ctx.Value(storeKey("store")).(Store)
 	if !ok {
 		return nil, ErrStoreNotFound
 	}
-	return c, nil
+	return s, nil
 }
 
-func WithStore(ctx context.Context, c *firestore.Client) context.Context {
-	return context.WithValue(ctx, fsKey("firestore"), c)
+func WithStore(ctx context.Context, s Store) context.Context {
+	return context.WithValue(ctx, storeKey("store"), s)
 }
 
-func StoreMiddleware(h http.Handler, fs *firestore.Client) http.Handler {
+func StoreMiddleware(h http.Handler, s Store) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		h.ServeHTTP(
 			w,
 			r.WithContext(
 				WithStore(
 					r.Context(),
-					fs,
+					s,
 				),
 			),
 		)
@@ -0,0 +1,242 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+// record has JSON names which differ from its Go field names, queries always
+// use the Go field names whichever backend stores it.
+type record struct {
+	ID      string           `json:"id"`
+	UserID  string           `json:"user_id"`
+	Started time.Time        `json:"started"`
+	Count   int              `json:"count"`
+	Tags    map[string]int64 `json:"tags,omitempty"`
+	Ref     *int64           `json:"ref,omitempty"`
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemory())
+}
+
+func TestSQLiteStore(t *testing.T) {
+	s, err := NewSQLite(context.Background(), ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	testStore(t, s)
+}
+
+// TestFirestoreStore runs the same tests against the Firestore emulator, if
+// FIRESTORE_EMULATOR_HOST is set.
+func TestFirestoreStore(t *testing.T) {
+	if os.Getenv("FIRESTORE_EMULATOR_HOST") == "" {
+		t.Skip("FIRESTORE_EMULATOR_HOST isn't set")
+	}
+	s, err := NewFirestore(context.Background(), "store-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	testStore(t, s)
+}
+
+func testStore(t *testing.T, s Store) {
+	ctx := context.Background()
+	collection := "records-" + time.Now().Format("150405.000000000")
+	base := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	ref := int64(42)
+
+	t.Run("get missing", func(t *testing.T) {
+		var r record
+		if err := s.Get(ctx, collection, "missing", &r); err != ErrNotFound {
+			t.Fatalf("got %v, want ErrNotFound", err)
+		}
+	})
+
+	for i, userID := range []string{"usr_a", "usr_b", "usr_a", "usr_a", "usr_b"} {
+		r := record{
+			ID:      string(rune('a' + i)),
+			UserID:  userID,
+			Started: base.Add(time.Duration(i) * time.Hour),
+			Count:   i,
+		}
+		if i == 0 {
+			r.Tags = map[string]int64{"x": 1}
+			r.Ref = &ref
+		}
+		if err := s.Set(ctx, collection, r.ID, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("get", func(t *testing.T) {
+		var r record
+		if err := s.Get(ctx, collection, "a", &r); err != nil {
+			t.Fatal(err)
+		}
+		if r.UserID != "usr_a" || !r.Started.Equal(base) || r.Tags["x"] != 1 || r.Ref == nil || *r.Ref != ref {
+			t.Fatalf("got %+v", r)
+		}
+	})
+
+	t.Run("set replaces", func(t *testing.T) {
+		if err := s.Set(ctx, collection, "e", record{ID: "e", UserID: "usr_b", Started: base.Add(4 * time.Hour), Count: 40}); err != nil {
+			t.Fatal(err)
+		}
+		var r record
+		if err := s.Get(ctx, collection, "e", &r); err != nil {
+			t.Fatal(err)
+		}
+		if r.Count != 40 {
+			t.Fatalf("got count %d, want 40", r.Count)
+		}
+	})
+
+	t.Run("query where", func(t *testing.T) {
+		var rs []record
+		if err := s.Query(ctx, collection, Where("UserID", "usr_a"), &rs); err != nil {
+			t.Fatal(err)
+		}
+		if got := ids(rs); !sameSet(got, []string{"a", "c", "d"}) {
+			t.Fatalf("got %v", got)
+		}
+	})
+
+	t.Run("query where order limit", func(t *testing.T) {
+		var rs []record
+		q := Where("UserID", "usr_a").Order("Started", true).WithLimit(2)
+		if err := s.Query(ctx, collection, q, &rs); err != nil {
+			t.Fatal(err)
+		}
+		if got := ids(rs); !equal(got, []string{"d", "c"}) {
+			t.Fatalf("got %v, want [d c]", got)
+		}
+	})
+
+	t.Run("query order ascending", func(t *testing.T) {
+		var rs []record
+		if err := s.Query(ctx, collection, Query{}.Order("Count", false), &rs); err != nil {
+			t.Fatal(err)
+		}
+		if got := ids(rs); !equal(got, []string{"a", "b", "c", "d", "e"}) {
+			t.Fatalf("got %v", got)
+		}
+	})
+
+	t.Run("update", func(t *testing.T) {
+		var r record
+		err := s.Update(ctx, collection, "b", &r, func() error {
+			if r.UserID != "usr_b" {
+				t.Errorf("update read %+v", r)
+			}
+			r.Count += 10
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got record
+		if err := s.Get(ctx, collection, "b", &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Count != 11 || got.UserID != "usr_b" {
+			t.Fatalf("got %+v", got)
+		}
+	})
+
+	t.Run("update failing", func(t *testing.T) {
+		var r record
+		failed := errors.New("failed")
+		err := s.Update(ctx, collection, "b", &r, func() error {
+			r.Count = 0
+			return failed
+		})
+		if err != failed {
+			t.Fatalf("got %v, want the error from fn", err)
+		}
+		var got record
+		if err := s.Get(ctx, collection, "b", &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Count != 11 {
+			t.Fatalf("failed update was written: %+v", got)
+		}
+	})
+
+	t.Run("update missing", func(t *testing.T) {
+		var r record
+		err := s.Update(ctx, collection, "missing", &r, func() error {
+			t.Error("fn called for a missing document")
+			return nil
+		})
+		if err != ErrNotFound {
+			t.Fatalf("got %v, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		if err := s.Delete(ctx, collection, "a"); err != nil {
+			t.Fatal(err)
+		}
+		var r record
+		if err := s.Get(ctx, collection, "a", &r); err != ErrNotFound {
+			t.Fatalf("got %v, want ErrNotFound", err)
+		}
+		var rs []record
+		if err := s.Query(ctx, collection, Where("UserID", "usr_a"), &rs); err != nil {
+			t.Fatal(err)
+		}
+		if got := ids(rs); !sameSet(got, []string{"c", "d"}) {
+			t.Fatalf("got %v", got)
+		}
+	})
+
+	t.Run("query bad destination", func(t *testing.T) {
+		var r record
+		if err := s.Query(ctx, collection, Query{}, &r); err == nil {
+			t.Fatal("expected an error querying into a struct")
+		}
+	})
+}
+
+func ids(rs []record) []string {
+	var out []string
+	for _, r := range rs {
+		out = append(out, r.ID)
+	}
+	return out
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func sameSet(a, b []string) bool {
+	seen := make(map[string]int)
+	for _, s := range a {
+		seen[s]++
+	}
+	for _, s := range b {
+		seen[s]--
+	}
+	for _, n := range seen {
+		if n != 0 {
+			return false
+		}
+	}
+	return len(a) == len(b)
+}
@@ -0,0 +1,131 @@
+package syncer
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/monzo/slog"
+	"github.com/pkg/errors"
+	gsheets "google.golang.org/api/sheets/v4"
+
+	"github.com/arussellsaw/youneedaspreadsheet/domain"
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/sheets"
+)
+
+// DefaultArchiveAfter is how long an account has to be missing before it's
+// archived, so a connection which briefly doesn't list it isn't enough.
+const DefaultArchiveAfter = 2 * 24 * time.Hour
+
+// archivedSuffix is added to the title of a kept account's tab when it's
+// archived.
+const archivedSuffix = " (Archived)"
+
+// archiveUpdate applies what the user chose to do with each archived account
+// to its tab, and puts back the tabs of restored accounts, which have been
+// listed again since they were archived. Kept tabs are marked as archived in
+// the sync which archives them, after that they're left alone so they can be
+// renamed.
+func archiveUpdate(ss *gsheets.Spreadsheet, archived, restored []domain.AccountState, now time.Time) []*gsheets.Request {
+	var reqs []*gsheets.Request
+	for _, acc := range archived {
+		sheet := mappedSheet(ss, acc)
+		if sheet == nil {
+			continue
+		}
+		p := sheet.Properties
+		switch acc.Action() {
+		case domain.ArchiveDelete:
+			reqs = append(reqs, &gsheets.Request{
+				DeleteSheet: &gsheets.DeleteSheetRequest{SheetId: p.SheetId},
+			})
+		case domain.ArchiveHide:
+			if !p.Hidden {
+				reqs = append(reqs, setHidden(p.SheetId, true))
+			}
+		default:
+			if p.Hidden {
+				reqs = append(reqs, setHidden(p.SheetId, false))
+			}
+			if acc.Archived.Equal(now) && !strings.HasSuffix(p.Title, archivedSuffix) {
+				reqs = append(reqs, retitle(ss, p.SheetId, p.Title+archivedSuffix)...)
+			}
+		}
+	}
+	for _, acc := range restored {
+		sheet := mappedSheet(ss, acc)
+		if sheet == nil {
+			continue
+		}
+		p := sheet.Properties
+		if p.Hidden {
+			reqs = append(reqs, setHidden(p.SheetId, false))
+		}
+		if strings.HasSuffix(p.Title, archivedSuffix) {
+			reqs = append(reqs, retitle(ss, p.SheetId, strings.TrimSuffix(p.Title, archivedSuffix))...)
+		}
+	}
+	return reqs
+}
+
+// mappedSheet returns the tab the account is mapped to, if it still exists.
+func mappedSheet(ss *gsheets.Spreadsheet, acc domain.AccountState) *gsheets.Sheet {
+	if acc.SheetID == nil {
+		return nil
+	}
+	return findSheet(ss, withSheetID(*acc.SheetID))
+}
+
+func setHidden(id int64, hidden bool) *gsheets.Request {
+	return &gsheets.Request{
+		UpdateSheetProperties: &gsheets.UpdateSheetPropertiesRequest{
+			Fields: "hidden",
+			Properties: &gsheets.SheetProperties{
+				SheetId:         id,
+				Hidden:          hidden,
+				ForceSendFields: []string{"Hidden"},
+			},
+		},
+	}
+}
+
+// retitle renames a tab, unless another tab already has the title.
+func retitle(ss *gsheets.Spreadsheet, id int64, title string) []*gsheets.Request {
+	taken := findSheet(ss, func(p *gsheets.SheetProperties) bool {
+		return p.SheetId != id && strings.EqualFold(p.Title, title)
+	})
+	if taken != nil {
+		return nil
+	}
+	return []*gsheets.Request{{
+		UpdateSheetProperties: &gsheets.UpdateSheetPropertiesRequest{
+			Fields: "title",
+			Properties: &gsheets.SheetProperties{
+				SheetId: id,
+				Title:   title,
+			},
+		},
+	}}
+}
+
+// applyArchive updates the tabs of archived and restored accounts in the
+// spreadsheet d, and forgets the archived accounts the user chose to delete
+// once their tabs are gone.
+func (e *Engine) applyArchive(ctx context.Context, gs sheets.Spreadsheets, u *domain.User, d *domain.Destination, ss *gsheets.Spreadsheet, archived, restored []domain.AccountState, now time.Time) error {
+	if reqs := archiveUpdate(ss, archived, restored, now); len(reqs) > 0 {
+		err := gs.BatchUpdate(ctx, d.SheetID, reqs)
+		if err != nil {
+			return errors.Wrap(err, "updating archived tabs")
+		}
+	}
+	for _, acc := range archived {
+		if acc.Action() == domain.ArchiveDelete {
+			delete(u.Accounts, acc.ID)
+			err := domain.DeleteTransfers(ctx, u.ID, acc.ID)
+			if err != nil {
+				slog.Warn(ctx, "Error deleting transfers of %s: %s", acc.ID, err)
+			}
+		}
+	}
+	return nil
+}
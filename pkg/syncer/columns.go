@@ -0,0 +1,365 @@
+package syncer
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	gsheets "google.golang.org/api/sheets/v4"
+
+	"github.com/arussellsaw/youneedaspreadsheet/domain"
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/fx"
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/truelayer"
+)
+
+// record is a transaction as it's written to a sheet, with the category and
+// tags given to it by the user's rules, the other account if it's a transfer
+// between the user's accounts, and the rate converting it into the user's base
+// currency if they have one.
+type record struct {
+	*truelayer.Transaction
+	category string
+	tags     []string
+	transfer string
+	rate     *fx.Rate
+}
+
+// Column is a transaction field which can be written to a user's sheet.
+type Column struct {
+	Key   string
+	Title string
+	kind  int
+	value func(tx *record) *gsheets.ExtendedValue
+}
+
+// The kinds of value a column can hold, which decide how its cells are typed
+// and formatted.
+const (
+	kindText = iota
+	kindDate
+	kindMoney
+	// kindBaseMoney is money in the user's base currency.
+	kindBaseMoney
+	// kindDay is a date serial of a day, with no time.
+	kindDay
+)
+
+// Columns is every column a user can choose from.
+var Columns = []Column{
+	{Key: "id", Title: "Transaction ID", value: func(tx *record) *gsheets.ExtendedValue {
+		// never empty, as rows are matched up by it
+		id := tx.TransactionID
+		return &gsheets.ExtendedValue{StringValue: &id}
+	}},
+	{Key: "timestamp", Title: "Timestamp", kind: kindDate, value: func(tx *record) *gsheets.ExtendedValue {
+		return stringValue(tx.Timestamp)
+	}},
+	{Key: "amount", Title: "Amount", kind: kindMoney, value: func(tx *record) *gsheets.ExtendedValue {
+		return numberValue(tx.Amount)
+	}},
+	{Key: "currency", Title: "Currency", value: func(tx *record) *gsheets.ExtendedValue {
+		return stringValue(tx.Currency)
+	}},
+	{Key: "description", Title: "Description", value: func(tx *record) *gsheets.ExtendedValue {
+		return stringValue(tx.Description)
+	}},
+	{Key: "status", Title: "Status", value: func(tx *record) *gsheets.ExtendedValue {
+		if tx.Pending {
+			return stringValue(statusPending)
+		}
+		return stringValue(statusSettled)
+	}},
+	{Key: "merchant_name", Title: "Merchant", value: func(tx *record) *gsheets.ExtendedValue {
+		return stringValue(tx.MerchantName)
+	}},
+	{Key: "transaction_type", Title: "Type", value: func(tx *record) *gsheets.ExtendedValue {
+		return stringValue(tx.TransactionType)
+	}},
+	{Key: "category", Title: "Category", value: func(tx *record) *gsheets.ExtendedValue {
+		return stringValue(tx.category)
+	}},
+	{Key: "tags", Title: "Tags", value: func(tx *record) *gsheets.ExtendedValue {
+		return stringValue(strings.Join(tx.tags, ", "))
+	}},
+	{Key: "transfer", Title: "Transfer", value: func(tx *record) *gsheets.ExtendedValue {
+		return stringValue(tx.transfer)
+	}},
+	{Key: "transaction_category", Title: "Bank Category", value: func(tx *record) *gsheets.ExtendedValue {
+		return stringValue(tx.TransactionCategory)
+	}},
+	{Key: "classification", Title: "Classification", value: func(tx *record) *gsheets.ExtendedValue {
+		return stringValue(strings.Join(tx.TransactionClassification, ", "))
+	}},
+	{Key: "running_balance", Title: "Running Balance", kind: kindMoney, value: func(tx *record) *gsheets.ExtendedValue {
+		if tx.RunningBalance.Currency == "" {
+			return &gsheets.ExtendedValue{}
+		}
+		return numberValue(tx.RunningBalance.Amount)
+	}},
+	{Key: "converted_amount", Title: "Converted Amount", kind: kindBaseMoney, value: func(tx *record) *gsheets.ExtendedValue {
+		if tx.rate == nil {
+			return &gsheets.ExtendedValue{}
+		}
+		return numberValue(round(tx.rate.Convert(tx.Amount)))
+	}},
+	{Key: "fx_rate", Title: "FX Rate", value: func(tx *record) *gsheets.ExtendedValue {
+		if tx.rate == nil {
+			return &gsheets.ExtendedValue{}
+		}
+		return numberValue(tx.rate.Value)
+	}},
+	{Key: "fx_date", Title: "FX Rate Date", kind: kindDay, value: func(tx *record) *gsheets.ExtendedValue {
+		if tx.rate == nil {
+			return &gsheets.ExtendedValue{}
+		}
+		return numberValue(math.Floor(dateSerial(tx.rate.Date, time.UTC)))
+	}},
+	{Key: "provider_category", Title: "Provider Category", value: func(tx *record) *gsheets.ExtendedValue {
+		return stringValue(tx.Meta.ProviderTransactionCategory)
+	}},
+}
+
+// DefaultColumns is the layout for users who haven't chosen their own.
+var DefaultColumns = []string{"id", "timestamp", "amount", "currency", "description", "status", "transfer"}
+
+// convertedColumns are added to the default layout for users with a base
+// currency.
+var convertedColumns = []string{"converted_amount", "fx_rate", "fx_date"}
+
+// legacyColumns is the layout of sheets written before columns could be
+// chosen.
+var legacyColumns = []string{"id", "timestamp", "amount", "currency", "description", "status"}
+
+// layout is the columns written to a sheet, in order.
+type layout []Column
+
+// ParseColumns validates a list of column keys. The transaction ID has to be
+// the first column, as it's how existing rows are matched up, and the
+// timestamp is required to order rows.
+func ParseColumns(keys []string) ([]Column, error) {
+	var (
+		out  []Column
+		seen = make(map[string]bool)
+	)
+	for _, key := range keys {
+		col, ok := columnByKey(key)
+		if !ok {
+			return nil, fmt.Errorf("unknown column %q", key)
+		}
+		if seen[key] {
+			return nil, fmt.Errorf("column %q is repeated", key)
+		}
+		seen[key] = true
+		out = append(out, col)
+	}
+	if len(out) == 0 || out[0].Key != "id" {
+		return nil, fmt.Errorf("the first column must be id")
+	}
+	if !seen["timestamp"] {
+		return nil, fmt.Errorf("the timestamp column is required")
+	}
+	return out, nil
+}
+
+// UserColumns returns the keys of the columns written to the user's sheets.
+func UserColumns(u *domain.User) []string {
+	return userLayout(u).Keys()
+}
+
+// userLayout returns the columns the user has chosen, or the defaults.
+func userLayout(u *domain.User) layout {
+	if len(u.Columns) > 0 {
+		cols, err := ParseColumns(u.Columns)
+		if err == nil {
+			return cols
+		}
+	}
+	if u.BaseCurrency != "" {
+		return mustLayout(append(append([]string{}, DefaultColumns...), convertedColumns...))
+	}
+	return mustLayout(DefaultColumns)
+}
+
+// sheetLayout returns the columns an account's sheet was last written with.
+func sheetLayout(acc domain.AccountState) layout {
+	if len(acc.Columns) > 0 {
+		cols, err := ParseColumns(acc.Columns)
+		if err == nil {
+			return cols
+		}
+	}
+	return mustLayout(legacyColumns)
+}
+
+func mustLayout(keys []string) layout {
+	cols, err := ParseColumns(keys)
+	if err != nil {
+		panic(err)
+	}
+	return cols
+}
+
+func columnByKey(key string) (Column, bool) {
+	for _, col := range Columns {
+		if col.Key == key {
+			return col, true
+		}
+	}
+	return Column{}, false
+}
+
+func (l layout) Keys() []string {
+	var keys []string
+	for _, col := range l {
+		keys = append(keys, col.Key)
+	}
+	return keys
+}
+
+// index returns the position of the column in the layout, or -1.
+func (l layout) index(key string) int {
+	for i, col := range l {
+		if col.Key == key {
+			return i
+		}
+	}
+	return -1
+}
+
+func (l layout) equal(other layout) bool {
+	if len(l) != len(other) {
+		return false
+	}
+	for i := range l {
+		if l[i].Key != other[i].Key {
+			return false
+		}
+	}
+	return true
+}
+
+func (l layout) row(tx *record, f cellFormat) *gsheets.RowData {
+	rd := &gsheets.RowData{}
+	for _, col := range l {
+		rd.Values = append(rd.Values, f.cell(col, col.value(tx)))
+	}
+	return rd
+}
+
+// remap moves the cells of a row written with the from layout into this
+// layout. Columns which weren't in the old layout are left empty, and cells
+// written before they were typed are converted.
+func (l layout) remap(row *gsheets.RowData, from layout, f cellFormat) *gsheets.RowData {
+	out := &gsheets.RowData{}
+	for _, col := range l {
+		cell := &gsheets.CellData{}
+		if i := from.index(col.Key); i >= 0 && i < len(row.Values) && row.Values[i] != nil && row.Values[i].UserEnteredValue != nil {
+			cell = f.cell(col, row.Values[i].UserEnteredValue)
+		}
+		out.Values = append(out.Values, cell)
+	}
+	return out
+}
+
+// header returns the header row of the layout.
+func (l layout) header() *gsheets.RowData {
+	rd := &gsheets.RowData{}
+	for _, col := range l {
+		rd.Values = append(rd.Values, headerCell(col.Title))
+	}
+	return rd
+}
+
+// isHeader reports whether a row is a header row, which is recognised by the
+// title of the transaction ID column.
+func isHeader(row *gsheets.RowData) bool {
+	id, _ := columnByKey("id")
+	return rowValue(row, 0) == id.Title
+}
+
+// cellFormat types and formats the cells of an account's sheet. Timestamps
+// are written as date serials in loc, the spreadsheet's time zone, and money
+// is formatted in the account's currency, or the user's base currency.
+type cellFormat struct {
+	loc      *time.Location
+	currency string
+	base     string
+}
+
+func (f cellFormat) cell(col Column, v *gsheets.ExtendedValue) *gsheets.CellData {
+	switch col.kind {
+	case kindDate:
+		if v.StringValue != nil {
+			t, err := time.Parse(time.RFC3339, *v.StringValue)
+			if err != nil {
+				return &gsheets.CellData{UserEnteredValue: v}
+			}
+			v = numberValue(dateSerial(t, f.loc))
+		}
+		return &gsheets.CellData{
+			UserEnteredValue: v,
+			UserEnteredFormat: &gsheets.CellFormat{
+				NumberFormat: &gsheets.NumberFormat{Type: "DATE_TIME", Pattern: "yyyy-mm-dd hh:mm:ss"},
+			},
+		}
+	case kindMoney, kindBaseMoney:
+		if v.NumberValue == nil {
+			return &gsheets.CellData{UserEnteredValue: v}
+		}
+		currency := f.currency
+		if col.kind == kindBaseMoney {
+			currency = f.base
+		}
+		return &gsheets.CellData{
+			UserEnteredValue: v,
+			UserEnteredFormat: &gsheets.CellFormat{
+				NumberFormat: &gsheets.NumberFormat{Type: "CURRENCY", Pattern: currencyPattern(currency)},
+			},
+		}
+	case kindDay:
+		if v.NumberValue == nil {
+			return &gsheets.CellData{UserEnteredValue: v}
+		}
+		return dateCell(*v.NumberValue)
+	}
+	return &gsheets.CellData{UserEnteredValue: v}
+}
+
+// sheetsEpoch is day zero of Sheets' date serials.
+var sheetsEpoch = time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)
+
+// dateSerial returns t as a Sheets date serial, the number of days since the
+// epoch, for the wall clock time in loc, UTC if it's nil.
+func dateSerial(t time.Time, loc *time.Location) float64 {
+	if loc == nil {
+		loc = time.UTC
+	}
+	t = t.In(loc)
+	wall := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.UTC)
+	return wall.Sub(sheetsEpoch).Seconds() / (24 * 60 * 60)
+}
+
+var currencySymbols = map[string]string{
+	"GBP": "£",
+	"EUR": "€",
+	"USD": "$",
+}
+
+func currencyPattern(currency string) string {
+	if symbol, ok := currencySymbols[currency]; ok {
+		return "[$" + symbol + "]#,##0.00"
+	}
+	if currency == "" {
+		return "#,##0.00"
+	}
+	return "[$" + currency + "] #,##0.00"
+}
+
+func stringValue(s string) *gsheets.ExtendedValue {
+	return &gsheets.ExtendedValue{StringValue: strPtr(s)}
+}
+
+func numberValue(n float64) *gsheets.ExtendedValue {
+	return &gsheets.ExtendedValue{NumberValue: &n}
+}
@@ -0,0 +1,23 @@
+package syncer
+
+import (
+	"context"
+	"errors"
+)
+
+var ErrEngineNotFound = errors.New("sync engine not found in context")
+
+type engineKey string
+
+// FromContext returns the Engine in the context.
+func FromContext(ctx context.Context) (*Engine, error) {
+	e, ok := ctx.Value(engineKey("engine")).(*Engine)
+	if !ok {
+		return nil, ErrEngineNotFound
+	}
+	return e, nil
+}
+
+func WithEngine(ctx context.Context, e *Engine) context.Context {
+	return context.WithValue(ctx, engineKey("engine"), e)
+}
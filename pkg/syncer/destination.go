@@ -0,0 +1,120 @@
+package syncer
+
+import (
+	"context"
+	"time"
+
+	"github.com/monzo/slog"
+	gsheets "google.golang.org/api/sheets/v4"
+
+	"github.com/arussellsaw/youneedaspreadsheet/domain"
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/sheets"
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/truelayer"
+)
+
+// destination is one of the user's spreadsheets as of a sync, and what the
+// sync writes to it.
+type destination struct {
+	domain.Destination
+	ss           *gsheets.Spreadsheet
+	balanceSheet *gsheets.Sheet
+	// err is set if the spreadsheet couldn't be opened, nothing is
+	// written to it.
+	err error
+
+	// states are the accounts on its balance sheet.
+	states []domain.AccountState
+	// snapshots are the accounts whose balance was fetched by this sync.
+	snapshots []domain.AccountState
+	// synced are the accounts whose transactions were synced, and transfers
+	// the IDs of their transactions which are transfers, by account ID.
+	synced    []truelayer.AbstractAccount
+	transfers map[string][]string
+	// archived are its archived accounts, and restored those which have
+	// been listed again since they were archived.
+	archived, restored []domain.AccountState
+}
+
+type destinations []*destination
+
+// openDestinations gets every spreadsheet the user syncs into. Those which
+// can't be opened are skipped by the sync, an error is only returned if
+// none of them can be.
+func openDestinations(ctx context.Context, gs sheets.Spreadsheets, u *domain.User) (destinations, error) {
+	var (
+		dests   destinations
+		opened  int
+		openErr error
+	)
+	for _, d := range u.DestinationList() {
+		dest := &destination{Destination: d, transfers: make(map[string][]string)}
+		dest.ss, dest.err = gs.Get(ctx, d.SheetID)
+		if dest.err != nil {
+			slog.Error(ctx, "Error getting sheet %s: %s", d.SheetID, dest.err)
+			if openErr == nil {
+				openErr = dest.err
+			}
+		} else {
+			opened++
+		}
+		dests = append(dests, dest)
+	}
+	if opened == 0 {
+		return nil, openErr
+	}
+	return dests, nil
+}
+
+// of returns the spreadsheet the account is synced into.
+func (ds destinations) of(u *domain.User, acc domain.AccountState) *destination {
+	id := u.DestinationOf(acc)
+	for _, d := range ds {
+		if d.ID == id {
+			return d
+		}
+	}
+	return ds[0]
+}
+
+// runError records err in one of the run's errors, naming the spreadsheet
+// unless it's the main one, as a run can write to several.
+func (d *destination) runError(field *string, err error) {
+	msg := err.Error()
+	if d.ID != domain.MainDestination {
+		msg = d.Name + ": " + msg
+	}
+	if *field != "" {
+		msg = *field + "; " + msg
+	}
+	*field = msg
+}
+
+// writeDestination updates the archived tabs, balances, balance history and
+// monthly summary of one of the user's spreadsheets once its accounts have
+// been synced, converting balances into base if it's set.
+func (e *Engine) writeDestination(ctx context.Context, gs sheets.Spreadsheets, u *domain.User, d *destination, base string, now time.Time, res *domain.SyncRun) {
+	err := e.applyArchive(ctx, gs, u, &d.Destination, d.ss, d.archived, d.restored, now)
+	if err != nil {
+		slog.Error(ctx, "Error updating archived accounts %s: %s", u.ID, err)
+		d.runError(&res.ArchiveError, err)
+	}
+	if d.balanceSheet != nil {
+		err = gs.BatchUpdate(ctx, d.SheetID, []*gsheets.Request{balanceUpdate(d.states, d.balanceSheet, e.FX, base)})
+		if err != nil {
+			slog.Error(ctx, "Error updating balances %s : %s", u.ID, err)
+			d.runError(&res.BalancesError, err)
+		}
+	} else {
+		slog.Warn(ctx, "No balance sheet for user %s in %s", u.ID, d.SheetID)
+	}
+	err = e.syncBalanceHistory(ctx, gs, u, &d.Destination, d.ss, d.snapshots, now)
+	if err != nil {
+		slog.Error(ctx, "Error updating balance history %s: %s", u.ID, err)
+		d.runError(&res.HistoryError, err)
+	}
+	err = e.syncSummary(ctx, gs, u, &d.Destination, d.ss, d.synced, d.transfers)
+	if err != nil {
+		slog.Error(ctx, "Error updating monthly summary %s: %s", u.ID, err)
+		d.runError(&res.SummaryError, err)
+	}
+}
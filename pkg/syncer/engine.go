@@ -0,0 +1,776 @@
+package syncer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/monzo/slog"
+	gsheets "google.golang.org/api/sheets/v4"
+
+	"github.com/arussellsaw/youneedaspreadsheet/domain"
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/fx"
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/idgen"
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/logging"
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/sheets"
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/stripe"
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/truelayer"
+)
+
+// DefaultOverlap is how far before an account's watermark an incremental sync
+// starts fetching, so transactions which settle late aren't missed.
+const DefaultOverlap = 7 * 24 * time.Hour
+
+var (
+	ErrNoSheet        = errors.New("no sheet configured")
+	ErrNoSubscription = errors.New("no active subscription")
+)
+
+// Engine syncs a user's bank accounts into their spreadsheet, it's the single
+// entry point for HTTP, queue and CLI triggered syncs.
+type Engine struct {
+	Sheets          func(ctx context.Context, userID string) (sheets.Spreadsheets, error)
+	Truelayer       func(ctx context.Context, userID string) ([]*truelayer.Client, []truelayer.FailedConnection, error)
+	HasSubscription func(ctx context.Context, u *domain.User) (bool, error)
+	// Overlap is how far before the watermark incremental syncs fetch from,
+	// DefaultOverlap if unset.
+	Overlap time.Duration
+	// TransferWindow is how far apart the sides of a transfer between a
+	// user's accounts can be, DefaultTransferWindow if unset.
+	TransferWindow time.Duration
+	// FX converts amounts into users' base currencies. If it's nil nothing
+	// is converted, rather than guessing at rates.
+	FX fx.Source
+	// ArchiveAfter is how long an account has to be missing before it's
+	// archived, DefaultArchiveAfter if unset.
+	ArchiveAfter time.Duration
+}
+
+// NewEngine returns an Engine using the real Google Sheets, TrueLayer and
+// Stripe clients.
+func NewEngine() *Engine {
+	return &Engine{
+		Sheets: func(ctx context.Context, userID string) (sheets.Spreadsheets, error) {
+			return sheets.NewClient(ctx, userID)
+		},
+		Truelayer:       truelayer.GetClients,
+		HasSubscription: stripe.HasSubscription,
+		Overlap:         DefaultOverlap,
+		TransferWindow:  DefaultTransferWindow,
+		ArchiveAfter:    DefaultArchiveAfter,
+	}
+}
+
+// baseCurrency returns the currency the user's amounts are converted into,
+// empty if they haven't chosen one or the engine has no rates to do it with.
+func (e *Engine) baseCurrency(ctx context.Context, u *domain.User) string {
+	if u.BaseCurrency != "" && e.FX == nil {
+		slog.Warn(ctx, "No exchange rates, not converting %s into %s", u.ID, u.BaseCurrency)
+		return ""
+	}
+	return u.BaseCurrency
+}
+
+type Options struct {
+	// Trigger is what started the sync, one of the domain.Trigger constants.
+	Trigger string
+	// Backfill fetches every account's full transaction history rather than
+	// only what's changed since the last sync.
+	Backfill bool
+	// DryRun reads from TrueLayer and the sheet as usual, but rather than
+	// writing anything records the diff it would make against each account.
+	// Nothing is saved, including the run itself.
+	DryRun bool
+	// ReapplyRules applies the user's categorisation rules to every row
+	// already in their sheets, not just new transactions. It implies
+	// Backfill.
+	ReapplyRules bool
+}
+
+// Sync fetches every account for the user from TrueLayer and writes the
+// transactions and balances to the spreadsheet each account is routed to.
+// Each connection, account and spreadsheet is synced independently, failures
+// are recorded against the account on the user and in the run rather than
+// stopping the sync. An error is only returned if nothing could be synced at
+// all. Every attempt is saved as a SyncRun.
+func (e *Engine) Sync(ctx context.Context, u *domain.User, opts Options) (*domain.SyncRun, error) {
+	ctx = logging.WithParams(ctx, map[string]string{"user_id": u.ID})
+	run := &domain.SyncRun{
+		ID:      idgen.New("run"),
+		UserID:  u.ID,
+		Trigger: opts.Trigger,
+		DryRun:  opts.DryRun,
+		Started: time.Now(),
+	}
+	if run.Trigger == "" {
+		run.Trigger = domain.TriggerManual
+	}
+	if opts.DryRun {
+		// the sync records state on the user as it goes, leave the
+		// caller's copy alone.
+		u = copyUser(u)
+	}
+	err := e.sync(ctx, u, opts, run)
+	run.Finished = time.Now()
+	if err != nil {
+		run.Error = err.Error()
+	}
+	if opts.DryRun {
+		return run, err
+	}
+	if serr := domain.SaveSyncRun(ctx, run); serr != nil {
+		slog.Error(ctx, "Error saving sync run %s: %s", run.ID, serr)
+	}
+	return run, err
+}
+
+func (e *Engine) sync(ctx context.Context, u *domain.User, opts Options, res *domain.SyncRun) error {
+	slog.Info(ctx, "sync user: %s", u.ID)
+
+	if u.SheetID == "" {
+		slog.Error(ctx, "No sheet ID for user %s", u.ID)
+		return ErrNoSheet
+	}
+	ok, err := e.HasSubscription(ctx, u)
+	if err != nil || !ok {
+		slog.Error(ctx, "error checking for subscription: %s", err)
+		return ErrNoSubscription
+	}
+	tls, failed, err := e.Truelayer(ctx, u.ID)
+	if err != nil {
+		slog.Error(ctx, "UNABLE TO SYNC USER, NO TRUELAYER CLIENTS %s: %s", u.ID, err)
+		return err
+	}
+	gs, err := e.Sheets(ctx, u.ID)
+	if err != nil {
+		slog.Error(ctx, "Error getting sheets client: %s", err)
+		return err
+	}
+	dests, err := openDestinations(ctx, gs, u)
+	if err != nil {
+		return err
+	}
+	if u.Accounts == nil {
+		u.Accounts = make(map[string]domain.AccountState)
+	}
+	if u.Connections == nil {
+		u.Connections = make(map[string]domain.ConnectionState)
+	}
+
+	now := time.Now()
+	overlap := e.Overlap
+	if overlap == 0 {
+		overlap = DefaultOverlap
+	}
+	window := e.TransferWindow
+	if window == 0 {
+		window = DefaultTransferWindow
+	}
+	archiveAfter := e.ArchiveAfter
+	if archiveAfter == 0 {
+		archiveAfter = DefaultArchiveAfter
+	}
+	base := e.baseCurrency(ctx, u)
+	var (
+		accs  []truelayer.AbstractAccount
+		conns = make(map[string]bool)
+		// connections which may not have listed every account
+		incomplete = make(map[string]bool)
+	)
+	// connections whose tokens couldn't be loaded are still the user's, so
+	// their accounts are kept with the error rather than archived.
+	for _, f := range failed {
+		conns[f.ConnectionID] = true
+		conn := u.Connections[f.ConnectionID]
+		conn.ID = f.ConnectionID
+		failConnection(u, res, conn, fmt.Errorf("the bank connection couldn't be refreshed, it may need to be renewed: %w", f.Err), now)
+	}
+	for _, tl := range tls {
+		conns[tl.ConnectionID] = true
+		conn := u.Connections[tl.ConnectionID]
+		conn.ID = tl.ConnectionID
+		connRes := domain.ConnectionRun{ConnectionID: tl.ConnectionID}
+
+		m, err := tl.Metadata(ctx)
+		if err != nil {
+			slog.Warn(ctx, "Error getting metadata for connection %s: %s", tl.ConnectionID, err)
+		} else {
+			conn.Provider = m.Provider.DisplayName
+			conn.ProviderID = m.Provider.ProviderID
+			conn.ConsentStatus = m.ConsentStatus
+			conn.ConsentExpiresAt = m.ConsentExpiresAt
+		}
+
+		as, err := tl.Accounts(ctx)
+		if err != nil {
+			slog.Error(ctx, "Error getting accounts for connection %s: %s", tl.ConnectionID, err)
+			if truelayer.IsUnauthorized(err) {
+				err = fmt.Errorf("the bank connection needs to be renewed: %w", err)
+			}
+			failConnection(u, res, conn, err, now)
+			continue
+		}
+		for _, a := range as {
+			a := a
+			accs = append(accs, a)
+			conn.Provider = a.ProviderName()
+		}
+		connRes.Accounts += len(as)
+		cs, err := tl.Cards(ctx)
+		if err != nil {
+			// not every provider supports cards, so this isn't a failure
+			slog.Error(ctx, "Error getting cards: %s", err)
+			incomplete[conn.ID] = !truelayer.IsNotImplemented(err)
+		}
+		for _, c := range cs {
+			c := c
+			accs = append(accs, c)
+			conn.Provider = c.ProviderName()
+		}
+		connRes.Accounts += len(cs)
+		conn.LastSynced, conn.LastError, conn.LastErrorAt = now, "", time.Time{}
+		u.Connections[conn.ID] = conn
+		res.Connections = append(res.Connections, connRes)
+	}
+
+	var (
+		cols       = userLayout(u)
+		rs         = userRules(ctx, u)
+		fetches    = make([]fetched, len(accs))
+		fetchedTxs []AccountTransactions
+	)
+	// every account's transactions are fetched before any are written, so
+	// transfers between them can be paired up.
+	for i, acc := range accs {
+		state := u.Accounts[acc.ID()]
+		// a new account, or one which has never synced successfully, gets
+		// its full history. So does one whose columns or base currency have
+		// changed, to fill them in on the rows already written, or whose
+		// rules are being re-applied, so they match on every field they can.
+		// One whose tab has gone, deleted by the user or in a spreadsheet
+		// it's been moved to, gets it too, as there's nothing to add to.
+		var since time.Time
+		if !opts.Backfill && !opts.ReapplyRules && !state.Watermark.IsZero() && sheetLayout(state).equal(cols) && state.BaseCurrency == base && hasSheet(u, dests.of(u, state), acc, state) {
+			since = state.Watermark.Add(-overlap)
+		}
+		fetches[i] = fetchTransactions(ctx, acc, since, cols.index("status") >= 0)
+		if fetches[i].err == nil {
+			fetchedTxs = append(fetchedTxs, AccountTransactions{AccountID: acc.ID(), Name: acc.Name(), Transactions: fetches[i].txs})
+		}
+	}
+	// transfers are paired across every account, whichever spreadsheets
+	// they're synced into.
+	transfers := transferLabels(FindTransfers(fetchedTxs, window), accs)
+	for _, d := range dests {
+		if d.err != nil {
+			continue
+		}
+		// found first so it's never mistaken for an account's tab
+		d.ss, d.balanceSheet, err = e.balanceSheet(ctx, gs, &d.Destination, d.ss, opts.DryRun)
+		if err != nil {
+			slog.Error(ctx, "Error adding balance sheet for %s: %s", u.ID, err)
+			d.runError(&res.BalancesError, err)
+		}
+	}
+
+	for i, acc := range accs {
+		state := u.Accounts[acc.ID()]
+		state.ID = acc.ID()
+		state.Name = acc.Name()
+		state.Provider = acc.ProviderName()
+		state.ConnectionID = acc.ConnectionID()
+		d := dests.of(u, state)
+		if state.IsArchived() {
+			d.restored = append(d.restored, state)
+		}
+		state.MissingSince, state.Archived, state.ArchiveAction = time.Time{}, time.Time{}, ""
+
+		prev := sheetLayout(state)
+		if base != "" {
+			if _, err := e.FX.Rate(acc.CurrencyCode(), base, now); err != nil {
+				slog.Warn(ctx, "Can't convert %s into %s for %s: %s", acc.CurrencyCode(), base, acc.ID(), err)
+			}
+		}
+		var accRes domain.AccountRun
+		w := rowWriter{
+			from:      prev,
+			to:        cols,
+			format:    cellFormat{loc: sheetLocation(ctx, d.ss), currency: acc.CurrencyCode(), base: base},
+			rules:     rs,
+			accountID: acc.ID(),
+			// rows too old to be fetched again get categories from
+			// what's in their columns.
+			reapply:   opts.ReapplyRules || !prev.equal(cols),
+			transfers: transfers[acc.ID()],
+			rates:     e.FX,
+		}
+		f := fetches[i]
+		if d.err != nil && f.err == nil {
+			f.err = fmt.Errorf("opening the %s spreadsheet: %w", d.Name, d.err)
+		}
+		d.ss, accRes = e.syncAccount(ctx, gs, &d.Destination, d.ss, u, acc, &state, f, w, opts.DryRun)
+		res.Accounts = append(res.Accounts, accRes)
+		if accRes.Error == "" {
+			state.Watermark = now
+			state.Columns = cols.Keys()
+			state.BaseCurrency = base
+			d.synced = append(d.synced, acc)
+			if !opts.DryRun {
+				d.transfers[acc.ID()] = recordTransfers(ctx, u.ID, acc.ID(), w.transfers)
+			}
+		}
+
+		fresh := false
+		b, err := acc.Balance(ctx)
+		if err != nil {
+			slog.Error(ctx, "error getting balance for %s: %s", acc.ID(), err)
+			if accRes.Error == "" {
+				accRes.Error = err.Error()
+				res.Accounts[len(res.Accounts)-1] = accRes
+			}
+		} else {
+			fresh = true
+			state.LastBalance = &domain.Balance{
+				Currency:  b.Currency,
+				Available: b.Available,
+				Current:   b.Current,
+				Overdraft: b.Overdraft,
+				Updated:   b.UpdateTimestamp,
+			}
+		}
+		if accRes.Error != "" {
+			state.LastError, state.LastErrorAt = accRes.Error, now
+		} else {
+			state.LastSynced, state.LastError, state.LastErrorAt = now, "", time.Time{}
+		}
+		u.Accounts[state.ID] = state
+		d.states = append(d.states, state)
+		if fresh {
+			d.snapshots = append(d.snapshots, state)
+		}
+	}
+	// accounts which weren't listed, on a connection which listed every
+	// account or which is gone, are archived once they've been missing for
+	// a while, in case it's a blip. Those on connections which failed keep
+	// their last known balance.
+	listed := make(map[string]bool)
+	for _, acc := range accs {
+		listed[acc.ID()] = true
+	}
+	for _, acc := range u.AccountList() {
+		if listed[acc.ID] {
+			continue
+		}
+		d := dests.of(u, acc)
+		if conns[acc.ConnectionID] && (u.Connections[acc.ConnectionID].LastError != "" || incomplete[acc.ConnectionID]) {
+			d.states = append(d.states, acc)
+			continue
+		}
+		if acc.MissingSince.IsZero() {
+			acc.MissingSince = now
+		}
+		if !acc.IsArchived() && now.Sub(acc.MissingSince) >= archiveAfter {
+			slog.Info(ctx, "Archiving account %s, missing since %s", acc.ID, acc.MissingSince)
+			acc.Archived = now
+		}
+		u.Accounts[acc.ID] = acc
+		if acc.IsArchived() {
+			d.archived = append(d.archived, acc)
+		}
+		if acc.Action() == domain.ArchiveKeep {
+			d.states = append(d.states, acc)
+		}
+	}
+
+	synced := 0
+	for _, accRes := range res.Accounts {
+		res.RowsAdded += accRes.RowsAdded
+		res.RowsUpdated += accRes.RowsUpdated
+		res.RowsRemoved += accRes.RowsRemoved
+		if accRes.Error == "" {
+			synced++
+		}
+	}
+	if opts.DryRun {
+		return nil
+	}
+
+	for _, d := range dests {
+		if d.err != nil {
+			continue
+		}
+		e.writeDestination(ctx, gs, u, d, base, now, res)
+		u.SetDestination(d.Destination)
+	}
+
+	// LastSync is when something was last written, not just attempted.
+	if synced > 0 {
+		u.LastSync = now
+	}
+	// only what the sync recorded is saved, the user may have changed their
+	// settings while it ran.
+	latest, err := domain.ModifyUser(ctx, u.ID, func(latest *domain.User) error {
+		latest.MergeSync(u)
+		return nil
+	})
+	if err != nil {
+		slog.Error(ctx, "Error updating user after sync: %s", err)
+	} else {
+		*u = *latest
+	}
+	if synced == 0 && len(res.Accounts) > 0 {
+		return errors.New("every account failed to sync")
+	}
+	return nil
+}
+
+// fetched is what was fetched from an account for a sync.
+type fetched struct {
+	// since is when the transactions were fetched from, zero for the
+	// account's full history.
+	since          time.Time
+	txs            []truelayer.Transaction
+	pendingFetched bool
+	err            error
+}
+
+// failConnection records err on a connection that couldn't be synced. The
+// accounts we already know about on it are kept around with the error so it's
+// visible.
+func failConnection(u *domain.User, res *domain.SyncRun, conn domain.ConnectionState, err error, now time.Time) {
+	conn.LastError, conn.LastErrorAt = err.Error(), now
+	u.Connections[conn.ID] = conn
+	res.Connections = append(res.Connections, domain.ConnectionRun{
+		ConnectionID: conn.ID,
+		Error:        err.Error(),
+	})
+	for _, acc := range u.AccountList() {
+		if acc.ConnectionID != conn.ID {
+			continue
+		}
+		acc.LastError, acc.LastErrorAt = err.Error(), now
+		u.Accounts[acc.ID] = acc
+		res.Accounts = append(res.Accounts, domain.AccountRun{
+			AccountID: acc.ID,
+			Name:      acc.Name,
+			Provider:  acc.Provider,
+			Error:     err.Error(),
+		})
+	}
+}
+
+// fetchTransactions fetches an account's transactions since the given time,
+// and its pending transactions if withPending is set, ordered by time.
+func fetchTransactions(ctx context.Context, acc truelayer.AbstractAccount, since time.Time, withPending bool) fetched {
+	f := fetched{since: since}
+	if since.IsZero() {
+		f.txs, f.err = acc.Transactions(ctx, true)
+	} else {
+		f.txs, f.err = acc.TransactionsSince(ctx, since)
+	}
+	if f.err != nil {
+		slog.Error(ctx, "Error getting transactions for %s: %s", acc.ID(), f.err)
+		return f
+	}
+	// not every provider supports pending transactions, so carry on
+	// without them and leave any pending rows we've already written. They
+	// can't be told apart from settled rows without a status column, so
+	// they're left out altogether.
+	var pending []truelayer.Transaction
+	if withPending {
+		var err error
+		pending, err = acc.PendingTransactions(ctx)
+		if err != nil {
+			slog.Warn(ctx, "Error getting pending transactions for %s: %s", acc.ID(), err)
+		}
+		f.pendingFetched = err == nil
+	}
+	settled := make(map[string]bool)
+	for _, tx := range f.txs {
+		settled[tx.TransactionID] = true
+	}
+	for _, tx := range pending {
+		if !settled[tx.TransactionID] {
+			f.txs = append(f.txs, tx)
+		}
+	}
+	sort.Slice(f.txs, func(i, j int) bool {
+		return f.txs[i].Timestamp < f.txs[j].Timestamp
+	})
+	return f
+}
+
+// syncAccount writes the transactions fetched from an account to its own
+// sheet in the spreadsheet d, adding the sheet if it doesn't exist yet and
+// mapping the account's state to it. The rows are built by w, which rewrites
+// the rows already in the sheet in the user's current layout. It returns the
+// spreadsheet as of the end of the sync so later accounts can find any sheet
+// it added. On a dry run nothing is written, and the diff is recorded on the
+// result instead.
+func (e *Engine) syncAccount(ctx context.Context, gs sheets.Spreadsheets, d *domain.Destination, userSheet *gsheets.Spreadsheet, u *domain.User, acc truelayer.AbstractAccount, state *domain.AccountState, f fetched, w rowWriter, dryRun bool) (*gsheets.Spreadsheet, domain.AccountRun) {
+	accRes := domain.AccountRun{
+		AccountID: acc.ID(),
+		Name:      acc.Name(),
+		Provider:  acc.ProviderName(),
+		Backfill:  f.since.IsZero(),
+	}
+	if f.err != nil {
+		accRes.Error = f.err.Error()
+		return userSheet, accRes
+	}
+	accSheet := accountSheet(userSheet, u, d, acc, *state)
+	if accSheet == nil && dryRun {
+		id, title := newAccountSheet(userSheet, acc, d.TabPrefix)
+		accSheet = &gsheets.Sheet{
+			Properties: &gsheets.SheetProperties{
+				SheetId: id,
+				Title:   title,
+			},
+			Data: []*gsheets.GridData{{}},
+		}
+	}
+	if accSheet == nil {
+		columns := int64(7)
+		if int64(len(w.to)) > columns {
+			columns = int64(len(w.to))
+		}
+		id, title := newAccountSheet(userSheet, acc, d.TabPrefix)
+		add := []*gsheets.Request{
+			{
+				AddSheet: &gsheets.AddSheetRequest{
+					Properties: &gsheets.SheetProperties{
+						SheetId: id,
+						Title:   title,
+						GridProperties: &gsheets.GridProperties{
+							ColumnCount:    columns,
+							RowCount:       5,
+							FrozenRowCount: 1,
+						},
+					},
+				},
+			},
+		}
+		err := gs.BatchUpdate(ctx, d.SheetID, add)
+		if err != nil {
+			slog.Error(ctx, "Error adding new sheet for %s: %s", acc.ID(), err)
+			accRes.Error = err.Error()
+			return userSheet, accRes
+		}
+		userSheet = withAdded(userSheet, add)
+		accSheet = findSheet(userSheet, withSheetID(id))
+	}
+	if !dryRun {
+		id := accSheet.Properties.SheetId
+		state.SheetID = &id
+	}
+	update, rows, diff := buildUpdate(f.txs, f.pendingFetched, accSheet, w)
+	if dryRun {
+		accRes.RowsAdded, accRes.RowsUpdated, accRes.RowsRemoved = len(diff.Append), len(diff.Rewrite), len(diff.Remove)
+		accRes.Diff = &diff
+		return userSheet, accRes
+	}
+	if update == nil {
+		return userSheet, accRes
+	}
+	err := gs.BatchUpdate(ctx, d.SheetID, update)
+	if err != nil {
+		slog.Error(ctx, "Error updating sheet for %s: %s", acc.ID(), err)
+		accRes.Error = err.Error()
+		return userSheet, accRes
+	}
+	accRes.RowsAdded, accRes.RowsUpdated, accRes.RowsRemoved = len(diff.Append), len(diff.Rewrite), len(diff.Remove)
+	// another account can share this sheet, and the summary is worked out
+	// from it, so don't leave them working from the rows we just replaced.
+	setRows(accSheet, rows, len(w.to))
+	return userSheet, accRes
+}
+
+func copyUser(u *domain.User) *domain.User {
+	dup := *u
+	dup.Accounts = make(map[string]domain.AccountState, len(u.Accounts))
+	for id, acc := range u.Accounts {
+		dup.Accounts[id] = acc
+	}
+	dup.Connections = make(map[string]domain.ConnectionState, len(u.Connections))
+	for id, conn := range u.Connections {
+		dup.Connections[id] = conn
+	}
+	dup.Destinations = append([]domain.Destination(nil), u.Destinations...)
+	return &dup
+}
+
+// accountSheet returns the tab the account is mapped to, nil if it isn't
+// mapped to one or the tab has been deleted. Accounts synced before tabs were
+// mapped are matched up with their tab by its ID or title, as they used to
+// be, skipping the tabs which belong to something else. A spreadsheet the
+// user connected, or added, has none of those tabs.
+func accountSheet(ss *gsheets.Spreadsheet, u *domain.User, d *domain.Destination, acc truelayer.AbstractAccount, state domain.AccountState) *gsheets.Sheet {
+	if state.SheetID != nil {
+		return findSheet(ss, withSheetID(*state.SheetID))
+	}
+	if d.Connected || d.ID != domain.MainDestination {
+		return nil
+	}
+	claimed := claimedSheets(u, d, acc.ID())
+	var accSheet *gsheets.Sheet
+	for _, sheet := range ss.Sheets {
+		if claimed[sheet.Properties.SheetId] {
+			continue
+		}
+		if sheet.Properties.SheetId == sheetID(acc.ID()) {
+			accSheet = sheet
+		}
+		if strings.HasPrefix(sheet.Properties.Title, acc.Name()) {
+			if len(sheet.Properties.Title) > len(acc.Name()) && !strings.HasSuffix(sheet.Properties.Title, acc.ID()) {
+				continue
+			}
+			accSheet = sheet
+		}
+	}
+	return accSheet
+}
+
+// claimedSheets returns the IDs of the tabs in the spreadsheet d mapped to
+// the balances or to any account but the given one.
+func claimedSheets(u *domain.User, d *domain.Destination, accountID string) map[int64]bool {
+	claimed := make(map[int64]bool)
+	if d.BalanceSheetID != nil {
+		claimed[*d.BalanceSheetID] = true
+	}
+	for _, acc := range u.Accounts {
+		if acc.ID != accountID && acc.SheetID != nil && u.DestinationOf(acc) == d.ID {
+			claimed[*acc.SheetID] = true
+		}
+	}
+	return claimed
+}
+
+// newAccountSheet returns the ID and title of a new tab for an account. The
+// title is the prefix and the account's name, with its provider or then its
+// ID added if another tab already has it.
+func newAccountSheet(ss *gsheets.Spreadsheet, acc truelayer.AbstractAccount, prefix string) (int64, string) {
+	id := sheetID(acc.ID())
+	for id == 0 || findSheet(ss, withSheetID(id)) != nil {
+		id++
+	}
+	for _, title := range []string{
+		prefix + acc.Name(),
+		prefix + acc.Name() + " (" + acc.ProviderName() + ")",
+	} {
+		taken := findSheet(ss, func(p *gsheets.SheetProperties) bool {
+			return strings.EqualFold(p.Title, title)
+		})
+		if taken == nil {
+			return id, title
+		}
+	}
+	return id, freeTitle(ss, prefix+acc.Name()+" "+acc.ID())
+}
+
+// balancesSheet is the title of the tab balances are written to in a
+// spreadsheet the user connected or added.
+const balancesSheet = "Balances"
+
+// balanceSheet returns the tab balances are written to in the spreadsheet d,
+// mapping d to it the first time it's found. A spreadsheet created for the
+// user has them in its first tab, Sheet1, and one the user connected or
+// added gets a tab added for them, unless it's a dry run.
+func (e *Engine) balanceSheet(ctx context.Context, gs sheets.Spreadsheets, d *domain.Destination, ss *gsheets.Spreadsheet, dryRun bool) (*gsheets.Spreadsheet, *gsheets.Sheet, error) {
+	if d.BalanceSheetID != nil {
+		return ss, findSheet(ss, withSheetID(*d.BalanceSheetID)), nil
+	}
+	var sheet *gsheets.Sheet
+	if d.Connected || d.ID != domain.MainDestination {
+		if dryRun {
+			return ss, nil, nil
+		}
+		if ownSheet(ss, balancesSheet) == nil {
+			add := []*gsheets.Request{{
+				AddSheet: &gsheets.AddSheetRequest{
+					Properties: &gsheets.SheetProperties{
+						SheetId: sheetID(balancesSheet),
+						Title:   freeTitle(ss, d.TabPrefix+balancesSheet),
+					},
+				},
+			}}
+			err := gs.BatchUpdate(ctx, d.SheetID, add)
+			if err != nil {
+				return ss, nil, fmt.Errorf("adding balances sheet: %w", err)
+			}
+			ss = withAdded(ss, add)
+		}
+		sheet = ownSheet(ss, balancesSheet)
+	} else {
+		sheet = findSheet(ss, func(p *gsheets.SheetProperties) bool {
+			return p.Title == "Sheet1"
+		})
+	}
+	if sheet != nil {
+		id := sheet.Properties.SheetId
+		d.BalanceSheetID = &id
+	}
+	return ss, sheet, nil
+}
+
+// withAdded returns the spreadsheet with the empty tabs added by the AddSheet
+// requests, which have been applied, so it needn't be read again.
+func withAdded(ss *gsheets.Spreadsheet, reqs []*gsheets.Request) *gsheets.Spreadsheet {
+	dup := *ss
+	dup.Sheets = append([]*gsheets.Sheet(nil), ss.Sheets...)
+	for _, req := range reqs {
+		if req.AddSheet == nil {
+			continue
+		}
+		props := *req.AddSheet.Properties
+		if props.GridProperties != nil {
+			grid := *props.GridProperties
+			props.GridProperties = &grid
+		}
+		dup.Sheets = append(dup.Sheets, &gsheets.Sheet{
+			Properties: &props,
+			Data:       []*gsheets.GridData{{}},
+		})
+	}
+	return &dup
+}
+
+// hasSheet returns true if the account's tab is in the spreadsheet d, or d
+// couldn't be opened to tell.
+func hasSheet(u *domain.User, d *destination, acc truelayer.AbstractAccount, state domain.AccountState) bool {
+	if d.err != nil || d.ss == nil {
+		return true
+	}
+	return accountSheet(d.ss, u, &d.Destination, acc, state) != nil
+}
+
+func withSheetID(id int64) func(*gsheets.SheetProperties) bool {
+	return func(p *gsheets.SheetProperties) bool {
+		return p.SheetId == id
+	}
+}
+
+func findSheet(ss *gsheets.Spreadsheet, match func(*gsheets.SheetProperties) bool) *gsheets.Sheet {
+	for _, sheet := range ss.Sheets {
+		if match(sheet.Properties) {
+			return sheet
+		}
+	}
+	return nil
+}
+
+// sheetLocation returns the spreadsheet's time zone, which timestamps are
+// written in, falling back to UTC.
+func sheetLocation(ctx context.Context, ss *gsheets.Spreadsheet) *time.Location {
+	if ss == nil || ss.Properties == nil || ss.Properties.TimeZone == "" {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(ss.Properties.TimeZone)
+	if err != nil {
+		slog.Warn(ctx, "Unknown spreadsheet time zone %s: %s", ss.Properties.TimeZone, err)
+		return time.UTC
+	}
+	return loc
+}
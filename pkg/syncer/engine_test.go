@@ -0,0 +1,865 @@
+package syncer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	gsheets "google.golang.org/api/sheets/v4"
+
+	"github.com/arussellsaw/youneedaspreadsheet/domain"
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/fx"
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/idgen"
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/sheets"
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/sheets/sheetstest"
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/store"
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/truelayer"
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/truelayer/truelayertest"
+)
+
+// testEngine is an Engine syncing a user with the demo connection into a fake
+// spreadsheet.
+type testEngine struct {
+	*Engine
+	ctx  context.Context
+	gs   *sheetstest.Fake
+	tl   *truelayertest.Server
+	conn *truelayertest.Connection
+	u    *domain.User
+}
+
+func newTestEngine(t *testing.T) *testEngine {
+	rps := truelayer.RequestsPerSecond
+	t.Cleanup(func() { truelayer.RequestsPerSecond = rps })
+	truelayer.RequestsPerSecond = 1000
+	idgen.Init(context.Background())
+
+	te := &testEngine{
+		ctx:  store.WithStore(context.Background(), store.NewMemory()),
+		gs:   sheetstest.NewFake(),
+		tl:   truelayertest.NewServer(),
+		conn: truelayertest.DemoConnection(1, time.Now()),
+	}
+	t.Cleanup(te.tl.Close)
+	te.tl.AddConnection("tok_demo", te.conn)
+
+	id, err := te.gs.Create(te.ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	te.u, err = domain.NewUserWithID(te.ctx, "usr_test", "test@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	te.u.SheetID = id
+	err = domain.UpdateUser(te.ctx, te.u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	te.Engine = &Engine{
+		Sheets: func(ctx context.Context, userID string) (sheets.Spreadsheets, error) {
+			return te.gs, nil
+		},
+		Truelayer: func(ctx context.Context, userID string) ([]*truelayer.Client, []truelayer.FailedConnection, error) {
+			return []*truelayer.Client{te.tl.Client(userID, "tok_demo")}, nil, nil
+		},
+		HasSubscription: func(ctx context.Context, u *domain.User) (bool, error) {
+			return true, nil
+		},
+	}
+	return te
+}
+
+func (te *testEngine) sync(t *testing.T, opts Options) *domain.SyncRun {
+	t.Helper()
+	run, err := te.Sync(te.ctx, te.u, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, acc := range run.Accounts {
+		if acc.Error != "" {
+			t.Fatalf("syncing %s: %s", acc.AccountID, acc.Error)
+		}
+	}
+	return run
+}
+
+// rows returns the rows of a tab below its header, keyed by transaction ID and
+// then by column title. It fails if a transaction is in the tab twice.
+func (te *testEngine) rows(t *testing.T, title string) map[string]map[string]string {
+	t.Helper()
+	grid := te.gs.Grid(te.u.SheetID, title)
+	if len(grid) == 0 {
+		t.Fatalf("no %s tab in %v", title, te.gs.Titles(te.u.SheetID))
+	}
+	header := grid[0]
+	out := make(map[string]map[string]string)
+	for _, row := range grid[1:] {
+		values := make(map[string]string)
+		for i, v := range row {
+			values[header[i]] = v
+		}
+		id := values["Transaction ID"]
+		if _, ok := out[id]; ok {
+			t.Errorf("transaction %s is in %s twice", id, title)
+		}
+		out[id] = values
+	}
+	return out
+}
+
+func (te *testEngine) accountRun(t *testing.T, run *domain.SyncRun, accountID string) domain.AccountRun {
+	t.Helper()
+	for _, acc := range run.Accounts {
+		if acc.AccountID == accountID {
+			return acc
+		}
+	}
+	t.Fatalf("%s wasn't synced", accountID)
+	return domain.AccountRun{}
+}
+
+func TestSyncBackfill(t *testing.T) {
+	te := newTestEngine(t)
+	run := te.sync(t, Options{})
+
+	for _, tab := range []struct {
+		title, accountID string
+	}{
+		{"Current Account", "acc-1"},
+		{"Credit Card", "card-1"},
+	} {
+		txs := te.conn.Transactions[tab.accountID]
+		pending := te.conn.Pending[tab.accountID]
+		accRun := te.accountRun(t, run, tab.accountID)
+		if !accRun.Backfill {
+			t.Errorf("%s: first sync wasn't a backfill", tab.accountID)
+		}
+		if accRun.RowsAdded != len(txs)+len(pending) {
+			t.Errorf("%s: added %d rows, want %d", tab.accountID, accRun.RowsAdded, len(txs)+len(pending))
+		}
+		rows := te.rows(t, tab.title)
+		if len(rows) != len(txs)+len(pending) {
+			t.Errorf("%s: %d rows, want %d", tab.title, len(rows), len(txs)+len(pending))
+		}
+		for _, tx := range txs {
+			if rows[tx.TransactionID]["Status"] != statusSettled {
+				t.Errorf("%s: %s is %q, want settled", tab.title, tx.TransactionID, rows[tx.TransactionID]["Status"])
+			}
+		}
+		for _, tx := range pending {
+			if rows[tx.TransactionID]["Status"] != statusPending {
+				t.Errorf("%s: %s is %q, want pending", tab.title, tx.TransactionID, rows[tx.TransactionID]["Status"])
+			}
+		}
+		state := te.u.Accounts[tab.accountID]
+		if state.SheetID == nil || state.Watermark.IsZero() {
+			t.Errorf("%s: state wasn't recorded: %+v", tab.accountID, state)
+		}
+	}
+}
+
+func TestSyncIncremental(t *testing.T) {
+	te := newTestEngine(t)
+	te.sync(t, Options{})
+	before := len(te.rows(t, "Current Account"))
+
+	run := te.sync(t, Options{})
+	accRun := te.accountRun(t, run, "acc-1")
+	if accRun.Backfill {
+		t.Error("second sync was a backfill")
+	}
+	if accRun.RowsAdded != 0 {
+		t.Errorf("added %d rows with nothing new", accRun.RowsAdded)
+	}
+	if n := len(te.rows(t, "Current Account")); n != before {
+		t.Errorf("%d rows after re-running, want %d", n, before)
+	}
+
+	tx := te.conn.Transactions["acc-1"][len(te.conn.Transactions["acc-1"])-1]
+	tx.TransactionID = "acc-1-tx-new"
+	tx.Description = "NEW MERCHANT"
+	te.conn.Transactions["acc-1"] = append(te.conn.Transactions["acc-1"], tx)
+
+	run = te.sync(t, Options{})
+	if accRun := te.accountRun(t, run, "acc-1"); accRun.RowsAdded != 1 {
+		t.Errorf("added %d rows, want 1", accRun.RowsAdded)
+	}
+	rows := te.rows(t, "Current Account")
+	if len(rows) != before+1 {
+		t.Errorf("%d rows, want %d", len(rows), before+1)
+	}
+	if rows["acc-1-tx-new"]["Description"] != "NEW MERCHANT" {
+		t.Errorf("new transaction is %v", rows["acc-1-tx-new"])
+	}
+}
+
+func TestSyncDeletedTab(t *testing.T) {
+	te := newTestEngine(t)
+	te.sync(t, Options{})
+	before := len(te.rows(t, "Current Account"))
+
+	err := te.gs.BatchUpdate(te.ctx, te.u.SheetID, []*gsheets.Request{
+		{DeleteSheet: &gsheets.DeleteSheetRequest{SheetId: *te.u.Accounts["acc-1"].SheetID}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := te.sync(t, Options{})
+	if !te.accountRun(t, run, "acc-1").Backfill {
+		t.Error("re-adding a deleted tab wasn't a backfill")
+	}
+	if te.accountRun(t, run, "card-1").Backfill {
+		t.Error("the card's tab is still there, but it was backfilled")
+	}
+	if n := len(te.rows(t, "Current Account")); n != before {
+		t.Errorf("%d rows in the re-added tab, want the full history of %d", n, before)
+	}
+}
+
+func TestSyncPending(t *testing.T) {
+	te := newTestEngine(t)
+	te.sync(t, Options{})
+	before := len(te.rows(t, "Current Account"))
+
+	// one settles under a new ID, the other is dropped by the bank
+	if !te.tl.Settle("acc-1-pending-00000", "acc-1-settled") {
+		t.Fatal("no pending transaction to settle")
+	}
+	te.conn.Pending["acc-1"] = nil
+
+	run := te.sync(t, Options{})
+	accRun := te.accountRun(t, run, "acc-1")
+	if accRun.RowsAdded != 1 || accRun.RowsRemoved != 2 {
+		t.Errorf("added %d and removed %d rows, want 1 and 2", accRun.RowsAdded, accRun.RowsRemoved)
+	}
+	rows := te.rows(t, "Current Account")
+	if len(rows) != before-1 {
+		t.Errorf("%d rows, want %d", len(rows), before-1)
+	}
+	for _, id := range []string{"acc-1-pending-00000", "acc-1-pending-00001"} {
+		if _, ok := rows[id]; ok {
+			t.Errorf("pending %s is still in the sheet", id)
+		}
+	}
+	if rows["acc-1-settled"]["Status"] != statusSettled {
+		t.Errorf("settled transaction is %v", rows["acc-1-settled"])
+	}
+}
+
+func TestSyncColumnChange(t *testing.T) {
+	te := newTestEngine(t)
+	te.sync(t, Options{})
+	before := te.rows(t, "Current Account")
+
+	te.u.Columns = []string{"id", "description", "amount", "transaction_type", "timestamp"}
+	if err := domain.UpdateUser(te.ctx, te.u); err != nil {
+		t.Fatal(err)
+	}
+	run := te.sync(t, Options{})
+	if !te.accountRun(t, run, "acc-1").Backfill {
+		t.Error("changing the columns didn't backfill")
+	}
+
+	grid := te.gs.Grid(te.u.SheetID, "Current Account")
+	want := []string{"Transaction ID", "Description", "Amount", "Type", "Timestamp"}
+	if fmt.Sprint(grid[0]) != fmt.Sprint(want) {
+		t.Errorf("header is %v, want %v", grid[0], want)
+	}
+	// without a status column pending rows can't be told apart, so they go
+	rows := te.rows(t, "Current Account")
+	if want := len(te.conn.Transactions["acc-1"]); len(rows) != want {
+		t.Errorf("%d rows, want %d", len(rows), want)
+	}
+	for _, tx := range te.conn.Pending["acc-1"] {
+		if _, ok := rows[tx.TransactionID]; ok {
+			t.Errorf("pending %s is still in the sheet", tx.TransactionID)
+		}
+	}
+	for _, tx := range te.conn.Transactions["acc-1"] {
+		row, old := rows[tx.TransactionID], before[tx.TransactionID]
+		if row["Description"] != old["Description"] || row["Amount"] != old["Amount"] || row["Timestamp"] != old["Timestamp"] {
+			t.Fatalf("%s moved columns wrongly: %v, was %v", tx.TransactionID, row, old)
+		}
+		if row["Type"] != tx.TransactionType {
+			t.Fatalf("%s has type %q, want %q", tx.TransactionID, row["Type"], tx.TransactionType)
+		}
+		if _, ok := row["Status"]; ok {
+			t.Fatalf("%s still has a status: %v", tx.TransactionID, row)
+		}
+	}
+	if te.u.Accounts["acc-1"].Columns[1] != "description" {
+		t.Errorf("account's columns weren't recorded: %v", te.u.Accounts["acc-1"].Columns)
+	}
+}
+
+func TestSyncKeepsConcurrentEdits(t *testing.T) {
+	te := newTestEngine(t)
+	te.sync(t, Options{})
+
+	joint, err := te.gs.Create(te.ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the user changes their settings while the next sync is running
+	listClients := te.Truelayer
+	te.Truelayer = func(ctx context.Context, userID string) ([]*truelayer.Client, []truelayer.FailedConnection, error) {
+		_, err := domain.ModifyUser(ctx, userID, func(u *domain.User) error {
+			u.Columns = []string{"id", "timestamp", "amount"}
+			u.Rules = append(u.Rules, domain.Rule{ID: "rul_1", Category: "Groceries"})
+			u.SetDestination(domain.Destination{ID: "dst_joint", Name: "Joint", SheetID: joint, Connected: true})
+			return u.RouteAccount("card-1", "dst_joint")
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return listClients(ctx, userID)
+	}
+	te.sync(t, Options{})
+
+	u, err := domain.UserByID(te.ctx, te.u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	card := u.Accounts["card-1"]
+	if len(u.Columns) != 3 || len(u.Rules) != 1 || len(u.Destinations) != 1 || card.DestinationID != "dst_joint" {
+		t.Errorf("settings changed during the sync were lost: columns %v, rules %v, spreadsheets %v, card %+v", u.Columns, u.Rules, u.Destinations, card)
+	}
+	// it was synced into the main spreadsheet, which it's no longer in
+	if card.SheetID != nil || !card.Watermark.IsZero() {
+		t.Errorf("moved account kept its old tab: %+v", card)
+	}
+	if card.LastSynced.IsZero() || card.LastBalance == nil {
+		t.Errorf("moved account's sync wasn't saved: %+v", card)
+	}
+	acc := u.Accounts["acc-1"]
+	if acc.SheetID == nil || acc.LastSynced.IsZero() || !acc.Watermark.Equal(u.LastSync) {
+		t.Errorf("sync state wasn't saved: %+v", acc)
+	}
+	if te.u.Rules == nil {
+		t.Error("caller's user wasn't updated with what was saved")
+	}
+}
+
+// countingSheets counts the times each spreadsheet is read.
+type countingSheets struct {
+	sheets.Spreadsheets
+	gets map[string]int
+}
+
+func (c *countingSheets) Get(ctx context.Context, spreadsheetID string) (*gsheets.Spreadsheet, error) {
+	c.gets[spreadsheetID]++
+	return c.Spreadsheets.Get(ctx, spreadsheetID)
+}
+
+func TestSyncReadsOnce(t *testing.T) {
+	te := newTestEngine(t)
+	counter := &countingSheets{Spreadsheets: te.gs}
+	te.Sheets = func(ctx context.Context, userID string) (sheets.Spreadsheets, error) {
+		return counter, nil
+	}
+
+	for i, name := range []string{"first", "second"} {
+		counter.gets = make(map[string]int)
+		te.sync(t, Options{Backfill: i == 0})
+		if n := counter.gets[te.u.SheetID]; n != 1 {
+			t.Errorf("%s sync read the spreadsheet %d times, want once", name, n)
+		}
+	}
+
+	// the summary is worked out from the rows written to each tab
+	summary := te.gs.Grid(te.u.SheetID, summarySheet)
+	accounts := make(map[string]bool)
+	for _, row := range summary[1:] {
+		accounts[row[1]] = true
+	}
+	if !accounts["Current Account"] || !accounts["Credit Card"] {
+		t.Errorf("summary has accounts %v", accounts)
+	}
+}
+
+func TestSyncSummaryTransfers(t *testing.T) {
+	te := newTestEngine(t)
+	at := time.Now().AddDate(0, 0, -2).UTC().Format(time.RFC3339)
+	for _, tx := range []struct {
+		accountID, id string
+		amount        float64
+	}{
+		{"acc-1", "acc-1-transfer", -123.45},
+		{"card-1", "card-1-transfer", 123.45},
+	} {
+		te.conn.Transactions[tx.accountID] = append(te.conn.Transactions[tx.accountID], truelayer.Transaction{
+			TransactionID:       tx.id,
+			Timestamp:           at,
+			Description:         "CARD PAYMENT",
+			Amount:              tx.amount,
+			Currency:            "GBP",
+			TransactionCategory: "TRANSFER",
+		})
+	}
+	// no transfer column, so only the recorded transfers say which they are
+	te.u.Columns = []string{"id", "timestamp", "amount", "description", "status"}
+	if err := domain.UpdateUser(te.ctx, te.u); err != nil {
+		t.Fatal(err)
+	}
+
+	// the second sync is incremental, and still has to leave them out
+	for i := 0; i < 2; i++ {
+		te.sync(t, Options{})
+		for _, acc := range []struct {
+			accountID, title, column string
+			sign                     float64
+		}{
+			{"acc-1", "Current Account", "Out", -1},
+			{"card-1", "Credit Card", "In", 1},
+		} {
+			recorded, err := domain.TransfersOf(te.ctx, te.u.ID, acc.accountID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := recorded.TransactionIDs; len(got) != 1 || got[0] != acc.accountID+"-transfer" {
+				t.Errorf("%s: recorded transfers %v", acc.accountID, got)
+			}
+			var want float64
+			for _, tx := range te.conn.Transactions[acc.accountID] {
+				if tx.Amount*acc.sign > 0 && tx.TransactionCategory != "TRANSFER" {
+					want += tx.Amount * acc.sign
+				}
+			}
+			var got float64
+			grid := te.gs.Grid(te.u.SheetID, summarySheet)
+			for _, row := range grid[1:] {
+				if row[1] != acc.title || row[3] != summaryTotal {
+					continue
+				}
+				var v float64
+				for i, title := range summaryColumns {
+					if title == acc.column {
+						fmt.Sscan(row[i], &v)
+					}
+				}
+				got += v
+			}
+			if round(got) != round(want) {
+				t.Errorf("%s: summary has %.2f %s, want %.2f without the transfer", acc.accountID, got, acc.column, want)
+			}
+		}
+	}
+}
+
+func TestSyncBaseCurrency(t *testing.T) {
+	te := newTestEngine(t)
+	te.u.BaseCurrency = "EUR"
+	if err := domain.UpdateUser(te.ctx, te.u); err != nil {
+		t.Fatal(err)
+	}
+
+	// without rates nothing is converted
+	te.sync(t, Options{})
+	for id, row := range te.rows(t, "Current Account") {
+		if row["Converted Amount"] != "" || row["FX Rate"] != "" {
+			t.Fatalf("%s was converted without rates: %v", id, row)
+		}
+	}
+	if base := te.u.Accounts["acc-1"].BaseCurrency; base != "" {
+		t.Errorf("account recorded as converted into %q", base)
+	}
+
+	// once there are, every row is
+	te.FX = &fx.Table{
+		Base: "EUR",
+		Days: []fx.Day{{Date: time.Now().AddDate(-2, 0, 0), Rates: map[string]float64{"GBP": 0.5}}},
+	}
+	run := te.sync(t, Options{})
+	if !te.accountRun(t, run, "acc-1").Backfill {
+		t.Error("getting rates didn't backfill")
+	}
+	for id, row := range te.rows(t, "Current Account") {
+		if row["FX Rate"] != "2" || row["FX Rate Date"] == "" || row["Converted Amount"] == "" {
+			t.Fatalf("%s wasn't converted: %v", id, row)
+		}
+	}
+	if base := te.u.Accounts["acc-1"].BaseCurrency; base != "EUR" {
+		t.Errorf("account recorded as converted into %q", base)
+	}
+}
+
+func TestSyncRenewedConsent(t *testing.T) {
+	te := newTestEngine(t)
+	te.sync(t, Options{})
+	expires := te.u.Connections["tok_demo"].ConsentExpiresAt
+	remind := func(expiresAt time.Time) {
+		t.Helper()
+		u, err := domain.ModifyUser(te.ctx, te.u.ID, func(u *domain.User) error {
+			c := u.Connections["tok_demo"]
+			c.ConsentExpiresAt, c.ConsentReminderAt = expiresAt, time.Now()
+			u.Connections["tok_demo"] = c
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		te.u = u
+	}
+
+	// still the expiry it was reminded about
+	remind(expires)
+	te.sync(t, Options{})
+	if te.u.Connections["tok_demo"].ConsentReminderAt.IsZero() {
+		t.Error("reminder was cleared without the consent being renewed")
+	}
+
+	// renewed outside the reconnect flow
+	remind(expires.AddDate(0, 0, -30))
+	te.sync(t, Options{})
+	if c := te.u.Connections["tok_demo"]; !c.ConsentReminderAt.IsZero() || !c.ConsentExpiresAt.Equal(expires) {
+		t.Errorf("renewed consent is still flagged: %+v", c)
+	}
+}
+
+func TestSyncFailedConnection(t *testing.T) {
+	te := newTestEngine(t)
+	te.sync(t, Options{})
+
+	// the token can't be refreshed, the connection is still stored though
+	te.ArchiveAfter = time.Nanosecond
+	te.Truelayer = func(ctx context.Context, userID string) ([]*truelayer.Client, []truelayer.FailedConnection, error) {
+		return nil, []truelayer.FailedConnection{{ConnectionID: "tok_demo", Err: errors.New("invalid_grant")}}, nil
+	}
+	run, err := te.Sync(te.ctx, te.u, Options{})
+	if err == nil {
+		t.Error("sync succeeded without syncing any accounts")
+	}
+	if len(run.Connections) != 1 || run.Connections[0].Error == "" {
+		t.Errorf("connection's error wasn't recorded in the run: %+v", run.Connections)
+	}
+	u, err := domain.UserByID(te.ctx, te.u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := u.Connections["tok_demo"]; c.LastError == "" || c.LastErrorAt.IsZero() {
+		t.Errorf("connection's error wasn't recorded: %+v", c)
+	}
+	for _, id := range []string{"acc-1", "card-1"} {
+		if te.accountRun(t, run, id).Error == "" {
+			t.Errorf("%s's error wasn't recorded in the run", id)
+		}
+		acc := u.Accounts[id]
+		if acc.LastError == "" {
+			t.Errorf("%s's error wasn't recorded: %+v", id, acc)
+		}
+		if acc.IsArchived() || !acc.MissingSince.IsZero() {
+			t.Errorf("%s was archived while its connection failed: %+v", id, acc)
+		}
+	}
+	titles := strings.Join(te.gs.Titles(te.u.SheetID), ",")
+	if strings.Contains(titles, archivedSuffix) {
+		t.Errorf("tabs were archived: %s", titles)
+	}
+}
+
+func TestSyncBalanceHistory(t *testing.T) {
+	te := newTestEngine(t)
+	te.sync(t, Options{})
+	te.sync(t, Options{})
+
+	// syncing again the same day replaces the day's balances
+	long := te.gs.Grid(te.u.SheetID, historySheet)
+	if len(long) != 1+2 {
+		t.Errorf("long history has %d rows, want a header and one per account: %v", len(long), long)
+	}
+	wide := te.gs.Grid(te.u.SheetID, historyWideSheet)
+	want := []string{"Date", "Current Account (Demo Bank)", "Credit Card (Demo Bank)"}
+	if len(wide) != 2 || fmt.Sprint(wide[0]) != fmt.Sprint(want) {
+		t.Fatalf("wide history is %v, want a header of %v and one row", wide, want)
+	}
+	if b := te.conn.Balances["acc-1"]; wide[1][1] != fmt.Sprint(b.Current) {
+		t.Errorf("wide history has %s for the current account, want %v", wide[1][1], b.Current)
+	}
+
+	// a new account gets a column, and today's row its balance
+	savings := te.conn.Accounts[0]
+	savings.AccountID, savings.DisplayName = "acc-savings", "Savings"
+	te.conn.Accounts = append(te.conn.Accounts, savings)
+	te.conn.Balances["acc-savings"] = truelayer.Balance{Currency: "GBP", Available: 500, Current: 500}
+	te.sync(t, Options{})
+
+	if long := te.gs.Grid(te.u.SheetID, historySheet); len(long) != 1+3 {
+		t.Errorf("long history has %d rows, want a header and one per account: %v", len(long), long)
+	}
+	wide = te.gs.Grid(te.u.SheetID, historyWideSheet)
+	want = append(want, "Savings (Demo Bank)")
+	if len(wide) != 2 || fmt.Sprint(wide[0]) != fmt.Sprint(want) {
+		t.Fatalf("wide history is %v, want a header of %v and one row", wide, want)
+	}
+	if wide[1][3] != "500" {
+		t.Errorf("wide history has %s for the new account, want 500", wide[1][3])
+	}
+}
+
+func TestSyncRules(t *testing.T) {
+	te := newTestEngine(t)
+	te.u.Columns = []string{"id", "timestamp", "amount", "description", "status", "category", "tags"}
+	te.u.Rules = []domain.Rule{
+		{ID: "salary", Description: "salary", Category: "Income", Tags: []string{"work", "monthly"}},
+		// would match the salary too, but comes after
+		{ID: "acme", Description: "^acme", Category: "Acme"},
+		{ID: "spending", AccountID: "acc-1", TransactionType: "DEBIT", Category: "Spending"},
+	}
+	if err := domain.UpdateUser(te.ctx, te.u); err != nil {
+		t.Fatal(err)
+	}
+	te.sync(t, Options{})
+
+	check := func(spending string) {
+		t.Helper()
+		rows := te.rows(t, "Current Account")
+		for _, tx := range te.conn.Transactions["acc-1"] {
+			row := rows[tx.TransactionID]
+			want, tags := spending, ""
+			if tx.Description == "ACME LTD SALARY" {
+				want, tags = "Income", "work, monthly"
+			}
+			if row["Category"] != want || row["Tags"] != tags {
+				t.Fatalf("%s %q is %q tagged %q, want %q tagged %q", tx.TransactionID, tx.Description, row["Category"], row["Tags"], want, tags)
+			}
+		}
+		// the card's account doesn't match, so keeps the bank's category
+		cards := te.rows(t, "Credit Card")
+		for _, tx := range te.conn.Transactions["card-1"] {
+			if got := cards[tx.TransactionID]["Category"]; got != tx.TransactionCategory {
+				t.Fatalf("%s on the card is %q, want %q", tx.TransactionID, got, tx.TransactionCategory)
+			}
+		}
+	}
+	check("Spending")
+
+	u, err := domain.ModifyUser(te.ctx, te.u.ID, func(u *domain.User) error {
+		u.Rules[2].Category = "Bills"
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	te.u = u
+
+	// only the transactions fetched again get the changed rule
+	te.sync(t, Options{})
+	first := te.conn.Transactions["acc-1"][0]
+	if first.Description == "ACME LTD SALARY" {
+		first = te.conn.Transactions["acc-1"][1]
+	}
+	if got := te.rows(t, "Current Account")[first.TransactionID]["Category"]; got != "Spending" {
+		t.Fatalf("year old %s was recategorised as %q without reapplying", first.TransactionID, got)
+	}
+
+	run := te.sync(t, Options{ReapplyRules: true})
+	if te.accountRun(t, run, "acc-1").RowsUpdated == 0 {
+		t.Error("reapplying the rules didn't update any rows")
+	}
+	check("Bills")
+}
+
+// missing marks an account as missing for longer than the engine's
+// ArchiveAfter, with action chosen for it once it's archived.
+func (te *testEngine) missing(t *testing.T, accountID, action string) {
+	t.Helper()
+	u, err := domain.ModifyUser(te.ctx, te.u.ID, func(u *domain.User) error {
+		acc := u.Accounts[accountID]
+		acc.MissingSince = time.Now().Add(-2 * te.ArchiveAfter)
+		acc.ArchiveAction = action
+		u.Accounts[accountID] = acc
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	te.u = u
+}
+
+// tab returns the properties of a tab in the user's spreadsheet, or nil if
+// it's gone.
+func (te *testEngine) tab(t *testing.T, sheetID int64) *gsheets.SheetProperties {
+	t.Helper()
+	ss, err := te.gs.Get(te.ctx, te.u.SheetID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sheet := findSheet(ss, withSheetID(sheetID)); sheet != nil {
+		return sheet.Properties
+	}
+	return nil
+}
+
+func TestSyncArchive(t *testing.T) {
+	te := newTestEngine(t)
+	te.ArchiveAfter = time.Hour
+	te.sync(t, Options{})
+	sheetID := *te.u.Accounts["card-1"].SheetID
+	cards := te.conn.Cards
+
+	// the connection stops listing the card
+	te.conn.Cards = nil
+	te.sync(t, Options{})
+	if card := te.u.Accounts["card-1"]; card.IsArchived() || card.MissingSince.IsZero() {
+		t.Fatalf("card was archived as soon as it went missing: %+v", card)
+	}
+
+	te.missing(t, "card-1", "")
+	te.sync(t, Options{})
+	if card := te.u.Accounts["card-1"]; !card.IsArchived() {
+		t.Fatalf("card wasn't archived after ArchiveAfter: %+v", card)
+	}
+	if p := te.tab(t, sheetID); p == nil || p.Title != "Credit Card"+archivedSuffix || p.Hidden {
+		t.Errorf("kept tab wasn't marked as archived: %+v", p)
+	}
+	if p := te.tab(t, *te.u.Accounts["acc-1"].SheetID); p == nil || p.Title != "Current Account" {
+		t.Errorf("listed account's tab changed: %+v", p)
+	}
+	te.sync(t, Options{})
+	if p := te.tab(t, sheetID); p == nil || p.Title != "Credit Card"+archivedSuffix {
+		t.Errorf("archived tab was changed by a later sync: %+v", p)
+	}
+
+	// and lists it again
+	te.conn.Cards = cards
+	te.sync(t, Options{})
+	if card := te.u.Accounts["card-1"]; card.IsArchived() || !card.MissingSince.IsZero() {
+		t.Errorf("card wasn't restored: %+v", card)
+	}
+	if p := te.tab(t, sheetID); p == nil || p.Title != "Credit Card" {
+		t.Errorf("restored tab is still marked as archived: %+v", p)
+	}
+}
+
+func TestSyncArchiveHide(t *testing.T) {
+	te := newTestEngine(t)
+	te.ArchiveAfter = time.Hour
+	te.sync(t, Options{})
+	sheetID := *te.u.Accounts["card-1"].SheetID
+	cards := te.conn.Cards
+
+	te.conn.Cards = nil
+	te.missing(t, "card-1", domain.ArchiveHide)
+	te.sync(t, Options{})
+	if p := te.tab(t, sheetID); p == nil || !p.Hidden || p.Title != "Credit Card" {
+		t.Errorf("archived tab wasn't hidden: %+v", p)
+	}
+
+	te.conn.Cards = cards
+	te.sync(t, Options{})
+	u, err := domain.UserByID(te.ctx, te.u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if card := u.Accounts["card-1"]; card.IsArchived() || card.ArchiveAction != "" {
+		t.Errorf("restored card kept its archive action: %+v", card)
+	}
+	if p := te.tab(t, sheetID); p == nil || p.Hidden {
+		t.Errorf("restored tab is still hidden: %+v", p)
+	}
+}
+
+func TestSyncArchiveDelete(t *testing.T) {
+	te := newTestEngine(t)
+	te.ArchiveAfter = time.Hour
+	te.sync(t, Options{})
+	sheetID := *te.u.Accounts["card-1"].SheetID
+	err := domain.SaveTransfers(te.ctx, &domain.AccountTransfers{
+		ID:             te.u.ID + "_card-1",
+		UserID:         te.u.ID,
+		AccountID:      "card-1",
+		TransactionIDs: []string{"card-1-transfer"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	te.conn.Cards = nil
+	te.missing(t, "card-1", domain.ArchiveDelete)
+	te.sync(t, Options{})
+	if p := te.tab(t, sheetID); p != nil {
+		t.Errorf("archived tab wasn't deleted: %+v", p)
+	}
+	u, err := domain.UserByID(te.ctx, te.u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if card, ok := u.Accounts["card-1"]; ok {
+		t.Errorf("deleted card wasn't forgotten: %+v", card)
+	}
+	if _, ok := u.Accounts["acc-1"]; !ok {
+		t.Error("listed account was forgotten")
+	}
+	transfers, err := domain.TransfersOf(te.ctx, te.u.ID, "card-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(transfers.TransactionIDs) != 0 {
+		t.Errorf("deleted card's transfers weren't forgotten: %v", transfers.TransactionIDs)
+	}
+}
+
+func TestSyncConnectedSpreadsheet(t *testing.T) {
+	te := newTestEngine(t)
+	// the user's own tabs, some named like those the sync would add
+	userTabs := map[int64]string{0: "Sheet1", 101: "Credit Card", 102: "Balances", 103: "Monthly Summary"}
+	var reqs []*gsheets.Request
+	for id, title := range userTabs {
+		if id != 0 {
+			reqs = append(reqs, &gsheets.Request{AddSheet: &gsheets.AddSheetRequest{
+				Properties: &gsheets.SheetProperties{SheetId: id, Title: title},
+			}})
+		}
+		budget := "Budget"
+		reqs = append(reqs, &gsheets.Request{UpdateCells: &gsheets.UpdateCellsRequest{
+			Start:  &gsheets.GridCoordinate{SheetId: id},
+			Fields: "userEnteredValue",
+			Rows: []*gsheets.RowData{{Values: []*gsheets.CellData{
+				{UserEnteredValue: &gsheets.ExtendedValue{StringValue: &budget}},
+			}}},
+		}})
+	}
+	if err := te.gs.BatchUpdate(te.ctx, te.u.SheetID, reqs); err != nil {
+		t.Fatal(err)
+	}
+	te.u.SetSpreadsheet(te.u.SheetID, true)
+	te.u.TabPrefix = "YNAS - "
+	if err := domain.UpdateUser(te.ctx, te.u); err != nil {
+		t.Fatal(err)
+	}
+	te.sync(t, Options{})
+	te.sync(t, Options{})
+
+	for id, title := range userTabs {
+		p := te.tab(t, id)
+		if p == nil || p.Title != title || p.Hidden {
+			t.Errorf("user's %s tab was changed: %+v", title, p)
+			continue
+		}
+		if grid := te.gs.Grid(te.u.SheetID, title); len(grid) != 1 || len(grid[0]) != 1 || grid[0][0] != "Budget" {
+			t.Errorf("user's %s tab was written to, it has %d rows", title, len(grid))
+		}
+	}
+	mine := make(map[string]bool)
+	for _, title := range userTabs {
+		mine[title] = true
+	}
+	titles := te.gs.Titles(te.u.SheetID)
+	added := 0
+	for _, title := range titles {
+		if mine[title] {
+			continue
+		}
+		added++
+		if !strings.HasPrefix(title, te.u.TabPrefix) {
+			t.Errorf("added tab %q doesn't have the tab prefix", title)
+		}
+	}
+	if added == 0 {
+		t.Errorf("no tabs were added: %v", titles)
+	}
+}
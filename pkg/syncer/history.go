@@ -0,0 +1,294 @@
+package syncer
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/monzo/slog"
+	"github.com/pkg/errors"
+	gsheets "google.golang.org/api/sheets/v4"
+
+	"github.com/arussellsaw/youneedaspreadsheet/domain"
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/sheets"
+)
+
+// The balance history tabs, the long tab has a row per account per day, and
+// the wide tab a row per day with a column per account, which is easier to
+// chart.
+const (
+	historySheet     = "Balance History"
+	historyWideSheet = "Balance History (Wide)"
+)
+
+var historyColumns = []string{"Date", "Account", "Provider", "Available", "Current", "Overdraft"}
+
+// syncBalanceHistory records today's balance of every account in accs in the
+// balance history tabs of the spreadsheet d, adding them if they don't exist.
+// Syncing more than once in a day replaces that day's balances.
+func (e *Engine) syncBalanceHistory(ctx context.Context, gs sheets.Spreadsheets, u *domain.User, d *domain.Destination, ss *gsheets.Spreadsheet, accs []domain.AccountState, now time.Time) error {
+	if len(accs) == 0 {
+		return nil
+	}
+	ss, err := addSheets(ctx, gs, d.SheetID, ss, d.TabPrefix, len(historyColumns), historySheet, historyWideSheet)
+	if err != nil {
+		return errors.Wrap(err, "adding balance history sheets")
+	}
+	var (
+		loc   = sheetLocation(ctx, ss)
+		today = math.Floor(dateSerial(now, loc))
+		// every account the user has, to tell apart those with the same
+		// name
+		known = u.AccountList()
+		reqs  []*gsheets.Request
+	)
+	reqs = append(reqs, historyUpdate(ownSheet(ss, historySheet), accs, known, today)...)
+	reqs = append(reqs, historyWideUpdate(ownSheet(ss, historyWideSheet), accs, known, today)...)
+	err = gs.BatchUpdate(ctx, d.SheetID, reqs)
+	if err != nil {
+		slog.Error(ctx, "Error updating balance history: %s", err)
+		return errors.Wrap(err, "updating balance history")
+	}
+	return nil
+}
+
+// historyUpdate appends a row for each account to the long history tab, or
+// overwrites the account's row if it already has one for today.
+func historyUpdate(sheet *gsheets.Sheet, accs, known []domain.AccountState, today float64) []*gsheets.Request {
+	rows := sheetRows(sheet)
+	var reqs []*gsheets.Request
+	if len(rows) == 0 {
+		header := &gsheets.RowData{}
+		for _, title := range historyColumns {
+			header.Values = append(header.Values, headerCell(title))
+		}
+		reqs = append(reqs, updateRows(sheet, 0, header))
+		rows = []*gsheets.RowData{header}
+	}
+	// today's rows are always the last ones
+	todays := make(map[string]int)
+	for i := len(rows) - 1; i > 0 && rowDate(rows[i]) == today; i-- {
+		todays[rowValue(rows[i], 1)+"\x00"+rowValue(rows[i], 2)] = i
+	}
+	var appends []*gsheets.RowData
+	for _, acc := range accs {
+		name := historyName(acc, known)
+		f := cellFormat{currency: acc.LastBalance.Currency}
+		row := &gsheets.RowData{
+			Values: []*gsheets.CellData{
+				dateCell(today),
+				stringCell(name),
+				stringCell(acc.Provider),
+				f.cell(moneyColumn, numberValue(acc.LastBalance.Available)),
+				f.cell(moneyColumn, numberValue(acc.LastBalance.Current)),
+				f.cell(moneyColumn, numberValue(acc.LastBalance.Overdraft)),
+			},
+		}
+		if i, ok := todays[name+"\x00"+acc.Provider]; ok {
+			reqs = append(reqs, updateRows(sheet, int64(i), row))
+			continue
+		}
+		appends = append(appends, row)
+	}
+	if len(appends) > 0 {
+		reqs = append(reqs, &gsheets.Request{
+			AppendCells: &gsheets.AppendCellsRequest{
+				SheetId: sheet.Properties.SheetId,
+				Fields:  "*",
+				Rows:    appends,
+			},
+		})
+	}
+	return reqs
+}
+
+// historyWideUpdate sets each account's current balance in today's row of the
+// wide history tab, adding a column for any account it hasn't seen before.
+func historyWideUpdate(sheet *gsheets.Sheet, accs, known []domain.AccountState, today float64) []*gsheets.Request {
+	rows := sheetRows(sheet)
+	header := &gsheets.RowData{Values: []*gsheets.CellData{headerCell("Date")}}
+	if len(rows) > 0 {
+		header = rows[0]
+	}
+	columns := make(map[string]int)
+	for i := 1; i < len(header.Values); i++ {
+		columns[rowValue(header, i)] = i
+	}
+	var reqs []*gsheets.Request
+	for _, acc := range accs {
+		title := historyName(acc, known) + " (" + acc.Provider + ")"
+		if _, ok := columns[title]; ok {
+			continue
+		}
+		columns[title] = len(header.Values)
+		header.Values = append(header.Values, headerCell(title))
+	}
+	if grid := sheet.Properties.GridProperties; grid != nil && int64(len(header.Values)) > grid.ColumnCount {
+		reqs = append(reqs, &gsheets.Request{
+			AppendDimension: &gsheets.AppendDimensionRequest{
+				SheetId:   sheet.Properties.SheetId,
+				Dimension: "COLUMNS",
+				Length:    int64(len(header.Values)) - grid.ColumnCount,
+			},
+		})
+	}
+	reqs = append(reqs, updateRows(sheet, 0, header))
+
+	var (
+		row  = &gsheets.RowData{}
+		last = len(rows) - 1
+	)
+	replace := last > 0 && rowDate(rows[last]) == today
+	if replace {
+		row = rows[last]
+	}
+	for len(row.Values) < len(header.Values) {
+		row.Values = append(row.Values, &gsheets.CellData{})
+	}
+	row.Values[0] = dateCell(today)
+	for _, acc := range accs {
+		f := cellFormat{currency: acc.LastBalance.Currency}
+		row.Values[columns[historyName(acc, known)+" ("+acc.Provider+")"]] = f.cell(moneyColumn, numberValue(acc.LastBalance.Current))
+	}
+	if replace {
+		return append(reqs, updateRows(sheet, int64(last), row))
+	}
+	return append(reqs, &gsheets.Request{
+		AppendCells: &gsheets.AppendCellsRequest{
+			SheetId: sheet.Properties.SheetId,
+			Fields:  "*",
+			Rows:    []*gsheets.RowData{row},
+		},
+	})
+}
+
+// historyName returns the name an account is recorded under in the history
+// tabs, which has its ID added if another account at the same provider has
+// the same name.
+func historyName(acc domain.AccountState, known []domain.AccountState) string {
+	for _, other := range known {
+		if other.ID != acc.ID && other.Name == acc.Name && other.Provider == acc.Provider {
+			return acc.Name + " " + acc.ID
+		}
+	}
+	return acc.Name
+}
+
+// moneyColumn formats balances like transaction amounts.
+var moneyColumn = Column{kind: kindMoney}
+
+// addSheets adds any of the titled sheets which don't exist yet, with a
+// frozen header row, and returns the spreadsheet with them added. Each is
+// titled with the prefix, and a number if one of the user's own tabs already
+// has the title.
+func addSheets(ctx context.Context, gs sheets.Spreadsheets, spreadsheetID string, ss *gsheets.Spreadsheet, prefix string, columns int, titles ...string) (*gsheets.Spreadsheet, error) {
+	var (
+		add   []*gsheets.Request
+		taken []string
+	)
+	for _, title := range titles {
+		if ownSheet(ss, title) != nil {
+			continue
+		}
+		name := freeTitle(ss, prefix+title, taken...)
+		taken = append(taken, name)
+		add = append(add, &gsheets.Request{
+			AddSheet: &gsheets.AddSheetRequest{
+				Properties: &gsheets.SheetProperties{
+					SheetId: sheetID(title),
+					Title:   name,
+					GridProperties: &gsheets.GridProperties{
+						ColumnCount:    int64(columns),
+						RowCount:       2,
+						FrozenRowCount: 1,
+					},
+				},
+			},
+		})
+	}
+	if len(add) == 0 {
+		return ss, nil
+	}
+	err := gs.BatchUpdate(ctx, spreadsheetID, add)
+	if err != nil {
+		return nil, err
+	}
+	return withAdded(ss, add), nil
+}
+
+// ownSheet finds a tab added by addSheets by the ID it was given, so it can
+// be renamed.
+func ownSheet(ss *gsheets.Spreadsheet, title string) *gsheets.Sheet {
+	return findSheet(ss, withSheetID(sheetID(title)))
+}
+
+// freeTitle returns the title, with a number added if a tab in the
+// spreadsheet, or one about to be added in also, already has it.
+func freeTitle(ss *gsheets.Spreadsheet, title string, also ...string) string {
+	isTaken := func(t string) bool {
+		for _, a := range also {
+			if strings.EqualFold(a, t) {
+				return true
+			}
+		}
+		return findSheet(ss, func(p *gsheets.SheetProperties) bool {
+			return strings.EqualFold(p.Title, t)
+		}) != nil
+	}
+	name := title
+	for n := 2; isTaken(name); n++ {
+		name = fmt.Sprintf("%s (%d)", title, n)
+	}
+	return name
+}
+
+func sheetRows(sheet *gsheets.Sheet) []*gsheets.RowData {
+	if len(sheet.Data) == 0 {
+		return nil
+	}
+	return sheet.Data[0].RowData
+}
+
+// updateRows overwrites the rows starting at the given row.
+func updateRows(sheet *gsheets.Sheet, row int64, rows ...*gsheets.RowData) *gsheets.Request {
+	return &gsheets.Request{
+		UpdateCells: &gsheets.UpdateCellsRequest{
+			Fields: "*",
+			Start: &gsheets.GridCoordinate{
+				SheetId:     sheet.Properties.SheetId,
+				RowIndex:    row,
+				ColumnIndex: 0,
+			},
+			Rows: rows,
+		},
+	}
+}
+
+func headerCell(title string) *gsheets.CellData {
+	return &gsheets.CellData{
+		UserEnteredValue: stringValue(title),
+		UserEnteredFormat: &gsheets.CellFormat{
+			TextFormat: &gsheets.TextFormat{Bold: true},
+		},
+	}
+}
+
+// dateCell writes a day's date serial formatted as a date.
+func dateCell(day float64) *gsheets.CellData {
+	return &gsheets.CellData{
+		UserEnteredValue: numberValue(day),
+		UserEnteredFormat: &gsheets.CellFormat{
+			NumberFormat: &gsheets.NumberFormat{Type: "DATE", Pattern: "yyyy-mm-dd"},
+		},
+	}
+}
+
+// rowDate returns the date serial in the first cell of a row, or -1.
+func rowDate(row *gsheets.RowData) float64 {
+	if row == nil || len(row.Values) == 0 || row.Values[0] == nil || row.Values[0].UserEnteredValue == nil || row.Values[0].UserEnteredValue.NumberValue == nil {
+		return -1
+	}
+	return *row.Values[0].UserEnteredValue.NumberValue
+}
@@ -0,0 +1,94 @@
+package syncer
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+
+	"github.com/monzo/slog"
+
+	"github.com/arussellsaw/youneedaspreadsheet/domain"
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/truelayer"
+)
+
+type rule struct {
+	domain.Rule
+	description, merchant *regexp.Regexp
+}
+
+// rules are a user's categorisation rules, in order.
+type rules []rule
+
+// ValidateRule checks a rule has a category and its patterns compile.
+// Patterns are case insensitive.
+func ValidateRule(r domain.Rule) error {
+	_, err := compileRule(r)
+	return err
+}
+
+func compileRule(r domain.Rule) (rule, error) {
+	out := rule{Rule: r}
+	if r.Category == "" {
+		return out, fmt.Errorf("a rule needs a category")
+	}
+	if r.MinAmount != nil && r.MaxAmount != nil && *r.MinAmount > *r.MaxAmount {
+		return out, fmt.Errorf("the minimum amount is more than the maximum")
+	}
+	var err error
+	if r.Description != "" {
+		out.description, err = regexp.Compile("(?i)" + r.Description)
+		if err != nil {
+			return out, fmt.Errorf("bad description pattern: %s", err)
+		}
+	}
+	if r.Merchant != "" {
+		out.merchant, err = regexp.Compile("(?i)" + r.Merchant)
+		if err != nil {
+			return out, fmt.Errorf("bad merchant pattern: %s", err)
+		}
+	}
+	return out, nil
+}
+
+// userRules compiles the user's rules, any which are invalid are skipped.
+func userRules(ctx context.Context, u *domain.User) rules {
+	var rs rules
+	for _, r := range u.Rules {
+		c, err := compileRule(r)
+		if err != nil {
+			slog.Warn(ctx, "Skipping rule %s: %s", r.ID, err)
+			continue
+		}
+		rs = append(rs, c)
+	}
+	return rs
+}
+
+func (r rule) matches(tx *truelayer.Transaction, accountID string) bool {
+	switch {
+	case r.description != nil && !r.description.MatchString(tx.Description):
+		return false
+	case r.merchant != nil && !r.merchant.MatchString(tx.MerchantName):
+		return false
+	case r.MinAmount != nil && tx.Amount < *r.MinAmount:
+		return false
+	case r.MaxAmount != nil && tx.Amount > *r.MaxAmount:
+		return false
+	case r.AccountID != "" && r.AccountID != accountID:
+		return false
+	case r.TransactionType != "" && r.TransactionType != tx.TransactionType:
+		return false
+	}
+	return true
+}
+
+// categorise returns the category and tags of the first rule matching the
+// transaction, or the bank's category if none do.
+func (rs rules) categorise(tx *truelayer.Transaction, accountID string) (string, []string) {
+	for _, r := range rs {
+		if r.matches(tx, accountID) {
+			return r.Category, r.Tags
+		}
+	}
+	return tx.TransactionCategory, nil
+}
@@ -0,0 +1,227 @@
+package syncer
+
+import (
+	"context"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/monzo/slog"
+	"github.com/pkg/errors"
+	gsheets "google.golang.org/api/sheets/v4"
+
+	"github.com/arussellsaw/youneedaspreadsheet/domain"
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/sheets"
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/truelayer"
+)
+
+const summarySheet = "Monthly Summary"
+
+var summaryColumns = []string{"Month", "Account", "Provider", "Category", "In", "Out", "Net"}
+
+// summaryTotal is the category of the row totalling every transaction in an
+// account's month.
+const summaryTotal = "All"
+
+// summaryRow is a row of the summary tab.
+type summaryRow struct {
+	month    float64
+	account  string
+	provider string
+	category string
+	row      *gsheets.RowData
+}
+
+type monthTotal struct {
+	in, out float64
+}
+
+// syncSummary recomputes the monthly summary in the spreadsheet d of every
+// account in accs from the rows in its sheet, so transactions which land late
+// in a previous month are counted, and leaves the rows of every other account
+// in the tab alone. transfers are the IDs of each account's transfers, by
+// account ID.
+func (e *Engine) syncSummary(ctx context.Context, gs sheets.Spreadsheets, u *domain.User, d *domain.Destination, ss *gsheets.Spreadsheet, accs []truelayer.AbstractAccount, transfers map[string][]string) error {
+	if len(accs) == 0 {
+		return nil
+	}
+	ss, err := addSheets(ctx, gs, d.SheetID, ss, d.TabPrefix, len(summaryColumns), summarySheet)
+	if err != nil {
+		return errors.Wrap(err, "adding summary sheet")
+	}
+	sheet := ownSheet(ss, summarySheet)
+	old := sheetRows(sheet)
+	written := len(old)
+	if len(old) > 0 {
+		old = old[1:]
+	}
+
+	var (
+		rows     []summaryRow
+		replaced = make(map[string]bool)
+		known    = u.AccountList()
+	)
+	for _, acc := range accs {
+		state := u.Accounts[acc.ID()]
+		if state.SheetID == nil {
+			continue
+		}
+		accSheet := findSheet(ss, withSheetID(*state.SheetID))
+		if accSheet == nil {
+			continue
+		}
+		name := historyName(state, known)
+		replaced[name+"\x00"+state.Provider] = true
+		f := cellFormat{currency: acc.CurrencyCode()}
+		rows = append(rows, summaryRows(name, state.Provider, summarise(sheetRows(accSheet), sheetLayout(state), transfers[acc.ID()]), f)...)
+	}
+	for _, row := range old {
+		r := summaryRow{
+			month:    rowDate(row),
+			account:  rowValue(row, 1),
+			provider: rowValue(row, 2),
+			category: rowValue(row, 3),
+			row:      row,
+		}
+		if r.month < 0 || replaced[r.account+"\x00"+r.provider] {
+			continue
+		}
+		rows = append(rows, r)
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		a, b := rows[i], rows[j]
+		switch {
+		case a.month != b.month:
+			return a.month < b.month
+		case a.account != b.account:
+			return a.account < b.account
+		case a.provider != b.provider:
+			return a.provider < b.provider
+		case a.category == summaryTotal || b.category == summaryTotal:
+			return a.category == summaryTotal && b.category != summaryTotal
+		default:
+			return a.category < b.category
+		}
+	})
+
+	header := &gsheets.RowData{}
+	for _, title := range summaryColumns {
+		header.Values = append(header.Values, headerCell(title))
+	}
+	out := []*gsheets.RowData{header}
+	changed := len(rows) != len(old)
+	for i, r := range rows {
+		out = append(out, r.row)
+		if !changed && !rowsEqual(r.row, old[i]) {
+			changed = true
+		}
+	}
+	if !changed && written > 0 {
+		return nil
+	}
+	err = gs.BatchUpdate(ctx, d.SheetID, replaceRows(sheet, out, written))
+	if err != nil {
+		slog.Error(ctx, "Error updating summary: %s", err)
+		return errors.Wrap(err, "updating summary")
+	}
+	return nil
+}
+
+// summarise totals the settled transactions in an account sheet's rows by
+// month, and by category within each month if the sheet has categories,
+// preferring the category from the user's rules over the bank's. Transfers
+// between the user's accounts aren't money in or out, so are left out, found
+// by their IDs in transfers or by their label if the sheet has a transfer
+// column.
+func summarise(rows []*gsheets.RowData, l layout, transfers []string) map[float64]map[string]*monthTotal {
+	var (
+		months      = make(map[float64]map[string]*monthTotal)
+		transferIDs = make(map[string]bool, len(transfers))
+		amount      = l.index("amount")
+		category    = l.index("category")
+		transfer    = l.index("transfer")
+	)
+	if category < 0 {
+		category = l.index("transaction_category")
+	}
+	if amount < 0 {
+		return months
+	}
+	for _, id := range transfers {
+		transferIDs[id] = true
+	}
+	for _, row := range rows {
+		if row == nil || isHeader(row) || rowStatus(row, l) == statusPending || transferIDs[rowValue(row, 0)] || rowValue(row, transfer) != "" {
+			continue
+		}
+		ts := timestamp(row, l)
+		if amount >= len(row.Values) || row.Values[amount] == nil || row.Values[amount].UserEnteredValue == nil || row.Values[amount].UserEnteredValue.NumberValue == nil || ts == 0 {
+			continue
+		}
+		month := monthSerial(ts)
+		if months[month] == nil {
+			months[month] = make(map[string]*monthTotal)
+		}
+		keys := []string{summaryTotal}
+		if c := rowValue(row, category); c != "" {
+			keys = append(keys, c)
+		}
+		for _, key := range keys {
+			t := months[month][key]
+			if t == nil {
+				t = &monthTotal{}
+				months[month][key] = t
+			}
+			if v := *row.Values[amount].UserEnteredValue.NumberValue; v > 0 {
+				t.in += v
+			} else {
+				t.out -= v
+			}
+		}
+	}
+	return months
+}
+
+func summaryRows(account, provider string, months map[float64]map[string]*monthTotal, f cellFormat) []summaryRow {
+	var rows []summaryRow
+	for month, categories := range months {
+		for category, t := range categories {
+			rows = append(rows, summaryRow{
+				month:    month,
+				account:  account,
+				provider: provider,
+				category: category,
+				row: &gsheets.RowData{
+					Values: []*gsheets.CellData{
+						monthCell(month),
+						stringCell(account),
+						stringCell(provider),
+						stringCell(category),
+						f.cell(moneyColumn, numberValue(round(t.in))),
+						f.cell(moneyColumn, numberValue(round(t.out))),
+						f.cell(moneyColumn, numberValue(round(t.in-t.out))),
+					},
+				},
+			})
+		}
+	}
+	return rows
+}
+
+// monthSerial returns the date serial of the first day of the month of a
+// date serial.
+func monthSerial(serial float64) float64 {
+	t := sheetsEpoch.Add(time.Duration(serial * 24 * float64(time.Hour)))
+	return dateSerial(time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC), time.UTC)
+}
+
+func monthCell(month float64) *gsheets.CellData {
+	c := dateCell(month)
+	c.UserEnteredFormat.NumberFormat.Pattern = "yyyy-mm"
+	return c
+}
+
+// round drops the float noise from summing amounts to the penny.
+func round(v float64) float64 {
+	return math.Round(v*100) / 100
+}
@@ -0,0 +1,227 @@
+package syncer
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/monzo/slog"
+
+	"github.com/arussellsaw/youneedaspreadsheet/domain"
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/truelayer"
+)
+
+// DefaultTransferWindow is how far apart the two sides of a transfer between
+// a user's accounts can be, as banks don't always settle them on the same day.
+const DefaultTransferWindow = 3 * 24 * time.Hour
+
+// AccountTransactions are the transactions fetched from one of a user's
+// accounts.
+type AccountTransactions struct {
+	AccountID string
+	// Name is the account's name, which the description of a transfer
+	// from another account often includes.
+	Name         string
+	Transactions []truelayer.Transaction
+}
+
+// Transfer is money moved between two of a user's accounts, paid out of the
+// From transaction and into the To transaction.
+type Transfer struct {
+	FromAccountID     string
+	FromTransactionID string
+	ToAccountID       string
+	ToTransactionID   string
+	Amount            float64
+	Currency          string
+}
+
+// FindTransfers pairs each payment out of one of the accounts with a payment
+// of the same amount and currency into another within window of it. Amounts
+// alone match plenty of unrelated payments, so a pair also has to look like a
+// transfer: either side categorised or classified as one by the bank, or
+// both sides with the same description, or one naming the other's account. A
+// payment which could pair with more than one other is left unpaired, as
+// guessing would as likely as not pick the wrong one. Pending transactions
+// aren't paired, as they get a new ID when they settle.
+func FindTransfers(accs []AccountTransactions, window time.Duration) []Transfer {
+	type side struct {
+		acc *AccountTransactions
+		tx  *truelayer.Transaction
+		at  time.Time
+	}
+	var (
+		out []side
+		in  = make(map[string][]side)
+	)
+	for a := range accs {
+		acc := &accs[a]
+		for i := range acc.Transactions {
+			tx := &acc.Transactions[i]
+			if tx.Pending || tx.Amount == 0 {
+				continue
+			}
+			at, err := time.Parse(time.RFC3339, tx.Timestamp)
+			if err != nil {
+				continue
+			}
+			s := side{acc: acc, tx: tx, at: at}
+			if tx.Amount < 0 {
+				out = append(out, s)
+			} else {
+				key := transferKey(tx.Currency, tx.Amount)
+				in[key] = append(in[key], s)
+			}
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].at.Before(out[j].at)
+	})
+
+	var (
+		matches = make([][]side, len(out))
+		claims  = make(map[*truelayer.Transaction]int)
+	)
+	for i, from := range out {
+		for _, c := range in[transferKey(from.tx.Currency, from.tx.Amount)] {
+			if c.acc.AccountID == from.acc.AccountID {
+				continue
+			}
+			d := c.at.Sub(from.at)
+			if d < 0 {
+				d = -d
+			}
+			if d > window || !looksLikeTransfer(from.tx, c.tx, from.acc.Name, c.acc.Name) {
+				continue
+			}
+			matches[i] = append(matches[i], c)
+			claims[c.tx]++
+		}
+	}
+
+	var transfers []Transfer
+	for i, from := range out {
+		if len(matches[i]) != 1 || claims[matches[i][0].tx] != 1 {
+			continue
+		}
+		to := matches[i][0]
+		transfers = append(transfers, Transfer{
+			FromAccountID:     from.acc.AccountID,
+			FromTransactionID: from.tx.TransactionID,
+			ToAccountID:       to.acc.AccountID,
+			ToTransactionID:   to.tx.TransactionID,
+			Amount:            -from.tx.Amount,
+			Currency:          from.tx.Currency,
+		})
+	}
+	return transfers
+}
+
+// looksLikeTransfer returns true if either of two transactions of the same
+// amount is marked as a transfer by the bank, they have the same
+// description, or one's description names the other's account.
+func looksLikeTransfer(from, to *truelayer.Transaction, fromName, toName string) bool {
+	if isTransfer(from) || isTransfer(to) {
+		return true
+	}
+	fd, td := normalise(from.Description), normalise(to.Description)
+	if fd != "" && fd == td {
+		return true
+	}
+	return mentions(fd, toName) || mentions(td, fromName)
+}
+
+// isTransfer returns true if the bank says a transaction is a transfer.
+func isTransfer(tx *truelayer.Transaction) bool {
+	if strings.EqualFold(tx.TransactionCategory, "TRANSFER") || strings.EqualFold(tx.TransactionType, "TRANSFER") {
+		return true
+	}
+	for _, c := range tx.TransactionClassification {
+		if strings.HasPrefix(strings.ToLower(c), "transfer") {
+			return true
+		}
+	}
+	return false
+}
+
+// mentions returns true if a normalised description contains an account name.
+func mentions(description, account string) bool {
+	account = normalise(account)
+	return account != "" && strings.Contains(description, account)
+}
+
+// normalise lower-cases a description and collapses its whitespace, as banks
+// pad them out inconsistently.
+func normalise(s string) string {
+	return strings.Join(strings.Fields(strings.ToLower(s)), " ")
+}
+
+// transferKey matches up the two sides of a transfer by their currency and
+// amount to the penny.
+func transferKey(currency string, amount float64) string {
+	return fmt.Sprintf("%s %d", currency, int64(math.Round(math.Abs(amount)*100)))
+}
+
+// transferLabels returns what's written in the transfer column of each side of
+// the transfers, keyed by account and then transaction ID, naming the account
+// at the other end.
+func transferLabels(transfers []Transfer, accs []truelayer.AbstractAccount) map[string]map[string]string {
+	names := make(map[string]string)
+	for _, acc := range accs {
+		names[acc.ID()] = acc.Name() + " (" + acc.ProviderName() + ")"
+	}
+	labels := make(map[string]map[string]string)
+	set := func(accountID, transactionID, label string) {
+		if labels[accountID] == nil {
+			labels[accountID] = make(map[string]string)
+		}
+		labels[accountID][transactionID] = label
+	}
+	for _, t := range transfers {
+		set(t.FromAccountID, t.FromTransactionID, "To "+names[t.ToAccountID])
+		set(t.ToAccountID, t.ToTransactionID, "From "+names[t.FromAccountID])
+	}
+	return labels
+}
+
+// recordTransfers adds the IDs of an account's transactions labelled as
+// transfers to those already recorded, and returns them all. If they can't be
+// read or saved those found this time are still returned.
+func recordTransfers(ctx context.Context, userID, accountID string, labels map[string]string) []string {
+	t, err := domain.TransfersOf(ctx, userID, accountID)
+	if err != nil {
+		slog.Error(ctx, "Error getting transfers of %s: %s", accountID, err)
+		return addTransfers(nil, labels)
+	}
+	ids := addTransfers(t.TransactionIDs, labels)
+	if len(ids) == len(t.TransactionIDs) {
+		return ids
+	}
+	t.TransactionIDs = ids
+	err = domain.SaveTransfers(ctx, t)
+	if err != nil {
+		slog.Error(ctx, "Error saving transfers of %s: %s", accountID, err)
+	}
+	return ids
+}
+
+// addTransfers adds the IDs of the transactions labelled as transfers to
+// those already recorded for an account. Like the labels in its sheet, they
+// stay once found, as the other side may not be fetched again.
+func addTransfers(ids []string, labels map[string]string) []string {
+	seen := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		seen[id] = true
+	}
+	var added []string
+	for id := range labels {
+		if !seen[id] {
+			added = append(added, id)
+		}
+	}
+	sort.Strings(added)
+	return append(ids, added...)
+}
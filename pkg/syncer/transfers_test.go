@@ -0,0 +1,138 @@
+package syncer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/truelayer"
+)
+
+func TestFindTransfers(t *testing.T) {
+	at := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	tx := func(id string, amount float64, days int, description string) truelayer.Transaction {
+		return truelayer.Transaction{
+			TransactionID: id,
+			Timestamp:     at.AddDate(0, 0, days).Format(time.RFC3339),
+			Description:   description,
+			Amount:        amount,
+			Currency:      "GBP",
+		}
+	}
+	typed := func(t truelayer.Transaction) truelayer.Transaction {
+		t.TransactionCategory = "TRANSFER"
+		return t
+	}
+	classified := func(t truelayer.Transaction) truelayer.Transaction {
+		t.TransactionClassification = []string{"Transfers"}
+		return t
+	}
+
+	for _, tc := range []struct {
+		name string
+		accs []AccountTransactions
+		want map[string]string
+	}{
+		{
+			name: "categorised",
+			accs: []AccountTransactions{
+				{AccountID: "a", Transactions: []truelayer.Transaction{typed(tx("a1", -50, 0, "TFR"))}},
+				{AccountID: "b", Transactions: []truelayer.Transaction{tx("b1", 50, 1, "FROM 12345678")}},
+			},
+			want: map[string]string{"a1": "b1"},
+		},
+		{
+			name: "classified",
+			accs: []AccountTransactions{
+				{AccountID: "a", Transactions: []truelayer.Transaction{tx("a1", -50, 0, "TFR")}},
+				{AccountID: "b", Transactions: []truelayer.Transaction{classified(tx("b1", 50, 0, "FROM 12345678"))}},
+			},
+			want: map[string]string{"a1": "b1"},
+		},
+		{
+			name: "same description",
+			accs: []AccountTransactions{
+				{AccountID: "a", Transactions: []truelayer.Transaction{tx("a1", -50, 0, "MOVE  MONEY REF 42")}},
+				{AccountID: "b", Transactions: []truelayer.Transaction{tx("b1", 50, 2, "move money ref 42")}},
+			},
+			want: map[string]string{"a1": "b1"},
+		},
+		{
+			name: "names the account",
+			accs: []AccountTransactions{
+				{AccountID: "a", Name: "Current Account", Transactions: []truelayer.Transaction{tx("a1", -50, 0, "PAYMENT TO SAVINGS POT")}},
+				{AccountID: "b", Name: "Savings Pot", Transactions: []truelayer.Transaction{tx("b1", 50, 0, "INCOMING")}},
+			},
+			want: map[string]string{"a1": "b1"},
+		},
+		{
+			name: "unrelated payments of the same amount",
+			accs: []AccountTransactions{
+				{AccountID: "a", Transactions: []truelayer.Transaction{tx("a1", -50, 0, "TESCO STORES")}},
+				{AccountID: "b", Transactions: []truelayer.Transaction{tx("b1", 50, 0, "REFUND AMAZON")}},
+			},
+		},
+		{
+			name: "outside the window",
+			accs: []AccountTransactions{
+				{AccountID: "a", Transactions: []truelayer.Transaction{typed(tx("a1", -50, 0, "TFR"))}},
+				{AccountID: "b", Transactions: []truelayer.Transaction{typed(tx("b1", 50, 4, "TFR"))}},
+			},
+		},
+		{
+			name: "same account",
+			accs: []AccountTransactions{
+				{AccountID: "a", Transactions: []truelayer.Transaction{typed(tx("a1", -50, 0, "TFR")), typed(tx("a2", 50, 0, "TFR"))}},
+			},
+		},
+		{
+			name: "pending",
+			accs: []AccountTransactions{
+				{AccountID: "a", Transactions: []truelayer.Transaction{typed(tx("a1", -50, 0, "TFR"))}},
+				{AccountID: "b", Transactions: []truelayer.Transaction{func() truelayer.Transaction {
+					t := typed(tx("b1", 50, 0, "TFR"))
+					t.Pending = true
+					return t
+				}()}},
+			},
+		},
+		{
+			name: "two payments in",
+			accs: []AccountTransactions{
+				{AccountID: "a", Transactions: []truelayer.Transaction{typed(tx("a1", -50, 0, "TFR"))}},
+				{AccountID: "b", Transactions: []truelayer.Transaction{typed(tx("b1", 50, 0, "TFR"))}},
+				{AccountID: "c", Transactions: []truelayer.Transaction{typed(tx("c1", 50, 1, "TFR"))}},
+			},
+		},
+		{
+			name: "two payments out",
+			accs: []AccountTransactions{
+				{AccountID: "a", Transactions: []truelayer.Transaction{typed(tx("a1", -50, 0, "TFR")), typed(tx("a2", -50, 1, "TFR"))}},
+				{AccountID: "b", Transactions: []truelayer.Transaction{typed(tx("b1", 50, 1, "TFR"))}},
+			},
+		},
+		{
+			name: "ambiguity elsewhere",
+			accs: []AccountTransactions{
+				{AccountID: "a", Transactions: []truelayer.Transaction{typed(tx("a1", -50, 0, "TFR")), typed(tx("a2", -20, 0, "TFR"))}},
+				{AccountID: "b", Transactions: []truelayer.Transaction{typed(tx("b1", 50, 0, "TFR")), typed(tx("b2", 20, 0, "TFR"))}},
+				{AccountID: "c", Transactions: []truelayer.Transaction{typed(tx("c1", 20, 0, "TFR"))}},
+			},
+			want: map[string]string{"a1": "b1"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := make(map[string]string)
+			for _, tr := range FindTransfers(tc.accs, DefaultTransferWindow) {
+				got[tr.FromTransactionID] = tr.ToTransactionID
+			}
+			if len(got) != len(tc.want) {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+			for from, to := range tc.want {
+				if got[from] != to {
+					t.Errorf("got %v, want %v", got, tc.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,504 @@
+package syncer
+
+import (
+	"hash/fnv"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	gsheets "google.golang.org/api/sheets/v4"
+
+	"github.com/arussellsaw/youneedaspreadsheet/domain"
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/fx"
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/truelayer"
+)
+
+const (
+	statusPending = "pending"
+	statusSettled = "settled"
+)
+
+// buildUpdate merges txs into the transaction rows already in the sheet,
+// below a header row. If pendingFetched is set txs includes every pending
+// transaction the account has, so pending rows which are no longer in it have
+// settled, usually under a new ID, or been dropped, and are removed. It
+// returns the requests, every row the sheet has once they're applied, and a
+// diff describing what they change.
+func buildUpdate(txs []truelayer.Transaction, pendingFetched bool, sheet *gsheets.Sheet, w rowWriter) ([]*gsheets.Request, []*gsheets.RowData, domain.RowDiff) {
+	if len(sheet.Data) == 0 {
+		return nil, nil, domain.RowDiff{}
+	}
+	// sheets written before they had a header get one added above their
+	// rows.
+	old := sheet.Data[0].RowData
+	written := 0
+	if len(old) > 0 && isHeader(old[0]) {
+		old = old[1:]
+		written++
+	}
+	existing := make(map[string]*gsheets.RowData)
+	for _, row := range old {
+		if row == nil || len(row.Values) == 0 || row.Values[0] == nil || row.Values[0].UserEnteredValue == nil || row.Values[0].UserEnteredValue.StringValue == nil {
+			continue
+		}
+		txid := *row.Values[0].UserEnteredValue.StringValue
+		existing[txid] = row
+	}
+	written += len(existing)
+	rows := buildRows(txs, old, pendingFetched, w)
+	diff := diffRows(old, existing, rows)
+	rows = append([]*gsheets.RowData{w.to.header()}, rows...)
+
+	var reqs []*gsheets.Request
+	// a sheet needs room for any columns that have been added since it was
+	// created.
+	grid := sheet.Properties.GridProperties
+	if grid != nil && int64(len(w.to)) > grid.ColumnCount {
+		reqs = append(reqs, &gsheets.Request{
+			AppendDimension: &gsheets.AppendDimensionRequest{
+				SheetId:   sheet.Properties.SheetId,
+				Dimension: "COLUMNS",
+				Length:    int64(len(w.to)) - grid.ColumnCount,
+			},
+		})
+	}
+	if grid == nil || grid.FrozenRowCount != 1 {
+		reqs = append(reqs, &gsheets.Request{
+			UpdateSheetProperties: &gsheets.UpdateSheetPropertiesRequest{
+				Properties: &gsheets.SheetProperties{
+					SheetId:        sheet.Properties.SheetId,
+					GridProperties: &gsheets.GridProperties{FrozenRowCount: 1},
+				},
+				Fields: "gridProperties.frozenRowCount",
+			},
+		})
+	}
+	return append(reqs, replaceRows(sheet, rows, written)...), rows, diff
+}
+
+// setRows updates a sheet as it was read to have the rows an update from
+// buildUpdate wrote to it, and the columns of its layout, so it needn't be
+// read again.
+func setRows(sheet *gsheets.Sheet, rows []*gsheets.RowData, columns int) {
+	sheet.Data = []*gsheets.GridData{{RowData: rows}}
+	grid := &gsheets.GridProperties{}
+	if sheet.Properties.GridProperties != nil {
+		*grid = *sheet.Properties.GridProperties
+	}
+	if int64(columns) > grid.ColumnCount {
+		grid.ColumnCount = int64(columns)
+	}
+	if int64(len(rows)) > grid.RowCount {
+		grid.RowCount = int64(len(rows))
+	}
+	grid.FrozenRowCount = 1
+	sheet.Properties.GridProperties = grid
+}
+
+// replaceRows replaces every row in the sheet with rows, written is how many
+// rows the sheet has now. Rows beyond those are appended, so the sheet grows
+// to fit them.
+func replaceRows(sheet *gsheets.Sheet, rows []*gsheets.RowData, written int) []*gsheets.Request {
+	if len(rows) > written {
+		return []*gsheets.Request{
+			{
+				UpdateCells: &gsheets.UpdateCellsRequest{
+					Fields: "*",
+					Range: &gsheets.GridRange{
+						SheetId:          sheet.Properties.SheetId,
+						StartRowIndex:    0,
+						StartColumnIndex: 0,
+						EndColumnIndex:   0,
+						EndRowIndex:      0,
+					},
+					Rows: rows[:written],
+				},
+			},
+			{
+				AppendCells: &gsheets.AppendCellsRequest{
+					SheetId: sheet.Properties.SheetId,
+					Fields:  "*",
+					Rows:    rows[written:],
+				},
+			},
+		}
+	}
+	return []*gsheets.Request{
+		{
+			UpdateCells: &gsheets.UpdateCellsRequest{
+				Fields: "*",
+				Range: &gsheets.GridRange{
+					SheetId:          sheet.Properties.SheetId,
+					StartRowIndex:    0,
+					StartColumnIndex: 0,
+					EndColumnIndex:   0,
+					EndRowIndex:      0,
+				},
+				Rows: rows,
+			},
+		},
+	}
+}
+
+// buildRows merges the transactions with the rows already in the sheet, and
+// returns every row ordered by time.
+func buildRows(txs []truelayer.Transaction, existing []*gsheets.RowData, pendingFetched bool, w rowWriter) []*gsheets.RowData {
+	rows := []*gsheets.RowData{}
+	written := make(map[string]*gsheets.RowData)
+	for _, rd := range existing {
+		if id := rowValue(rd, 0); id != "" {
+			written[id] = rd
+		}
+	}
+	newRecs := make(map[string]struct{})
+	for _, tx := range txs {
+		tx := tx
+		newRecs[tx.TransactionID] = struct{}{}
+		rows = append(rows, w.row(&tx, written[tx.TransactionID]))
+	}
+	for _, rd := range existing {
+		if rd.Values == nil || len(rd.Values) == 0 || rd.Values[0].UserEnteredValue == nil || rd.Values[0].UserEnteredValue.StringValue == nil {
+			continue
+		}
+		if sv := rd.Values[0].UserEnteredValue.StringValue; sv != nil {
+			if _, ok := newRecs[*sv]; ok {
+				continue
+			}
+		}
+		// pending rows are dropped once the status column is, as they'd
+		// never be cleaned up.
+		if (pendingFetched || w.to.index("status") < 0) && rowStatus(rd, w.from) == statusPending {
+			continue
+		}
+		rows = append(rows, w.remap(rd))
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		return timestamp(rows[i], w.to) < timestamp(rows[j], w.to)
+	})
+	return rows
+}
+
+// rowWriter builds the rows of an account's sheet.
+type rowWriter struct {
+	// from is the layout the rows already in the sheet were written with,
+	// they're rewritten in the to layout.
+	from, to  layout
+	format    cellFormat
+	rules     rules
+	accountID string
+	// reapply applies the rules again to the rows already in the sheet.
+	reapply bool
+	// transfers labels the transactions paired with one in another of the
+	// user's accounts, keyed by transaction ID.
+	transfers map[string]string
+	// rates convert transactions into the base currency of format.
+	rates fx.Source
+}
+
+// row builds the row for a transaction. prev is its row already in the sheet,
+// if there is one, which it keeps its transfer from if the other side wasn't
+// fetched this time.
+func (w rowWriter) row(tx *truelayer.Transaction, prev *gsheets.RowData) *gsheets.RowData {
+	rec := &record{Transaction: tx, transfer: w.transfers[tx.TransactionID], rate: w.rate(tx)}
+	rec.category, rec.tags = w.rules.categorise(tx, w.accountID)
+	if rec.transfer == "" && prev != nil {
+		rec.transfer = rowValue(prev, w.from.index("transfer"))
+	}
+	return w.to.row(rec, w.format)
+}
+
+// rate returns the rate converting a transaction into the user's base
+// currency as of when it happened, nil if they don't have one or there's no
+// rate for its currency.
+func (w rowWriter) rate(tx *truelayer.Transaction) *fx.Rate {
+	if w.format.base == "" || w.rates == nil {
+		return nil
+	}
+	at, err := time.Parse(time.RFC3339, tx.Timestamp)
+	if err != nil {
+		return nil
+	}
+	currency := tx.Currency
+	if currency == "" {
+		currency = w.format.currency
+	}
+	r, err := w.rates.Rate(currency, w.format.base, at)
+	if err != nil {
+		return nil
+	}
+	return &r
+}
+
+// remap rewrites a row already in the sheet in the new layout.
+func (w rowWriter) remap(row *gsheets.RowData) *gsheets.RowData {
+	out := w.to.remap(row, w.from, w.format)
+	if !w.reapply {
+		return out
+	}
+	tx := rowTransaction(row, w.from)
+	category, tags := w.rules.categorise(&tx, w.accountID)
+	if i := w.to.index("category"); i >= 0 {
+		out.Values[i] = &gsheets.CellData{UserEnteredValue: stringValue(category)}
+	}
+	if i := w.to.index("tags"); i >= 0 {
+		out.Values[i] = &gsheets.CellData{UserEnteredValue: stringValue(strings.Join(tags, ", "))}
+	}
+	return out
+}
+
+// rowTransaction reads the fields rules match on back out of a row, as far as
+// the layout has them. Rules on fields which aren't in the sheet can't match
+// its old rows.
+func rowTransaction(row *gsheets.RowData, l layout) truelayer.Transaction {
+	tx := truelayer.Transaction{
+		TransactionID:       rowValue(row, l.index("id")),
+		Description:         rowValue(row, l.index("description")),
+		MerchantName:        rowValue(row, l.index("merchant_name")),
+		TransactionType:     rowValue(row, l.index("transaction_type")),
+		TransactionCategory: rowValue(row, l.index("transaction_category")),
+	}
+	if i := l.index("amount"); i >= 0 && i < len(row.Values) && row.Values[i] != nil && row.Values[i].UserEnteredValue != nil && row.Values[i].UserEnteredValue.NumberValue != nil {
+		tx.Amount = *row.Values[i].UserEnteredValue.NumberValue
+	}
+	return tx
+}
+
+// timestamp returns the date serial of a row, every row has been typed by the
+// time they're sorted.
+func timestamp(row *gsheets.RowData, l layout) float64 {
+	i := l.index("timestamp")
+	if i < 0 || len(row.Values) <= i || row.Values[i] == nil || row.Values[i].UserEnteredValue == nil || row.Values[i].UserEnteredValue.NumberValue == nil {
+		return 0
+	}
+	return *row.Values[i].UserEnteredValue.NumberValue
+}
+
+// rowStatus returns the status column of a transaction row, rows written
+// without one are settled.
+func rowStatus(row *gsheets.RowData, l layout) string {
+	if status := rowValue(row, l.index("status")); status != "" {
+		return status
+	}
+	return statusSettled
+}
+
+func rowValue(row *gsheets.RowData, i int) string {
+	if row == nil || i < 0 || len(row.Values) <= i || row.Values[i] == nil || row.Values[i].UserEnteredValue == nil || row.Values[i].UserEnteredValue.StringValue == nil {
+		return ""
+	}
+	return *row.Values[i].UserEnteredValue.StringValue
+}
+
+// balanceUpdate writes every account's balance to the balance sheet, archived
+// accounts with the last balance they had. If the user has a base currency
+// each current balance is converted into it too, as of when it was fetched,
+// and totalled in a row at the end.
+func balanceUpdate(accs []domain.AccountState, sheet *gsheets.Sheet, rates fx.Source, base string) *gsheets.Request {
+	rows := []*gsheets.RowData{
+		{
+			Values: []*gsheets.CellData{
+				stringCell("Account"),
+				stringCell("Currency"),
+				stringCell("Available Balance"),
+				stringCell("Current Balance"),
+				stringCell("Provider"),
+				stringCell("Last Synced"),
+				stringCell("Last Error"),
+				stringCell("Status"),
+			},
+		},
+	}
+	if base != "" {
+		rows[0].Values = append(rows[0].Values,
+			stringCell("Converted Balance ("+base+")"),
+			stringCell("FX Rate"),
+			stringCell("FX Rate Date"),
+		)
+	}
+	var (
+		f     = cellFormat{base: base}
+		total float64
+	)
+	for _, acc := range accs {
+		row := &gsheets.RowData{
+			Values: []*gsheets.CellData{stringCell(acc.Name)},
+		}
+		if b := acc.LastBalance; b != nil {
+			row.Values = append(row.Values,
+				stringCell(b.Currency),
+				numberCell(b.Available),
+				numberCell(b.Current),
+			)
+		} else {
+			row.Values = append(row.Values, stringCell(""), stringCell(""), stringCell(""))
+		}
+		row.Values = append(row.Values,
+			stringCell(acc.Provider),
+			stringCell(acc.SyncTime()),
+			stringCell(acc.LastError),
+			stringCell(acc.Status()),
+		)
+		if base != "" {
+			cells := []*gsheets.CellData{stringCell(""), stringCell(""), stringCell("")}
+			if b := acc.LastBalance; b != nil {
+				if r, err := rates.Rate(b.Currency, base, b.Updated); err == nil {
+					converted := round(r.Convert(b.Current))
+					total += converted
+					cells = []*gsheets.CellData{
+						f.cell(Column{kind: kindBaseMoney}, numberValue(converted)),
+						numberCell(r.Value),
+						dateCell(math.Floor(dateSerial(r.Date, time.UTC))),
+					}
+				}
+			}
+			row.Values = append(row.Values, cells...)
+		}
+		rows = append(rows, row)
+	}
+	if base != "" {
+		row := &gsheets.RowData{Values: []*gsheets.CellData{stringCell("Total")}}
+		for len(row.Values) < len(rows[0].Values)-3 {
+			row.Values = append(row.Values, stringCell(""))
+		}
+		row.Values = append(row.Values, f.cell(Column{kind: kindBaseMoney}, numberValue(round(total))))
+		rows = append(rows, row)
+	}
+	return &gsheets.Request{
+		UpdateCells: &gsheets.UpdateCellsRequest{
+			Fields: "*",
+			Range: &gsheets.GridRange{
+				SheetId:          sheet.Properties.SheetId,
+				StartRowIndex:    0,
+				StartColumnIndex: 0,
+				EndColumnIndex:   0,
+				EndRowIndex:      0,
+			},
+			Rows: rows,
+		},
+	}
+}
+
+func stringCell(s string) *gsheets.CellData {
+	return &gsheets.CellData{
+		UserEnteredValue: &gsheets.ExtendedValue{
+			StringValue: strPtr(s),
+		},
+	}
+}
+
+func numberCell(n float64) *gsheets.CellData {
+	return &gsheets.CellData{
+		UserEnteredValue: &gsheets.ExtendedValue{
+			NumberValue: &n,
+		},
+	}
+}
+
+// diffRows compares the rows being written to a sheet with the rows already
+// in it, which are also given keyed by transaction ID. Existing rows without a
+// transaction ID are overwritten, so they're in the diff as removed.
+func diffRows(old []*gsheets.RowData, existing map[string]*gsheets.RowData, rows []*gsheets.RowData) domain.RowDiff {
+	var diff domain.RowDiff
+	kept := make(map[string]bool)
+	for _, row := range rows {
+		txid := *row.Values[0].UserEnteredValue.StringValue
+		kept[txid] = true
+		prev, ok := existing[txid]
+		switch {
+		case !ok:
+			diff.Append = append(diff.Append, rowStrings(row))
+		case !rowsEqual(prev, row):
+			diff.Rewrite = append(diff.Rewrite, domain.RowChange{
+				Before: rowStrings(prev),
+				After:  rowStrings(row),
+			})
+		}
+	}
+	for _, row := range old {
+		values := rowStrings(row)
+		if len(values) == 0 {
+			continue
+		}
+		if kept[values[0]] {
+			continue
+		}
+		diff.Remove = append(diff.Remove, values)
+	}
+	return diff
+}
+
+// rowStrings returns a row's values as strings, without trailing empty cells.
+func rowStrings(row *gsheets.RowData) []string {
+	if row == nil {
+		return nil
+	}
+	var out []string
+	for _, c := range row.Values {
+		var v string
+		if c != nil && c.UserEnteredValue != nil {
+			switch ev := c.UserEnteredValue; {
+			case ev.StringValue != nil:
+				v = *ev.StringValue
+			case ev.NumberValue != nil:
+				v = strconv.FormatFloat(*ev.NumberValue, 'f', -1, 64)
+			case ev.BoolValue != nil:
+				v = strconv.FormatBool(*ev.BoolValue)
+			case ev.FormulaValue != nil:
+				v = *ev.FormulaValue
+			}
+		}
+		out = append(out, v)
+	}
+	for len(out) > 0 && out[len(out)-1] == "" {
+		out = out[:len(out)-1]
+	}
+	return out
+}
+
+// rowsEqual compares the values of two rows, trailing empty cells aren't
+// returned by the API so they're ignored.
+func rowsEqual(a, b *gsheets.RowData) bool {
+	n := len(a.Values)
+	if len(b.Values) > n {
+		n = len(b.Values)
+	}
+	for i := 0; i < n; i++ {
+		var ac, bc *gsheets.CellData
+		if i < len(a.Values) {
+			ac = a.Values[i]
+		}
+		if i < len(b.Values) {
+			bc = b.Values[i]
+		}
+		if cellValue(ac) != cellValue(bc) {
+			return false
+		}
+	}
+	return true
+}
+
+func cellValue(c *gsheets.CellData) string {
+	if c == nil || c.UserEnteredValue == nil {
+		return ""
+	}
+	buf, _ := c.UserEnteredValue.MarshalJSON()
+	if string(buf) == "{}" {
+		return ""
+	}
+	return string(buf)
+}
+
+func sheetID(id string) int64 {
+	h := fnv.New32()
+	h.Write([]byte(id))
+	return int64(h.Sum32())
+}
+
+func strPtr(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
@@ -0,0 +1,197 @@
+package token
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/monzo/slog"
+	"github.com/pkg/errors"
+
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/idgen"
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/secret"
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/store"
+)
+
+const rotationsCollection = "banksheets#key-rotations"
+
+// checkpointEvery is how many tokens are processed between saving progress,
+// tokens skipped when resuming don't count.
+const checkpointEvery = 20
+
+// RotationRun records a pass over all stored tokens re-encrypting them with the
+// primary key, runs are kept as evidence that rotation happens.
+type RotationRun struct {
+	ID          string
+	DryRun      bool
+	KeyName     string
+	Started     time.Time
+	Updated     time.Time
+	Finished    time.Time
+	LastTokenID string
+	Total       int
+	Rotated     int
+	Current     int
+	Failed      int
+	Errors      []string
+}
+
+type RotateOptions struct {
+	// DryRun reports which tokens would be rotated without writing anything.
+	DryRun bool
+	// Resume continues the most recent unfinished run rather than starting a
+	// new one.
+	Resume bool
+	// Progress is called after every token.
+	Progress func(*RotationRun)
+}
+
+// Rotate decrypts every stored token that isn't encrypted with the primary
+// key and re-encrypts it with the primary key.
+func Rotate(ctx context.Context, opts RotateOptions) (*RotationRun, error) {
+	s, err := store.FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	keyName, err := secret.PrimaryKeyName(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting primary key")
+	}
+
+	var run *RotationRun
+	if opts.Resume && !opts.DryRun {
+		run, err = lastUnfinishedRotation(ctx, s)
+		if err != nil {
+			return nil, err
+		}
+		if run != nil && run.KeyName != keyName {
+			slog.Warn(ctx, "primary key changed from %s to %s, starting a new rotation", run.KeyName, keyName)
+			run = nil
+		}
+	}
+	if run == nil {
+		run = &RotationRun{
+			ID:      idgen.New("rot"),
+			DryRun:  opts.DryRun,
+			KeyName: keyName,
+			Started: time.Now(),
+		}
+	} else {
+		slog.Info(ctx, "resuming rotation %s after token %s", run.ID, run.LastTokenID)
+	}
+
+	var sts []StoredToken
+	err = s.Query(ctx, collection, store.Query{}.Order("ID", false), &sts)
+	if err != nil {
+		return nil, errors.Wrap(err, "listing tokens")
+	}
+	run.Total = len(sts)
+
+	processed := 0
+	for _, st := range sts {
+		if st.ID <= run.LastTokenID {
+			continue
+		}
+		err := rotateToken(ctx, s, &st, keyName, opts.DryRun)
+		switch {
+		case err == errAlreadyRotated:
+			run.Current++
+		case err == store.ErrNotFound:
+			// deleted since it was listed, so there's nothing to rotate
+			slog.Info(ctx, "token %s was deleted during rotation", st.ID)
+		case err != nil:
+			run.Failed++
+			run.Errors = append(run.Errors, fmt.Sprintf("%s: %s", st.ID, err))
+			slog.Error(ctx, "error rotating token %s: %s", st.ID, err)
+		default:
+			run.Rotated++
+		}
+		run.LastTokenID = st.ID
+		run.Updated = time.Now()
+		processed++
+
+		if opts.Progress != nil {
+			opts.Progress(run)
+		}
+		if !opts.DryRun && processed%checkpointEvery == 0 {
+			err = s.Set(ctx, rotationsCollection, run.ID, run)
+			if err != nil {
+				return run, errors.Wrap(err, "saving rotation checkpoint")
+			}
+		}
+	}
+
+	run.Finished = time.Now()
+	if !opts.DryRun {
+		err = s.Set(ctx, rotationsCollection, run.ID, run)
+		if err != nil {
+			return run, errors.Wrap(err, "saving rotation")
+		}
+	}
+	slog.Info(ctx, "rotation %s finished: %d rotated, %d current, %d failed", run.ID, run.Rotated, run.Current, run.Failed)
+	return run, nil
+}
+
+// ListRotations returns all rotation runs, most recent first.
+func ListRotations(ctx context.Context) ([]RotationRun, error) {
+	s, err := store.FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var runs []RotationRun
+	err = s.Query(ctx, rotationsCollection, store.Query{}.Order("Started", true), &runs)
+	return runs, err
+}
+
+var errAlreadyRotated = errors.New("token is encrypted with the primary key")
+
+// rotateToken re-encrypts a token with the primary key. It's re-read and
+// written back in one update, as the token may have been refreshed since the
+// run listed it, and writing back what was listed would lose the refresh.
+func rotateToken(ctx context.Context, s store.Store, st *StoredToken, keyName string, dryRun bool) error {
+	if st.KeyName == keyName {
+		return errAlreadyRotated
+	}
+	if dryRun {
+		_, err := secret.Decrypt(ctx, st.EncryptedToken, st.KeyName)
+		if err != nil {
+			return errors.Wrap(err, "decrypting token")
+		}
+		return nil
+	}
+	var fresh StoredToken
+	return s.Update(ctx, collection, st.ID, &fresh, func() error {
+		if fresh.KeyName == keyName {
+			return errAlreadyRotated
+		}
+		buf, err := secret.Decrypt(ctx, fresh.EncryptedToken, fresh.KeyName)
+		if err != nil {
+			return errors.Wrap(err, "decrypting token")
+		}
+		ciphertext, newKeyName, err := secret.Encrypt(ctx, buf)
+		if err != nil {
+			return errors.Wrap(err, "encrypting token")
+		}
+		fresh.EncryptedToken = ciphertext
+		fresh.KeyName = newKeyName
+		fresh.EncryptedAt = time.Now()
+		return nil
+	})
+}
+
+func lastUnfinishedRotation(ctx context.Context, s store.Store) (*RotationRun, error) {
+	runs, err := ListRotations(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "listing rotations")
+	}
+	for _, run := range runs {
+		if run.DryRun {
+			continue
+		}
+		if run.Finished.IsZero() {
+			return &run, nil
+		}
+		return nil, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,224 @@
+package token
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"golang.org/x/oauth2"
+
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/idgen"
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/secret"
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/store"
+)
+
+// checkpointStore records every rotation checkpoint, and fails the one at
+// failAt to stand in for the command being killed part way through.
+type checkpointStore struct {
+	store.Store
+	failAt      int
+	checkpoints []RotationRun
+}
+
+func (s *checkpointStore) Set(ctx context.Context, collection, id string, v interface{}) error {
+	if run, ok := v.(*RotationRun); ok && collection == rotationsCollection {
+		if len(s.checkpoints)+1 == s.failAt {
+			return errors.New("killed")
+		}
+		s.checkpoints = append(s.checkpoints, *run)
+	}
+	return s.Store.Set(ctx, collection, id, v)
+}
+
+func setKeys(t *testing.T, primary string) {
+	t.Helper()
+	k, err := secret.NewLocalKeyring(map[string][]byte{
+		"1": bytes.Repeat([]byte{1}, 32),
+		"2": bytes.Repeat([]byte{2}, 32),
+	}, primary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret.SetPrimary(k)
+}
+
+func setTokens(t *testing.T, ctx context.Context, from, to int) {
+	t.Helper()
+	for i := from; i < to; i++ {
+		id := fmt.Sprintf("tok_%03d", i)
+		err := Set(ctx, id, "usr_1", "truelayer", &oauth2.Config{}, &oauth2.Token{AccessToken: "access-" + id, RefreshToken: "refresh-" + id})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// checkTokens checks every token is encrypted with the primary key and
+// still decrypts to what was stored.
+func checkTokens(t *testing.T, ctx context.Context, keyName string) {
+	t.Helper()
+	s, _ := store.FromContext(ctx)
+	var sts []StoredToken
+	if err := s.Query(ctx, collection, store.Query{}, &sts); err != nil {
+		t.Fatal(err)
+	}
+	for _, st := range sts {
+		if st.KeyName != keyName {
+			t.Errorf("%s: got key %s, want %s", st.ID, st.KeyName, keyName)
+		}
+		tok, _, err := doGet(ctx, nil, st.ID)
+		if err != nil {
+			t.Errorf("%s: %s", st.ID, err)
+			continue
+		}
+		if tok.AccessToken != "access-"+st.ID || tok.RefreshToken != "refresh-"+st.ID {
+			t.Errorf("%s: got %+v", st.ID, tok)
+		}
+	}
+}
+
+func TestRotate(t *testing.T) {
+	idgen.Init(context.Background())
+	ctx := store.WithStore(context.Background(), store.NewMemory())
+	setKeys(t, "1")
+	setTokens(t, ctx, 0, 5)
+	setKeys(t, "2")
+
+	dry, err := Rotate(ctx, RotateOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dry.Rotated != 5 || dry.Current != 0 {
+		t.Errorf("dry run: got %d rotated, %d current", dry.Rotated, dry.Current)
+	}
+	checkTokens(t, ctx, "local:1")
+
+	run, err := Rotate(ctx, RotateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run.Rotated != 5 || run.Current != 0 || run.Failed != 0 || run.Finished.IsZero() {
+		t.Errorf("got %+v", run)
+	}
+	checkTokens(t, ctx, "local:2")
+
+	again, err := Rotate(ctx, RotateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Rotated != 0 || again.Current != 5 {
+		t.Errorf("second run: got %d rotated, %d current", again.Rotated, again.Current)
+	}
+
+	runs, err := ListRotations(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 2 || runs[0].ID != again.ID {
+		t.Errorf("got %d runs, want the two which weren't dry runs, latest first", len(runs))
+	}
+}
+
+func TestRotateResume(t *testing.T) {
+	idgen.Init(context.Background())
+	s := &checkpointStore{Store: store.NewMemory(), failAt: 2}
+	ctx := store.WithStore(context.Background(), s)
+	setKeys(t, "1")
+	setTokens(t, ctx, 10, 60)
+	setKeys(t, "2")
+
+	// the first checkpoint is saved after tok_029, the run is killed
+	// saving the second after tok_049
+	first, err := Rotate(ctx, RotateOptions{})
+	if err == nil {
+		t.Fatal("expected the run to fail saving its second checkpoint")
+	}
+	if len(s.checkpoints) != 1 || s.checkpoints[0].LastTokenID != "tok_029" {
+		t.Fatalf("got checkpoints %+v, want one after tok_029", s.checkpoints)
+	}
+
+	// tokens added since sort before the checkpoint, and are skipped
+	setTokens(t, ctx, 0, 5)
+	s.failAt = 0
+	s.checkpoints = nil
+	resumed, err := Rotate(ctx, RotateOptions{Resume: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resumed.ID != first.ID {
+		t.Errorf("got run %s, want %s resumed", resumed.ID, first.ID)
+	}
+	// 20 tokens after the checkpoint are processed before the next one,
+	// however many were skipped
+	if len(s.checkpoints) != 2 || s.checkpoints[0].LastTokenID != "tok_049" {
+		t.Errorf("got checkpoints %+v, want one after tok_049 and the finished run", s.checkpoints)
+	}
+	// tok_030 to tok_049 were rotated by the killed run after its
+	// checkpoint
+	if resumed.Rotated != 30 || resumed.Current != 20 || resumed.Failed != 0 {
+		t.Errorf("got %d rotated, %d current, %d failed", resumed.Rotated, resumed.Current, resumed.Failed)
+	}
+	if resumed.LastTokenID != "tok_059" || resumed.Finished.IsZero() {
+		t.Errorf("got %+v", resumed)
+	}
+	checkTokens(t, ctx, "local:2")
+
+	// a finished run isn't resumed
+	next, err := Rotate(ctx, RotateOptions{Resume: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.ID == first.ID || next.Current != 55 {
+		t.Errorf("got %+v, want a new run with every token current", next)
+	}
+}
+
+// refreshingStore refreshes a token, as a sync would, just after the
+// rotation lists the tokens.
+type refreshingStore struct {
+	store.Store
+	refresh func(ctx context.Context)
+}
+
+func (s *refreshingStore) Query(ctx context.Context, collection string, q store.Query, dst interface{}) error {
+	err := s.Store.Query(ctx, collection, q, dst)
+	if _, ok := dst.(*[]StoredToken); ok && s.refresh != nil {
+		s.refresh(ctx)
+		s.refresh = nil
+	}
+	return err
+}
+
+func TestRotateKeepsRefresh(t *testing.T) {
+	idgen.Init(context.Background())
+	s := &refreshingStore{Store: store.NewMemory()}
+	ctx := store.WithStore(context.Background(), s)
+	setKeys(t, "1")
+	setTokens(t, ctx, 0, 3)
+	setKeys(t, "2")
+	refreshed := &oauth2.Token{AccessToken: "access-new", RefreshToken: "refresh-new"}
+	s.refresh = func(ctx context.Context) {
+		err := Set(ctx, "tok_001", "usr_1", "truelayer", &oauth2.Config{}, refreshed)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	run, err := Rotate(ctx, RotateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the refresh encrypted it with the primary key already
+	if run.Rotated != 2 || run.Current != 1 || run.Failed != 0 {
+		t.Errorf("got %d rotated, %d current, %d failed", run.Rotated, run.Current, run.Failed)
+	}
+	tok, st, err := doGet(ctx, nil, "tok_001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.AccessToken != refreshed.AccessToken || tok.RefreshToken != refreshed.RefreshToken || st.KeyName != "local:2" {
+		t.Errorf("the refresh was lost: got %+v with key %s", tok, st.KeyName)
+	}
+}
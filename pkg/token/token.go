@@ -4,12 +4,13 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"sort"
+	"time"
 
 	"github.com/pkg/errors"
 	"golang.org/x/oauth2"
 
 	"github.com/monzo/slog"
-	"google.golang.org/grpc"
 
 	"github.com/arussellsaw/youneedaspreadsheet/pkg/secret"
 	"github.com/arussellsaw/youneedaspreadsheet/pkg/store"
@@ -30,7 +31,7 @@ func Set(ctx context.Context, id, owner, kind string, config *oauth2.Config, tok
 	if token.RefreshToken == "" {
 		token.RefreshToken = refreshToken
 	}
-	fs, err := store.FromContext(ctx)
+	s, err := store.FromContext(ctx)
 	if err != nil {
 		return err
 	}
@@ -49,9 +50,10 @@ func Set(ctx context.Context, id, owner, kind string, config *oauth2.Config, tok
 		Kind:           kind,
 		KeyName:        keyName,
 		EncryptedToken: ciphertext,
+		EncryptedAt:    time.Now(),
 	}
 
-	_, err = fs.Collection(collection).Doc(t.ID).Set(ctx, t)
+	err = s.Set(ctx, collection, t.ID, t)
 	if err != nil {
 		return err
 	}
@@ -60,18 +62,14 @@ func Set(ctx context.Context, id, owner, kind string, config *oauth2.Config, tok
 }
 
 func doGet(ctx context.Context, config *oauth2.Config, id string) (*oauth2.Token, *StoredToken, error) {
-	fs, err := store.FromContext(ctx)
+	s, err := store.FromContext(ctx)
 	if err != nil {
 		return nil, nil, err
 	}
 
 	st := StoredToken{}
 
-	doc, err := fs.Collection(collection).Doc(id).Get(ctx)
-	if err != nil {
-		return nil, nil, err
-	}
-	err = doc.DataTo(&st)
+	err = s.Get(ctx, collection, id, &st)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -112,39 +110,37 @@ func Get(ctx context.Context, config *oauth2.Config, id string) (*oauth2.Token,
 	return token, nil
 }
 
-func ListByUser(ctx context.Context, userID, kind string, config *oauth2.Config) ([]*oauth2.Token, error) {
-	fs, err := store.FromContext(ctx)
+// Token is a decrypted token and the ID it's stored under.
+type Token struct {
+	ID string
+	*oauth2.Token
+}
+
+func ListByUser(ctx context.Context, userID, kind string, config *oauth2.Config) ([]Token, error) {
+	s, err := store.FromContext(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	var tokens []*oauth2.Token
+	var tokens []Token
 	// maybe get old style token
 	t, err := Get(ctx, config, LegacyTokenID(userID, config))
 	if err == nil {
-		tokens = append(tokens, t)
+		tokens = append(tokens, Token{ID: LegacyTokenID(userID, config), Token: t})
 	}
 
-	docs, err := fs.Collection(collection).
-		Where("OwnerID", "==", userID).
-		Where("Kind", "==", kind).Documents(ctx).GetAll()
+	var sts []StoredToken
+	err = s.Query(ctx, collection, store.Where("OwnerID", userID).Where("Kind", kind), &sts)
 	if err != nil {
-		slog.Error(ctx, "code: %s", grpc.Code(err))
+		slog.Error(ctx, "error listing tokens: %s", err)
 		return nil, err
 	}
-	var errs []error
-	for _, doc := range docs {
-		st := StoredToken{}
-		err = doc.DataTo(&st)
-		if err != nil {
-			errs = append(errs, errors.Wrap(err, "unmarshaling token"))
-			continue
-		}
-
+	errs := LoadErrors{}
+	for _, st := range sts {
 		t := oauth2.Token{}
 		buf, err := secret.Decrypt(ctx, st.EncryptedToken, st.KeyName)
 		if err != nil {
-			errs = append(errs, errors.Wrap(err, "decrypting token"))
+			errs[st.ID] = errors.Wrap(err, "decrypting token")
 			continue
 		}
 		err = json.Unmarshal(buf, &t)
@@ -156,7 +152,7 @@ func ListByUser(ctx context.Context, userID, kind string, config *oauth2.Config)
 
 		token, err := src.Token()
 		if err != nil {
-			errs = append(errs, errors.Wrap(err, "getting/refreshing token"))
+			errs[st.ID] = errors.Wrap(err, "getting/refreshing token")
 			continue
 		}
 		// token was refreshed, let's store the new access token
@@ -164,24 +160,33 @@ func ListByUser(ctx context.Context, userID, kind string, config *oauth2.Config)
 			slog.Info(ctx, "Access token was refreshed, setting new token %s", st.ID)
 			err = Set(ctx, st.ID, st.OwnerID, st.Kind, config, token)
 			if err != nil {
-				errs = append(errs, errors.Wrap(err, "storing updated token"))
+				errs[st.ID] = errors.Wrap(err, "storing updated token")
 				continue
 			}
 		}
-		tokens = append(tokens, token)
+		tokens = append(tokens, Token{ID: st.ID, Token: token})
 	}
-	return tokens, joinErrors(errs...)
+	if len(errs) > 0 {
+		return tokens, errs
+	}
+	return tokens, nil
 }
 
-func joinErrors(errs ...error) error {
-	if len(errs) == 0 {
-		return nil
+// LoadErrors are the tokens ListByUser couldn't load, by token ID. The tokens
+// it could load are still returned alongside it.
+type LoadErrors map[string]error
+
+func (e LoadErrors) Error() string {
+	ids := make([]string, 0, len(e))
+	for id := range e {
+		ids = append(ids, id)
 	}
+	sort.Strings(ids)
 	var out string
-	for _, err := range errs {
-		out += err.Error() + ", "
+	for _, id := range ids {
+		out += id + ": " + e[id].Error() + ", "
 	}
-	return errors.New(out)
+	return out
 }
 
 type StoredToken struct {
@@ -190,6 +195,7 @@ type StoredToken struct {
 	Kind           string
 	KeyName        string
 	EncryptedToken string
+	EncryptedAt    time.Time
 }
 
 func LegacyTokenID(id string, config *oauth2.Config) string {
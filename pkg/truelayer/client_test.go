@@ -0,0 +1,224 @@
+package truelayer_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/truelayer"
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/truelayer/truelayertest"
+)
+
+// fastRetries makes retries quick for the test, restoring the defaults after.
+func fastRetries(t *testing.T, maxDelay time.Duration) {
+	base, max, rps := truelayer.RetryBaseDelay, truelayer.RetryMaxDelay, truelayer.RequestsPerSecond
+	t.Cleanup(func() {
+		truelayer.RetryBaseDelay, truelayer.RetryMaxDelay, truelayer.RequestsPerSecond = base, max, rps
+	})
+	truelayer.RetryBaseDelay = time.Millisecond
+	truelayer.RetryMaxDelay = maxDelay
+	truelayer.RequestsPerSecond = 1000
+}
+
+// newFake returns a fake with one account holding a transaction every 10 days
+// for the last 300 days.
+func newFake(t *testing.T, now time.Time) (*truelayertest.Server, []truelayer.Transaction) {
+	fake := truelayertest.NewServer()
+	t.Cleanup(fake.Close)
+	var txs []truelayer.Transaction
+	for d := 300; d > 0; d -= 10 {
+		txs = append(txs, truelayer.Transaction{
+			TransactionID: fmt.Sprintf("tx-%03d", d),
+			Timestamp:     now.AddDate(0, 0, -d).UTC().Format(time.RFC3339),
+			Description:   "TESCO STORES",
+			Amount:        -float64(d),
+			Currency:      "GBP",
+		})
+	}
+	fake.AddConnection("token", &truelayertest.Connection{
+		Accounts:     []truelayer.Account{{AccountID: "acc", DisplayName: "Current Account", Currency: "GBP"}},
+		Transactions: map[string][]truelayer.Transaction{"acc": txs},
+	})
+	return fake, txs
+}
+
+func transactionRequests(fake *truelayertest.Server) []string {
+	var out []string
+	for _, r := range fake.Requests() {
+		if strings.HasPrefix(r, "/data/v1/accounts/acc/transactions?") {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+func checkTransactions(t *testing.T, got, want []truelayer.Transaction) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d transactions, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].TransactionID != want[i].TransactionID {
+			t.Errorf("transaction %d is %s, want %s", i, got[i].TransactionID, want[i].TransactionID)
+		}
+	}
+}
+
+func TestTransactionsSincePages(t *testing.T) {
+	fastRetries(t, time.Second)
+	ctx := context.Background()
+	now := time.Now()
+	fake, txs := newFake(t, now)
+	c := fake.Client("usr", "token")
+
+	got, err := c.TransactionsSince(ctx, "accounts", "acc", now.AddDate(0, 0, -305))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTransactions(t, got, txs)
+	// 305 days is 4 windows of at most 87
+	if reqs := transactionRequests(fake); len(reqs) != 4 {
+		t.Errorf("got %d requests, want 4: %v", len(reqs), reqs)
+	}
+
+	got, err = c.TransactionsSince(ctx, "accounts", "acc", now.AddDate(0, 0, -25))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTransactions(t, got, txs[len(txs)-2:])
+}
+
+func TestTransactionsHistoric(t *testing.T) {
+	fastRetries(t, time.Second)
+	ctx := context.Background()
+	now := time.Now()
+	fake, txs := newFake(t, now)
+	c := fake.Client("usr", "token")
+
+	got, err := c.Transactions(ctx, "accounts", "acc", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTransactions(t, got, txs[len(txs)-8:])
+
+	got, err = c.Transactions(ctx, "accounts", "acc", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTransactions(t, got, txs)
+	// one window past the oldest transaction comes back empty and stops it
+	if reqs := transactionRequests(fake); len(reqs) != 1+5 {
+		t.Errorf("got %d requests, want 6: %v", len(reqs), reqs)
+	}
+}
+
+func TestErrorMapping(t *testing.T) {
+	fastRetries(t, time.Second)
+	ctx := context.Background()
+	fake, _ := newFake(t, time.Now())
+
+	fake.ExpireToken("token")
+	_, err := fake.Client("usr", "token").Accounts(ctx)
+	if !truelayer.IsUnauthorized(err) {
+		t.Errorf("expired token: got %v, want unauthorized", err)
+	}
+	if truelayer.IsNotImplemented(err) {
+		t.Errorf("expired token: %v is not implemented", err)
+	}
+
+	fake, _ = newFake(t, time.Now())
+	c := fake.Client("usr", "token")
+	fake.Fail("/data/v1/cards", truelayertest.Failure{Status: http.StatusNotImplemented, Error: "not_implemented"})
+	_, err = c.Cards(ctx)
+	if !truelayer.IsNotImplemented(err) || truelayer.IsUnauthorized(err) {
+		t.Errorf("501: got %v, want not implemented", err)
+	}
+	fake.Fail("/data/v1/accounts/acc/transactions/pending", truelayertest.Failure{Status: http.StatusBadRequest, Error: "endpoint_not_supported"})
+	_, err = c.PendingTransactions(ctx, "accounts", "acc")
+	if !truelayer.IsNotImplemented(err) {
+		t.Errorf("endpoint_not_supported: got %v, want not implemented", err)
+	}
+	if reqs := fake.Requests(); len(reqs) != 2 {
+		t.Errorf("errors which aren't temporary were retried: %v", reqs)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	for _, status := range []int{http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusServiceUnavailable} {
+		t.Run(http.StatusText(status), func(t *testing.T) {
+			fastRetries(t, time.Second)
+			ctx := context.Background()
+			fake, _ := newFake(t, time.Now())
+			fake.Fail("/data/v1/accounts", truelayertest.Failure{Status: status, Times: 2})
+
+			as, err := fake.Client("usr", "token").Accounts(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(as) != 1 {
+				t.Errorf("got %d accounts, want 1", len(as))
+			}
+			if reqs := fake.Requests(); len(reqs) != 3 {
+				t.Errorf("got %d requests, want 3", len(reqs))
+			}
+		})
+	}
+}
+
+func TestRetriesGiveUp(t *testing.T) {
+	fastRetries(t, time.Second)
+	ctx := context.Background()
+	fake, _ := newFake(t, time.Now())
+	fake.Fail("/data/v1/accounts", truelayertest.Failure{Status: http.StatusBadGateway})
+
+	_, err := fake.Client("usr", "token").Accounts(ctx)
+	tlErr, ok := err.(*truelayer.Error)
+	if !ok || tlErr.StatusCode != http.StatusBadGateway {
+		t.Fatalf("got %v, want a 502", err)
+	}
+	if reqs := fake.Requests(); len(reqs) != 1+truelayer.MaxRetries {
+		t.Errorf("got %d requests, want %d", len(reqs), 1+truelayer.MaxRetries)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	fastRetries(t, 2*time.Second)
+	ctx := context.Background()
+	fake, _ := newFake(t, time.Now())
+	fake.Fail("/data/v1/accounts", truelayertest.Failure{Status: http.StatusTooManyRequests, RetryAfter: "1", Times: 1})
+
+	start := time.Now()
+	_, err := fake.Client("usr", "token").Accounts(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < time.Second {
+		t.Errorf("retried after %s, want at least the 1s asked for", d)
+	}
+	if reqs := fake.Requests(); len(reqs) != 2 {
+		t.Errorf("got %d requests, want 2", len(reqs))
+	}
+}
+
+func TestRetryAfterTooLong(t *testing.T) {
+	fastRetries(t, time.Second)
+	ctx := context.Background()
+	fake, _ := newFake(t, time.Now())
+	fake.Fail("/data/v1/accounts", truelayertest.Failure{Status: http.StatusTooManyRequests, RetryAfter: "3600", Times: 1})
+
+	start := time.Now()
+	_, err := fake.Client("usr", "token").Accounts(ctx)
+	tlErr, ok := err.(*truelayer.Error)
+	if !ok || tlErr.StatusCode != http.StatusTooManyRequests || tlErr.RetryAfter != time.Hour {
+		t.Fatalf("got %v, want a 429 asking for an hour", err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("took %s to give up", d)
+	}
+	if reqs := fake.Requests(); len(reqs) != 1 {
+		t.Errorf("got %d requests, want 1", len(reqs))
+	}
+}
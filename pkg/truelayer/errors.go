@@ -0,0 +1,51 @@
+package truelayer
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Error is an error response from TrueLayer.
+type Error struct {
+	StatusCode  int                    `json:"-"`
+	Code        string                 `json:"error"`
+	Description string                 `json:"error_description"`
+	Details     map[string]interface{} `json:"error_details"`
+	// RetryAfter is how long TrueLayer asked us to wait before trying again,
+	// from the Retry-After header.
+	RetryAfter time.Duration `json:"-"`
+}
+
+func (e *Error) Error() string {
+	code := e.Code
+	if code == "" {
+		code = http.StatusText(e.StatusCode)
+	}
+	if e.Description == "" {
+		return fmt.Sprintf("truelayer: %d %s", e.StatusCode, code)
+	}
+	return fmt.Sprintf("truelayer: %d %s: %s", e.StatusCode, code, e.Description)
+}
+
+// Temporary returns true for rate limiting and server errors, which are worth
+// retrying. A 501 is the provider not supporting the endpoint, which won't
+// change by asking again.
+func (e *Error) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || (e.StatusCode >= 500 && e.StatusCode != http.StatusNotImplemented)
+}
+
+// IsUnauthorized returns true if err is TrueLayer rejecting the access token,
+// the user needs to reconnect the account.
+func IsUnauthorized(err error) bool {
+	var tlErr *Error
+	return errors.As(err, &tlErr) && tlErr.StatusCode == http.StatusUnauthorized
+}
+
+// IsNotImplemented returns true if err is the provider not supporting an
+// endpoint, like cards or pending transactions for some banks.
+func IsNotImplemented(err error) bool {
+	var tlErr *Error
+	return errors.As(err, &tlErr) && (tlErr.StatusCode == http.StatusNotImplemented || tlErr.Code == "endpoint_not_supported")
+}
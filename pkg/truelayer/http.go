@@ -0,0 +1,158 @@
+package truelayer
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/monzo/slog"
+	"github.com/pkg/errors"
+)
+
+var (
+	// MaxRetries is how many times a request which is rate limited or fails
+	// with a server error is retried.
+	MaxRetries = 4
+	// RetryBaseDelay and RetryMaxDelay bound the exponential backoff between
+	// retries, a Retry-After from TrueLayer takes precedence. A Retry-After
+	// longer than RetryMaxDelay isn't waited for, the request fails so the
+	// sync can move on.
+	RetryBaseDelay = 500 * time.Millisecond
+	RetryMaxDelay  = 30 * time.Second
+	// RequestsPerSecond limits each client, and the unauthenticated Providers
+	// call, so one user's sync can't use up our quota.
+	RequestsPerSecond = 5.0
+)
+
+var providersLimiter = newLimiter(RequestsPerSecond)
+
+// get requests url, retrying temporary failures, and decodes the JSON response
+// into v. Error responses are returned as an *Error.
+func get(ctx context.Context, hc *http.Client, l *limiter, url string, auth func(*http.Request), v interface{}) error {
+	for attempt := 0; ; attempt++ {
+		err := l.Wait(ctx)
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		if auth != nil {
+			auth(req)
+		}
+		err = do(hc, req, v)
+		var tlErr *Error
+		if !errors.As(err, &tlErr) || !tlErr.Temporary() || attempt >= MaxRetries {
+			return err
+		}
+		if tlErr.RetryAfter > RetryMaxDelay {
+			return err
+		}
+		wait := backoff(attempt)
+		if tlErr.RetryAfter > 0 {
+			wait = tlErr.RetryAfter
+		}
+		slog.Warn(ctx, "truelayer request to %s failed, retrying in %s: %s", req.URL.Path, wait, err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func do(hc *http.Client, req *http.Request, v interface{}) error {
+	res, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return readError(res)
+	}
+	err = json.NewDecoder(res.Body).Decode(v)
+	if err != nil {
+		return errors.Wrapf(err, "decoding %s", req.URL.Path)
+	}
+	return nil
+}
+
+func readError(res *http.Response) error {
+	tlErr := &Error{
+		StatusCode: res.StatusCode,
+		RetryAfter: retryAfter(res.Header.Get("Retry-After")),
+	}
+	buf, _ := ioutil.ReadAll(io.LimitReader(res.Body, 64<<10))
+	if json.Unmarshal(buf, tlErr) != nil && len(buf) > 0 {
+		tlErr.Description = string(buf)
+	}
+	return tlErr
+}
+
+// retryAfter parses a Retry-After header, which is either a number of seconds
+// or a date.
+func retryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+// backoff returns an exponential delay with full jitter for the given attempt.
+func backoff(attempt int) time.Duration {
+	d := RetryBaseDelay << uint(attempt)
+	if d > RetryMaxDelay || d <= 0 {
+		d = RetryMaxDelay
+	}
+	return time.Duration(rand.Int63n(int64(d)) + 1)
+}
+
+// limiter spaces requests out evenly to a maximum rate.
+type limiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func newLimiter(perSecond float64) *limiter {
+	l := &limiter{}
+	if perSecond > 0 {
+		l.interval = time.Duration(float64(time.Second) / perSecond)
+	}
+	return l
+}
+
+// Wait blocks until the next request is allowed.
+func (l *limiter) Wait(ctx context.Context) error {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	wait := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	l.mu.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+	select {
+	case <-time.After(wait):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
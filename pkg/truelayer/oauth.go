@@ -6,14 +6,14 @@ import (
 	"os"
 	"time"
 
-	"cloud.google.com/go/pubsub"
-
 	"github.com/gorilla/mux"
 	"github.com/monzo/slog"
 	"golang.org/x/oauth2"
 
+	"github.com/arussellsaw/youneedaspreadsheet/domain"
 	"github.com/arussellsaw/youneedaspreadsheet/pkg/authn"
 	"github.com/arussellsaw/youneedaspreadsheet/pkg/idgen"
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/queue"
 	"github.com/arussellsaw/youneedaspreadsheet/pkg/token"
 	"github.com/arussellsaw/youneedaspreadsheet/pkg/util"
 )
@@ -22,10 +22,18 @@ var (
 	OauthConfig *oauth2.Config
 )
 
-func Init(ctx context.Context, m *mux.Router) error {
+func Init(ctx context.Context, m *mux.Router, c Config) error {
 	m.HandleFunc("/api/truelayer/oauth/login", oauthLogin)
 	m.HandleFunc("/api/truelayer/oauth/redirect", oauthCallback)
 
+	if c.APIBaseURL == "" {
+		c.APIBaseURL = defaultAPIBaseURL
+	}
+	if c.AuthBaseURL == "" {
+		c.AuthBaseURL = defaultAuthBaseURL
+	}
+	config = c
+
 	OauthConfig = &oauth2.Config{
 		RedirectURL:  util.BaseURL() + "/api/truelayer/oauth/redirect",
 		ClientID:     os.Getenv("TRUELAYER_CLIENT_ID"),
@@ -38,8 +46,8 @@ func Init(ctx context.Context, m *mux.Router) error {
 			"offline_access",
 		},
 		Endpoint: oauth2.Endpoint{
-			AuthURL:   "https://auth.truelayer.com/?providers=uk-ob-all+uk-oauth-all+de-xs2a-all",
-			TokenURL:  "https://auth.truelayer.com/connect/token",
+			AuthURL:   config.AuthBaseURL + "/?providers=uk-ob-all+uk-oauth-all+de-xs2a-all",
+			TokenURL:  config.AuthBaseURL + "/connect/token",
 			AuthStyle: oauth2.AuthStyleAutoDetect,
 		},
 	}
@@ -54,7 +62,24 @@ func oauthLogin(w http.ResponseWriter, r *http.Request) {
 	}
 	oauthState := generateStateOauthCookie(w, u.ID)
 
-	url := OauthConfig.AuthCodeURL(oauthState, oauth2.AccessTypeOffline)
+	opts := []oauth2.AuthCodeOption{oauth2.AccessTypeOffline}
+	// renewing an existing connection's consent, the new token replaces the
+	// old one so the accounts and their sheets carry on as they were.
+	if id := r.FormValue("connection"); id != "" {
+		conn, ok := u.Connections[id]
+		if !ok {
+			http.Error(w, "unknown connection", http.StatusNotFound)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: "oauthconnection", Value: id, Expires: time.Now().Add(1 * time.Hour)})
+		if conn.ProviderID != "" {
+			opts = append(opts, oauth2.SetAuthURLParam("provider_id", conn.ProviderID))
+		}
+	} else {
+		http.SetCookie(w, &http.Cookie{Name: "oauthconnection", MaxAge: -1})
+	}
+
+	url := OauthConfig.AuthCodeURL(oauthState, opts...)
 	slog.Info(r.Context(), "generating auth URL for user: %s", u.ID)
 	http.Redirect(w, r, url, http.StatusTemporaryRedirect)
 }
@@ -75,28 +100,71 @@ func oauthCallback(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = token.Set(ctx, idgen.New("tok"), oauthState.Value, "truelayer", OauthConfig, t)
+	id := idgen.New("tok")
+	if c, err := r.Cookie("oauthconnection"); err == nil && c.Value != "" {
+		http.SetCookie(w, &http.Cookie{Name: "oauthconnection", MaxAge: -1})
+		if reconnected(ctx, oauthState.Value, c.Value, t) {
+			id = c.Value
+		}
+	}
+
+	err = token.Set(ctx, id, oauthState.Value, "truelayer", OauthConfig, t)
 	if err != nil {
 		slog.Error(ctx, "failed to set token: %s", err)
 		return
 	}
 	slog.Info(ctx, "Set token for user %s", oauthState.Value)
-	ps, err := pubsub.NewClient(ctx, util.Project())
-	if err != nil {
-		slog.Error(ctx, "error getting pubsub client: %s", err)
-		return
-	}
-	topic := ps.Topic("sync-users")
-	result := topic.Publish(ctx, &pubsub.Message{
-		Data: []byte(oauthState.Value),
+	err = queue.Publish(ctx, &queue.Message{
+		Data:       []byte(oauthState.Value),
+		Attributes: map[string]string{"trigger": domain.TriggerConnection},
 	})
-	_, err = result.Get(ctx)
 	if err != nil {
 		slog.Error(ctx, "error publishing: %s", err)
 	}
 	http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
 }
 
+// reconnected returns true if t renews the consent of the user's existing
+// connection, and clears its reminder. If the user connected a different bank
+// instead, or the connection's bank isn't known to check, it's kept as a new
+// connection.
+func reconnected(ctx context.Context, userID, connectionID string, t *oauth2.Token) bool {
+	u, err := domain.UserByID(ctx, userID)
+	if err != nil {
+		slog.Error(ctx, "error getting user %s: %s", userID, err)
+		return false
+	}
+	conn, ok := u.Connections[connectionID]
+	if !ok {
+		return false
+	}
+	m, err := NewClient(userID, t, config.APIBaseURL).Metadata(ctx)
+	if err != nil {
+		slog.Error(ctx, "error getting metadata for new token: %s", err)
+		return false
+	}
+	if conn.ProviderID == "" || m.Provider.ProviderID != conn.ProviderID {
+		slog.Warn(ctx, "connection %s is %q but %s was connected, adding a new connection", connectionID, conn.ProviderID, m.Provider.ProviderID)
+		return false
+	}
+	_, err = domain.ModifyUser(ctx, userID, func(u *domain.User) error {
+		conn, ok := u.Connections[connectionID]
+		if !ok {
+			return nil
+		}
+		conn.ConsentStatus = m.ConsentStatus
+		conn.ConsentExpiresAt = m.ConsentExpiresAt
+		conn.ConsentReminderAt = time.Time{}
+		conn.LastError = ""
+		u.Connections[connectionID] = conn
+		return nil
+	})
+	if err != nil {
+		slog.Error(ctx, "error updating connection %s: %s", connectionID, err)
+	}
+	return true
+}
+
 func generateStateOauthCookie(w http.ResponseWriter, id string) string {
 	var expiration = time.Now().Add(1 * time.Hour)
 	cookie := http.Cookie{Name: "oauthstate", Value: id, Expires: expiration}
@@ -2,7 +2,6 @@ package truelayer
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"net/http"
 	"sort"
@@ -14,35 +13,75 @@ import (
 	"github.com/monzo/slog"
 )
 
+// Config is where the TrueLayer APIs are, empty fields use TrueLayer's own.
+// Point them at a fake for local development, see cmd/faketruelayer.
+type Config struct {
+	APIBaseURL  string
+	AuthBaseURL string
+}
+
 const (
-	baseURL = "https://api.truelayer.com"
+	defaultAPIBaseURL  = "https://api.truelayer.com"
+	defaultAuthBaseURL = "https://auth.truelayer.com"
 )
 
-func GetClients(ctx context.Context, userID string) ([]*Client, error) {
+var config = Config{
+	APIBaseURL:  defaultAPIBaseURL,
+	AuthBaseURL: defaultAuthBaseURL,
+}
+
+// GetClients returns a client for each of the user's connections, and the
+// connections that are stored but whose tokens couldn't be loaded.
+func GetClients(ctx context.Context, userID string) ([]*Client, []FailedConnection, error) {
 	ts, err := token.ListByUser(ctx, userID, "truelayer", OauthConfig)
-	if err != nil && len(ts) == 0 {
-		return nil, err
-	} else if err != nil {
+	var failed []FailedConnection
+	if lerrs, ok := err.(token.LoadErrors); ok {
 		slog.Warn(ctx, "error getting tokens for user %s : %s", userID, err)
+		for id, err := range lerrs {
+			failed = append(failed, FailedConnection{ConnectionID: id, Err: err})
+		}
+		sort.Slice(failed, func(i, j int) bool { return failed[i].ConnectionID < failed[j].ConnectionID })
+	} else if err != nil {
+		return nil, nil, err
 	}
 	var cs []*Client
 	for _, t := range ts {
-		cs = append(cs, &Client{
-			userID: userID,
-			t:      t,
-			http: &http.Client{
-				Transport: http.DefaultTransport,
-				Timeout:   300 * time.Second,
-			},
-		})
+		c := NewClient(userID, t.Token, config.APIBaseURL)
+		c.ConnectionID = t.ID
+		cs = append(cs, c)
 	}
-	return cs, nil
+	return cs, failed, nil
+}
+
+// FailedConnection is a stored connection whose token couldn't be loaded,
+// usually because it couldn't be refreshed after the bank revoked consent.
+type FailedConnection struct {
+	ConnectionID string
+	Err          error
 }
 
 type Client struct {
-	userID string
-	t      *oauth2.Token
-	http   *http.Client
+	// ConnectionID is the ID of the stored token the client uses.
+	ConnectionID string
+
+	userID  string
+	t       *oauth2.Token
+	baseURL string
+	http    *http.Client
+	limiter *limiter
+}
+
+func NewClient(userID string, t *oauth2.Token, baseURL string) *Client {
+	return &Client{
+		userID:  userID,
+		t:       t,
+		baseURL: baseURL,
+		http: &http.Client{
+			Transport: http.DefaultTransport,
+			Timeout:   300 * time.Second,
+		},
+		limiter: newLimiter(RequestsPerSecond),
+	}
 }
 
 func (c *Client) authRequest(r *http.Request) {
@@ -50,39 +89,29 @@ func (c *Client) authRequest(r *http.Request) {
 }
 
 func (c *Client) Accounts(ctx context.Context) ([]Account, error) {
-	req, err := http.NewRequestWithContext(
-		ctx,
-		http.MethodGet,
-		fmt.Sprintf("%s/data/v1/accounts", baseURL),
-		nil,
-	)
-	if err != nil {
-		return nil, err
-	}
-	c.authRequest(req)
-	res, err := c.http.Do(req)
+	var as []Account
+	err := c.doRequest(ctx, "/data/v1/accounts", &as)
 	if err != nil {
 		return nil, err
 	}
-	response := struct {
-		Results []Account `json:"results"`
-		Error   string
-	}{}
-	err = json.NewDecoder(res.Body).Decode(&response)
-	for i := range response.Results {
-		response.Results[i].client = c
+	for i := range as {
+		as[i].client = c
 	}
-	return response.Results, err
+	return as, nil
 }
 
+// transactionWindow is the longest period we request transactions for at
+// once, some providers reject anything over 90 days.
+const transactionWindow = 87 * 24 * time.Hour
+
+// Transactions returns the account's transactions from the last 88 days, or
+// if historic is set walks back through the account's full history until the
+// provider returns nothing.
 func (c *Client) Transactions(ctx context.Context, kind, accountID string, historic bool) ([]Transaction, error) {
 	t := time.Now()
 	txs := make(map[string]Transaction)
 	for {
-		var res []Transaction
-		ts := t.Add(-88 * 24 * time.Hour).Format("2006-01-02T15:04:05Z")
-		now := t.Format("2006-01-02T15:04:05Z")
-		err := c.doRequest(ctx, fmt.Sprintf("/data/v1/%s/%s/transactions?from=%s&to=%s", kind, accountID, ts, now), &res)
+		res, err := c.transactions(ctx, kind, accountID, t.Add(-88*24*time.Hour), t)
 		if err != nil {
 			return nil, err
 		}
@@ -95,8 +124,54 @@ func (c *Client) Transactions(ctx context.Context, kind, accountID string, histo
 		if !historic {
 			break
 		}
-		t = t.AddDate(0, 0, -87)
+		t = t.Add(-transactionWindow)
 	}
+	return sortTransactions(txs), nil
+}
+
+// TransactionsSince returns the account's transactions between since and now.
+func (c *Client) TransactionsSince(ctx context.Context, kind, accountID string, since time.Time) ([]Transaction, error) {
+	now := time.Now()
+	txs := make(map[string]Transaction)
+	for from := since; from.Before(now); from = from.Add(transactionWindow) {
+		to := from.Add(transactionWindow)
+		if to.After(now) {
+			to = now
+		}
+		res, err := c.transactions(ctx, kind, accountID, from, to)
+		if err != nil {
+			return nil, err
+		}
+		for _, tx := range res {
+			txs[tx.TransactionID] = tx
+		}
+	}
+	return sortTransactions(txs), nil
+}
+
+// PendingTransactions returns the account's transactions which haven't
+// settled yet. Once settled they're returned by Transactions, usually with a
+// different ID.
+func (c *Client) PendingTransactions(ctx context.Context, kind, accountID string) ([]Transaction, error) {
+	var res []Transaction
+	err := c.doRequest(ctx, fmt.Sprintf("/data/v1/%s/%s/transactions/pending", kind, accountID), &res)
+	if err != nil {
+		return nil, err
+	}
+	for i := range res {
+		res[i].Pending = true
+	}
+	return res, nil
+}
+
+func (c *Client) transactions(ctx context.Context, kind, accountID string, from, to time.Time) ([]Transaction, error) {
+	var res []Transaction
+	err := c.doRequest(ctx, fmt.Sprintf("/data/v1/%s/%s/transactions?from=%s&to=%s",
+		kind, accountID, from.UTC().Format("2006-01-02T15:04:05Z"), to.UTC().Format("2006-01-02T15:04:05Z")), &res)
+	return res, err
+}
+
+func sortTransactions(txs map[string]Transaction) []Transaction {
 	var out []Transaction
 	for _, tx := range txs {
 		out = append(out, tx)
@@ -104,7 +179,7 @@ func (c *Client) Transactions(ctx context.Context, kind, accountID string, histo
 	sort.Slice(out, func(i, j int) bool {
 		return out[i].Timestamp < out[j].Timestamp
 	})
-	return out, nil
+	return out
 }
 
 func (c *Client) Balance(ctx context.Context, kind, accountID string) (*Balance, error) {
@@ -144,35 +219,16 @@ func (c *Client) Cards(ctx context.Context) ([]Card, error) {
 }
 
 func (c *Client) doRequest(ctx context.Context, path string, results interface{}) error {
-	req, err := http.NewRequestWithContext(
-		ctx,
-		http.MethodGet,
-		baseURL+path,
-		nil,
-	)
-	if err != nil {
-		return err
-	}
-	c.authRequest(req)
-	res, err := c.http.Do(req)
-	if err != nil {
-		return err
-	}
 	response := struct {
 		Results interface{} `json:"results"`
 	}{}
 	response.Results = results
-	err = json.NewDecoder(res.Body).Decode(&response)
-	return err
+	return get(ctx, c.http, c.limiter, c.baseURL+path, c.authRequest, &response)
 }
 
 func Providers(ctx context.Context) ([]Provider, error) {
-	res, err := http.Get(fmt.Sprintf("https://auth.truelayer.com/api/providers?clientid=%s", OauthConfig.ClientID))
-	if err != nil {
-		return nil, err
-	}
 	var ps []Provider
-	err = json.NewDecoder(res.Body).Decode(&ps)
+	err := get(ctx, http.DefaultClient, providersLimiter, fmt.Sprintf("%s/api/providers?clientid=%s", config.AuthBaseURL, OauthConfig.ClientID), nil, &ps)
 	if err != nil {
 		return nil, err
 	}
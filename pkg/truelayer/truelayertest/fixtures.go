@@ -0,0 +1,153 @@
+package truelayertest
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/truelayer"
+)
+
+var demoMerchants = []struct {
+	name, category string
+	min, max       float64
+}{
+	{"TESCO STORES", "PURCHASE", 5, 80},
+	{"PRET A MANGER", "PURCHASE", 3, 12},
+	{"TFL TRAVEL CH", "PURCHASE", 1.5, 9},
+	{"AMAZON.CO.UK", "PURCHASE", 5, 120},
+	{"DELIVEROO", "PURCHASE", 12, 40},
+	{"THAMES WATER", "DIRECT_DEBIT", 30, 45},
+}
+
+// DemoConnection returns a connection with a current account and a credit
+// card, each with a year of generated transactions ending at now and a couple
+// of pending transactions from the last few hours. The same seed always
+// produces the same data.
+func DemoConnection(seed int64, now time.Time) *Connection {
+	r := rand.New(rand.NewSource(seed))
+	provider := truelayer.Provider{
+		DisplayName: "Demo Bank",
+		ProviderID:  "ob-demo",
+	}
+	account := truelayer.Account{
+		UpdateTimestamp: now,
+		AccountID:       fmt.Sprintf("acc-%d", seed),
+		AccountType:     "TRANSACTION",
+		DisplayName:     "Current Account",
+		Currency:        "GBP",
+		AccountNumber: truelayer.AccountNumber{
+			Number:   "12345678",
+			SortCode: "01-02-03",
+		},
+		Provider: provider,
+	}
+	card := truelayer.Card{
+		AccountID:         fmt.Sprintf("card-%d", seed),
+		CardNetwork:       "VISA",
+		CardType:          "CREDIT",
+		Currency:          "GBP",
+		DisplayName:       "Credit Card",
+		PartialCardNumber: "1234",
+		UpdateTimestamp:   now,
+		Provider:          provider,
+	}
+
+	accountTxs := demoTransactions(r, account.AccountID, now, true)
+	cardTxs := demoTransactions(r, card.AccountID, now, false)
+
+	return &Connection{
+		Metadata: truelayer.Metadata{
+			ClientID:               "demo",
+			CredentialsID:          fmt.Sprintf("cred-%d", seed),
+			ConsentStatus:          "Authorised",
+			ConsentStatusUpdatedAt: now.AddDate(0, 0, -30),
+			ConsentCreatedAt:       now.AddDate(0, 0, -30),
+			ConsentExpiresAt:       now.AddDate(0, 0, 60),
+			Provider:               provider,
+			Scopes:                 []string{"accounts", "balance", "cards", "transactions", "offline_access"},
+		},
+		Accounts: []truelayer.Account{account},
+		Cards:    []truelayer.Card{card},
+		Transactions: map[string][]truelayer.Transaction{
+			account.AccountID: accountTxs,
+			card.AccountID:    cardTxs,
+		},
+		Pending: map[string][]truelayer.Transaction{
+			account.AccountID: demoPending(r, account.AccountID, now),
+			card.AccountID:    demoPending(r, card.AccountID, now),
+		},
+		Balances: map[string]truelayer.Balance{
+			account.AccountID: {
+				Currency:        "GBP",
+				Available:       sum(accountTxs) + 500,
+				Current:         sum(accountTxs),
+				Overdraft:       500,
+				UpdateTimestamp: now,
+			},
+			card.AccountID: {
+				Currency:        "GBP",
+				Available:       2000 + sum(cardTxs),
+				Current:         -sum(cardTxs),
+				UpdateTimestamp: now,
+			},
+		},
+	}
+}
+
+func demoTransactions(r *rand.Rand, accountID string, now time.Time, salary bool) []truelayer.Transaction {
+	var txs []truelayer.Transaction
+	start := now.AddDate(-1, 0, 0).Truncate(24 * time.Hour)
+	for day := start; day.Before(now); day = day.AddDate(0, 0, 1) {
+		if salary && day.Day() == 25 {
+			txs = append(txs, demoTransaction(accountID, len(txs), day, "ACME LTD SALARY", "CREDIT", "CREDIT", 2500))
+		}
+		for i := 0; i < r.Intn(3); i++ {
+			m := demoMerchants[r.Intn(len(demoMerchants))]
+			amount := math.Round((m.min+r.Float64()*(m.max-m.min))*100) / 100
+			ts := day.Add(time.Duration(8+r.Intn(12)) * time.Hour)
+			if ts.After(now) {
+				continue
+			}
+			txs = append(txs, demoTransaction(accountID, len(txs), ts, m.name, "DEBIT", m.category, -amount))
+		}
+	}
+	return txs
+}
+
+func demoPending(r *rand.Rand, accountID string, now time.Time) []truelayer.Transaction {
+	var txs []truelayer.Transaction
+	for i := 0; i < 2; i++ {
+		m := demoMerchants[r.Intn(len(demoMerchants))]
+		amount := math.Round((m.min+r.Float64()*(m.max-m.min))*100) / 100
+		tx := demoTransaction(accountID, i, now.Add(-time.Duration(i+1)*time.Hour), m.name, "DEBIT", m.category, -amount)
+		tx.TransactionID = fmt.Sprintf("%s-pending-%05d", accountID, i)
+		txs = append(txs, tx)
+	}
+	return txs
+}
+
+func demoTransaction(accountID string, n int, ts time.Time, description, kind, category string, amount float64) truelayer.Transaction {
+	return truelayer.Transaction{
+		TransactionID:       fmt.Sprintf("%s-tx-%05d", accountID, n),
+		Timestamp:           ts.UTC().Format(time.RFC3339),
+		Description:         description,
+		Amount:              amount,
+		Currency:            "GBP",
+		TransactionType:     kind,
+		TransactionCategory: category,
+		MerchantName:        description,
+		Meta: truelayer.Meta{
+			ProviderTransactionCategory: category,
+		},
+	}
+}
+
+func sum(txs []truelayer.Transaction) float64 {
+	var total float64
+	for _, tx := range txs {
+		total += tx.Amount
+	}
+	return math.Round(total*100) / 100
+}
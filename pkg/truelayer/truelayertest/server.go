@@ -0,0 +1,388 @@
+// Package truelayertest provides a fake TrueLayer Data API and auth server
+// serving seeded fixtures, for tests and local development.
+package truelayertest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"github.com/arussellsaw/youneedaspreadsheet/pkg/truelayer"
+)
+
+// Connection is the data visible to one access token, like a single bank
+// connection made through the auth flow.
+type Connection struct {
+	Metadata truelayer.Metadata
+	Accounts []truelayer.Account
+	Cards    []truelayer.Card
+	// Transactions, Pending and Balances are keyed by account or card ID.
+	Transactions map[string][]truelayer.Transaction
+	Pending      map[string][]truelayer.Transaction
+	Balances     map[string]truelayer.Balance
+}
+
+// Failure is an error response returned for requests matching a path prefix.
+type Failure struct {
+	Status      int
+	Error       string
+	Description string
+	// RetryAfter is sent as the Retry-After header when set.
+	RetryAfter string
+	// Times is how many requests fail before the path recovers, 0 fails
+	// forever.
+	Times int
+}
+
+type failure struct {
+	prefix string
+	Failure
+	remaining int
+}
+
+type gap struct {
+	accountID string
+	from, to  time.Time
+}
+
+type Server struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	conns     map[string]*Connection
+	expired   map[string]bool
+	refreshes map[string]string
+	failures  []*failure
+	gaps      []gap
+	requests  []string
+}
+
+// NewServer starts a fake on a local port, close it when finished.
+func NewServer() *Server {
+	s := NewUnstartedServer()
+	s.Start()
+	return s
+}
+
+// NewUnstartedServer returns a fake that isn't listening yet, to change its
+// listener before calling Start.
+func NewUnstartedServer() *Server {
+	s := &Server{
+		conns:     make(map[string]*Connection),
+		expired:   make(map[string]bool),
+		refreshes: make(map[string]string),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.handleAuth)
+	mux.HandleFunc("/connect/token", s.handleToken)
+	mux.HandleFunc("/api/providers", s.handleProviders)
+	mux.HandleFunc("/data/v1/", s.handleData)
+	s.Server = httptest.NewUnstartedServer(mux)
+	return s
+}
+
+// AddConnection serves c to requests authorised with accessToken, the access
+// token is also the authorisation code handed out by the fake auth flow.
+func (s *Server) AddConnection(accessToken string, c *Connection) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conns[accessToken] = c
+	s.refreshes["refresh-"+accessToken] = accessToken
+}
+
+// Client returns a truelayer.Client talking to the fake.
+func (s *Server) Client(userID, accessToken string) *truelayer.Client {
+	c := truelayer.NewClient(userID, s.Token(accessToken), s.URL)
+	c.ConnectionID = accessToken
+	return c
+}
+
+// Token returns the token the fake's auth flow would issue for accessToken.
+func (s *Server) Token(accessToken string) *oauth2.Token {
+	return &oauth2.Token{
+		AccessToken:  accessToken,
+		RefreshToken: "refresh-" + accessToken,
+		TokenType:    "Bearer",
+		Expiry:       time.Now().Add(time.Hour),
+	}
+}
+
+// ExpireToken makes data requests with accessToken fail with a 401 until it's
+// refreshed.
+func (s *Server) ExpireToken(accessToken string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expired[accessToken] = true
+}
+
+// Fail makes requests whose path starts with prefix fail.
+func (s *Server) Fail(prefix string, f Failure) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = append(s.failures, &failure{prefix: prefix, Failure: f, remaining: f.Times})
+}
+
+// Gap hides an account's transactions between from and to, as if the bank
+// returned nothing for that period.
+func (s *Server) Gap(accountID string, from, to time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gaps = append(s.gaps, gap{accountID: accountID, from: from, to: to})
+}
+
+// Settle moves the pending transaction with pendingID to the settled
+// transactions under transactionID, like banks do once a payment clears. It
+// returns false if there's no such pending transaction.
+func (s *Server) Settle(pendingID, transactionID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		for accountID, pending := range c.Pending {
+			for i, tx := range pending {
+				if tx.TransactionID != pendingID {
+					continue
+				}
+				c.Pending[accountID] = append(pending[:i:i], pending[i+1:]...)
+				tx.TransactionID = transactionID
+				c.Transactions[accountID] = append(c.Transactions[accountID], tx)
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Requests returns the request URIs the fake has served, in order.
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+func (s *Server) handleAuth(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	redirect, err := url.Parse(r.FormValue("redirect_uri"))
+	if err != nil || redirect.String() == "" {
+		http.Error(w, "missing redirect_uri", http.StatusBadRequest)
+		return
+	}
+	// there's no consent screen, the first connection is always granted
+	s.mu.Lock()
+	var code string
+	for accessToken := range s.conns {
+		if code == "" || accessToken < code {
+			code = accessToken
+		}
+	}
+	s.mu.Unlock()
+	q := redirect.Query()
+	q.Set("code", code)
+	q.Set("state", r.FormValue("state"))
+	redirect.RawQuery = q.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	var accessToken string
+	switch r.FormValue("grant_type") {
+	case "authorization_code":
+		if _, ok := s.conns[r.FormValue("code")]; ok {
+			accessToken = r.FormValue("code")
+		}
+	case "refresh_token":
+		accessToken = s.refreshes[r.FormValue("refresh_token")]
+	}
+	if accessToken != "" {
+		delete(s.expired, accessToken)
+	}
+	s.mu.Unlock()
+
+	if accessToken == "" {
+		writeError(w, http.StatusBadRequest, "invalid_grant", "unknown code or refresh token")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token":  accessToken,
+		"refresh_token": "refresh-" + accessToken,
+		"token_type":    "Bearer",
+		"expires_in":    3600,
+	})
+}
+
+func (s *Server) handleProviders(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	var ps []truelayer.Provider
+	seen := make(map[string]bool)
+	for _, c := range s.conns {
+		p := c.Metadata.Provider
+		if !seen[p.ProviderID] {
+			seen[p.ProviderID] = true
+			ps = append(ps, p)
+		}
+	}
+	s.mu.Unlock()
+	json.NewEncoder(w).Encode(ps)
+}
+
+func (s *Server) handleData(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, r.URL.RequestURI())
+
+	for _, f := range s.failures {
+		if !strings.HasPrefix(r.URL.Path, f.prefix) || (f.Times > 0 && f.remaining == 0) {
+			continue
+		}
+		f.remaining--
+		if f.RetryAfter != "" {
+			w.Header().Set("Retry-After", f.RetryAfter)
+		}
+		writeError(w, f.Status, f.Error, f.Description)
+		return
+	}
+
+	accessToken := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	c, ok := s.conns[accessToken]
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "invalid_token", "unknown access token")
+		return
+	}
+	if s.expired[accessToken] {
+		writeError(w, http.StatusUnauthorized, "invalid_token", "access token has expired")
+		return
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/data/v1/"), "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "me":
+		writeResults(w, []truelayer.Metadata{c.Metadata})
+	case len(parts) == 1 && parts[0] == "accounts":
+		writeResults(w, c.Accounts)
+	case len(parts) == 1 && parts[0] == "cards":
+		writeResults(w, c.Cards)
+	case len(parts) == 3 && (parts[0] == "accounts" || parts[0] == "cards"):
+		if !s.hasAccount(c, parts[0], parts[1]) {
+			writeError(w, http.StatusNotFound, "account_not_found", fmt.Sprintf("no %s with id %s", parts[0], parts[1]))
+			return
+		}
+		switch parts[2] {
+		case "balance":
+			b, ok := c.Balances[parts[1]]
+			if !ok {
+				writeResults(w, []truelayer.Balance{})
+				return
+			}
+			writeResults(w, []truelayer.Balance{b})
+		case "transactions":
+			txs, err := s.transactions(c, parts[1], r.URL.Query())
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "invalid_date_range", err.Error())
+				return
+			}
+			writeResults(w, txs)
+		default:
+			http.NotFound(w, r)
+		}
+	case len(parts) == 4 && (parts[0] == "accounts" || parts[0] == "cards") && parts[2] == "transactions" && parts[3] == "pending":
+		if !s.hasAccount(c, parts[0], parts[1]) {
+			writeError(w, http.StatusNotFound, "account_not_found", fmt.Sprintf("no %s with id %s", parts[0], parts[1]))
+			return
+		}
+		pending := c.Pending[parts[1]]
+		if pending == nil {
+			pending = []truelayer.Transaction{}
+		}
+		writeResults(w, pending)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) hasAccount(c *Connection, kind, id string) bool {
+	if kind == "cards" {
+		for _, card := range c.Cards {
+			if card.AccountID == id {
+				return true
+			}
+		}
+		return false
+	}
+	for _, acc := range c.Accounts {
+		if acc.AccountID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) transactions(c *Connection, accountID string, q url.Values) ([]truelayer.Transaction, error) {
+	from, err := parseTime(q.Get("from"), time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	to, err := parseTime(q.Get("to"), time.Now())
+	if err != nil {
+		return nil, err
+	}
+	out := []truelayer.Transaction{}
+	for _, tx := range c.Transactions[accountID] {
+		ts, err := time.Parse(time.RFC3339, tx.Timestamp)
+		if err != nil {
+			return nil, err
+		}
+		if ts.Before(from) || ts.After(to) || s.inGap(accountID, ts) {
+			continue
+		}
+		out = append(out, tx)
+	}
+	return out, nil
+}
+
+func (s *Server) inGap(accountID string, ts time.Time) bool {
+	for _, g := range s.gaps {
+		if g.accountID == accountID && !ts.Before(g.from) && !ts.After(g.to) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseTime(v string, def time.Time) (time.Time, error) {
+	if v == "" {
+		return def, nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", v)
+}
+
+func writeResults(w http.ResponseWriter, results interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"results": results,
+		"status":  "Succeeded",
+	})
+}
+
+func writeError(w http.ResponseWriter, status int, code, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":             code,
+		"error_description": description,
+		"error_details":     map[string]string{},
+	})
+}
@@ -29,10 +29,26 @@ func (a Account) ProviderName() string {
 	return a.Provider.DisplayName
 }
 
+func (a Account) ConnectionID() string {
+	return a.client.ConnectionID
+}
+
+func (a Account) CurrencyCode() string {
+	return a.Currency
+}
+
 func (a Account) Transactions(ctx context.Context, historic bool) ([]Transaction, error) {
 	return a.client.Transactions(ctx, "accounts", a.AccountID, historic)
 }
 
+func (a Account) TransactionsSince(ctx context.Context, since time.Time) ([]Transaction, error) {
+	return a.client.TransactionsSince(ctx, "accounts", a.AccountID, since)
+}
+
+func (a Account) PendingTransactions(ctx context.Context) ([]Transaction, error) {
+	return a.client.PendingTransactions(ctx, "accounts", a.AccountID)
+}
+
 func (a Account) Balance(ctx context.Context) (*Balance, error) {
 	return a.client.Balance(ctx, "accounts", a.AccountID)
 }
@@ -56,6 +72,9 @@ type Transaction struct {
 	MerchantName              string         `json:"merchant_name"`
 	RunningBalance            RunningBalance `json:"running_balance"`
 	Meta                      Meta           `json:"meta"`
+	// Pending is set on transactions from the pending endpoint, which haven't
+	// settled yet.
+	Pending bool `json:"-"`
 }
 
 type RunningBalance struct {
@@ -123,10 +142,26 @@ func (c Card) ProviderName() string {
 	return c.Provider.DisplayName
 }
 
+func (c Card) ConnectionID() string {
+	return c.client.ConnectionID
+}
+
+func (c Card) CurrencyCode() string {
+	return c.Currency
+}
+
 func (c Card) Transactions(ctx context.Context, historic bool) ([]Transaction, error) {
 	return c.client.Transactions(ctx, "cards", c.AccountID, historic)
 }
 
+func (c Card) TransactionsSince(ctx context.Context, since time.Time) ([]Transaction, error) {
+	return c.client.TransactionsSince(ctx, "cards", c.AccountID, since)
+}
+
+func (c Card) PendingTransactions(ctx context.Context) ([]Transaction, error) {
+	return c.client.PendingTransactions(ctx, "cards", c.AccountID)
+}
+
 func (c Card) Balance(ctx context.Context) (*Balance, error) {
 	b, err := c.client.Balance(ctx, "cards", c.AccountID)
 	if err != nil {
@@ -142,12 +177,16 @@ type Balancer interface {
 
 type Transactioner interface {
 	Transactions(context.Context, bool) ([]Transaction, error)
+	TransactionsSince(context.Context, time.Time) ([]Transaction, error)
+	PendingTransactions(context.Context) ([]Transaction, error)
 }
 
 type AbstractAccount interface {
 	ID() string
 	Name() string
 	ProviderName() string
+	ConnectionID() string
+	CurrencyCode() string
 	Balancer
 	Transactioner
 }